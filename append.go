@@ -0,0 +1,118 @@
+package wormdb
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Open a finalized wormdb to add more records onto the end of it, where every
+// record added must sort after the last record already in the file.  The
+// search must hold the index of the file, as it would for [Open], and it has
+// the blocks which are added appended to it by Finalize.  The options must be
+// the same as those the wormdb was built with.
+//
+// The last block is read back in and filled up before any new blocks are
+// begun, so only it is written over.  A compressed wormdb is cut off before
+// its last block straight away, so the block is lost if the append does not
+// reach Finalize.  A bloom filter can not be extended and is an error, and as
+// the number of records already in the file is not known, [DB.Len] returns -1.
+func OpenForAppend(file *os.File, search Search, options ...Option) (*DB, error) {
+	db, err := open(file, append(options, WithSearch(search))...)
+	if err != nil {
+		return nil, err
+	}
+	if db.bloomBits > 0 || db.bloom != nil {
+		return nil, fmt.Errorf("A bloom filter can not be extended by appending")
+	}
+	s, ok := search.(interface{ reopen() })
+	if !ok {
+		return nil, fmt.Errorf("Search method %T can not be appended to", search)
+	}
+	if db.codec != nil {
+		if err := db.loadOffsets(); err != nil {
+			return nil, err
+		}
+	}
+	if len(db.indexes) > 0 {
+		if err := db.buildIndexes(); err != nil {
+			return nil, err
+		}
+	}
+	blocks, err := db.blocks()
+	if err != nil {
+		return nil, err
+	}
+	s.reopen()
+
+	db.block = make([]byte, db.blocksize)
+	db.prev = make([]byte, 0, db.recHint)
+	if blocks > 0 {
+		// Pick up where the last block left off
+		last := blocks - 1
+		buf := db.readpool.Get().([]byte)
+		defer db.readpool.Put(buf)
+		b, err := db.readSector(buf, last)
+		if err != nil {
+			return nil, err
+		}
+		c := db.newCursor()
+		c.reset(b, last)
+		for {
+			ok, err := c.next()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			db.recs++
+			db.prev = append(db.prev[:0], c.rec...)
+		}
+		if db.recs == 0 {
+			return nil, fmt.Errorf("Last block %d holds no records", last)
+		}
+		db.nblocks = int(blocks)
+		if len(b) > db.blocksize-db.reserved {
+			// A large record has its block to itself, see WithLargeRecords, so
+			// the block is kept and a new one begun after it
+			db.recs = 0
+			db.written = db.offsets[blocks]
+			db.offsets = db.offsets[:blocks]
+		} else {
+			db.used = copy(db.block, b[:c.pos])
+
+			db.written = last << db.shift
+			if db.codec != nil {
+				db.written = db.offsets[last]
+				db.offsets = db.offsets[:last]
+				if err := file.Truncate(db.base() + db.written); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	w := io.NewOffsetWriter(file, db.base()+db.written)
+	db.writeBuf = bufio.NewWriterSize(w, int(db.blocksize*8))
+	return db, nil
+}
+
+// reopen lets a finalized search have more entries added to it.
+func (s *BinarySearch) reopen() {
+	if s.list != nil {
+		return
+	}
+	s.list = list.New()
+	for _, entry := range s.Index {
+		s.list.PushBack(entry)
+	}
+	s.Index, s.lowerByte, s.upperByte = nil, nil, nil
+}
+
+// reopen lets a finalized search have more entries added to it.
+func (s *TrieSearch) reopen() {
+	s.finalized = false
+}
@@ -0,0 +1,87 @@
+package wormdb_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+func TestOpenForAppend(t *testing.T) {
+	codec, err := bwdb.NewGzipCodec(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []string
+	for i := 0; i < 600; i++ {
+		recs = append(recs, fmt.Sprintf("append %04d", i))
+	}
+	for name, opts := range map[string][]bwdb.Option{
+		"plain":    {bwdb.WithBlockSize(256)},
+		"checksum": {bwdb.WithBlockSize(256), bwdb.WithBlockChecksum()},
+		"compress": {bwdb.WithBlockSize(256), bwdb.WithCompression(codec)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "append.db")
+			f, err := os.Create(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bs := bwdb.NewBinarySearch()
+			db, err := bwdb.New(f, append(opts, bwdb.WithSearch(bs))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rec := range recs[:250] {
+				if err := db.Add([]byte(rec)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = os.OpenFile(file, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err = bwdb.OpenForAppend(f, bs, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Add([]byte(recs[100])); err == nil {
+				t.Fatal("expected an error adding a record before the last one")
+			}
+			for _, rec := range recs[250:] {
+				if err := db.Add([]byte(rec)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Finalize(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := walkAll(t, db); !slices.Equal(got, recs) {
+				t.Fatalf("walked %d records, want %d", len(got), len(recs))
+			}
+			for _, rec := range []string{recs[0], recs[249], recs[250], recs[599]} {
+				var got string
+				err := db.Get([]byte(rec), func(b []byte) error {
+					got = string(b)
+					return nil
+				})
+				if err != nil || got != rec {
+					t.Errorf("Get(%q) = %q, %v", rec, got, err)
+				}
+			}
+			if err := db.Verify(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package wormdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Keep the last size blocks read from the file in memory, so that lookups and
+// walks which land in the same blocks again skip reading them.  Unlike the
+// cache of [WithCache], which holds the answer to each needle, this holds the
+// blocks themselves by their number, and so helps range walks and batches of
+// nearby needles.  The least recently used block is dropped once the cache is
+// full.  Blocks are held after checking their checksum and decompressing
+// them, and the option does nothing for a wormdb which is memory mapped.
+func WithBlockCache(size int) Option {
+	return func(d *DB) {
+		d.bcache = nil
+		if size > 0 {
+			d.bcache = &blockCache{
+				max:     size,
+				list:    list.New(),
+				sectors: make(map[int64]*list.Element),
+			}
+		}
+	}
+}
+
+// blockCache is a least recently used cache of blocks by their number.  The
+// blocks held are never written to, so a block dropped from the cache is left
+// for the garbage collector rather than reused, as a reader may still hold it.
+type blockCache struct {
+	mu      sync.Mutex
+	max     int
+	list    *list.List // Cached blocks, the most recently used at the back
+	sectors map[int64]*list.Element
+}
+
+// cachedBlock is a block held in the cache.
+type cachedBlock struct {
+	n   int64
+	b   []byte
+	eof bool // The block is the last in the file
+}
+
+// get returns the block n when it is held.
+func (c *blockCache) get(n int64) (b []byte, eof, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.sectors[n]
+	if !ok {
+		return nil, false, false
+	}
+	c.list.MoveToBack(e)
+	cb := e.Value.(*cachedBlock)
+	return cb.b, cb.eof, true
+}
+
+// put holds the block n, which must not be written to afterwards.
+func (c *blockCache) put(n int64, b []byte, eof bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sectors[n]; ok {
+		// Read by another lookup at the same time
+		return
+	}
+	c.sectors[n] = c.list.PushBack(&cachedBlock{n: n, b: b, eof: eof})
+	for c.list.Len() > c.max {
+		front := c.list.Front()
+		delete(c.sectors, front.Value.(*cachedBlock).n)
+		c.list.Remove(front)
+	}
+}
+
+// clear drops every block, as the blocks of the file may have changed.
+func (c *blockCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.list.Init()
+	clear(c.sectors)
+}
@@ -0,0 +1,79 @@
+package wormdb
+
+import (
+	"bytes"
+	"math/bits"
+	"slices"
+)
+
+const (
+	minSuggestedBlock = 4096    // A disk reads a page at a time, so smaller saves nothing
+	maxSuggestedBlock = 1 << 20 // Beyond this each lookup reads far more than it needs
+	indexEntryBytes   = 24      // Slice header held for each entry of a BinarySearch
+)
+
+// SuggestBlockSize returns a block size for [WithBlockSize] which keeps the
+// index of a [BinarySearch] within targetIndexBytes of memory, reading as
+// little as possible on each lookup.  The sample keys are taken as the whole
+// set of records, in any order, so to plan for ten times the records of the
+// sample, pass a tenth of the budget.
+//
+// The estimate assumes the built in prefix compression, working out the
+// bytes stored for each record from the average length of the keys and the
+// average prefix each shares with the key before it.  The block size returned
+// is a power of two, no smaller than 4096, the size of a disk read, and large
+// enough to hold the longest key.  When no size up to 1 MiB meets the budget,
+// 1 MiB is returned, or the size needed by the longest key when larger.
+func SuggestBlockSize(sampleKeys [][]byte, targetIndexBytes int) int {
+	if len(sampleKeys) == 0 {
+		return minSuggestedBlock
+	}
+	sampleKeys = slices.Clone(sampleKeys)
+	slices.SortFunc(sampleKeys, bytes.Compare)
+	var keyBytes, storedBytes, longest int
+	for i, key := range sampleKeys {
+		keyBytes += len(key)
+		longest = max(longest, len(key))
+		shared := 0
+		if i > 0 {
+			shared = commonPrefix(sampleKeys[i-1], key)
+		}
+		// The prefix and record lengths take a byte each, or more as varints
+		storedBytes += len(key) - shared + 2*lenBytes(len(key))
+	}
+	entryBytes := keyBytes/len(sampleKeys) + indexEntryBytes
+
+	size := minSuggestedBlock
+	if need := longest + lenBytes(longest) + padEnd; need > size {
+		size = 1 << bits.Len(uint(need-1))
+	}
+	for ; size < maxSuggestedBlock; size *= 2 {
+		// The first record of each block is stored whole, which is made up
+		// for by the end of the block left unused
+		blocks := storedBytes/(size-padEnd) + 1
+		if blocks*entryBytes <= targetIndexBytes {
+			break
+		}
+	}
+	return size
+}
+
+// commonPrefix returns the number of leading bytes which a and b share.
+func commonPrefix(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// lenBytes returns the bytes taken by a stored length of v, a single byte up
+// to 255 and a varint beyond.
+func lenBytes(v int) int {
+	if v <= 255 {
+		return 1
+	}
+	return (bits.Len(uint(v)) + 6) / 7
+}
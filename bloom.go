@@ -0,0 +1,152 @@
+package wormdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Bloom is a bloom filter over the key of every record in a wormdb, which lets
+// [DB.GetExact] and [DB.GetValue] return for a key which is not there without
+// reading from disk.  See [WithBloom].
+type Bloom struct {
+	bits []uint64
+	k    int // Number of bits set for each key
+}
+
+// The saved bloom filter begins with this magic followed by a format version
+// byte.
+const (
+	bloomMagic   = "WORMBF"
+	bloomVersion = 1
+)
+
+// Build a bloom filter with each of the records added to the wormdb while it
+// is being written, using bitsPerKey bits of memory for each record.  The
+// false positive rate falls as bitsPerKey grows, 10 bits gives about 1% and
+// each further 5 bits divides it by about ten.  The hash of every record is
+// held in memory until Finalize, when the size of the filter is known.
+//
+// The filter holds whole keys, so it is only used by the lookups of a whole
+// key, [DB.GetExact] and [DB.GetValue], which skip the read for most keys not
+// in the wormdb.  Lookups by prefix, such as [DB.Get], do not use it.  Save the
+// filter from [DB.Bloom] and load it again with [WithBloomFilter].
+func WithBloom(bitsPerKey int) Option {
+	return func(d *DB) {
+		d.bloomBits = bitsPerKey
+	}
+}
+
+// Use a bloom filter which was saved with [Bloom.Save] for the whole key
+// lookups of an opened wormdb, see [WithBloom].
+func WithBloomFilter(b *Bloom) Option {
+	return func(d *DB) {
+		d.bloom = b
+	}
+}
+
+// Bloom returns the bloom filter of the wormdb, which is built by Finalize
+// when [WithBloom] is used.
+func (d *DB) Bloom() *Bloom {
+	return d.bloom
+}
+
+// bloomHash returns the 64 bit FNV-1a hash of a key.
+func bloomHash(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// newBloom sizes a filter for the hashes and sets their bits.
+func newBloom(hashes []uint64, bitsPerKey int) *Bloom {
+	k := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	b := &Bloom{
+		bits: make([]uint64, (max(len(hashes)*bitsPerKey, 64)+63)/64),
+		k:    min(max(k, 1), 30),
+	}
+	for _, h := range hashes {
+		b.set(h)
+	}
+	return b
+}
+
+// set turns on the bits for the hash, which are picked with double hashing.
+func (b *Bloom) set(h uint64) {
+	m := uint64(len(b.bits)) * 64
+	h1, h2 := h, h>>33|h<<31
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Has reports whether the key may be in the wormdb.  A false result means no
+// record has that key, though a record may still begin with it.
+func (b *Bloom) Has(key []byte) bool {
+	h := bloomHash(key)
+	m := uint64(len(b.bits)) * 64
+	h1, h2 := h, h>>33|h<<31
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Save writes the bloom filter out so it can be loaded again with
+// [LoadBloom].
+func (b *Bloom) Save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(bloomMagic)
+	bw.WriteByte(bloomVersion)
+
+	var tmp [binary.MaxVarintLen64]byte
+	bw.Write(binary.AppendUvarint(tmp[:0], uint64(b.k)))
+	bw.Write(binary.AppendUvarint(tmp[:0], uint64(len(b.bits))))
+	for _, word := range b.bits {
+		bw.Write(binary.LittleEndian.AppendUint64(tmp[:0], word))
+	}
+	return bw.Flush()
+}
+
+// Load a bloom filter which was written out with [Bloom.Save].
+func LoadBloom(r io.Reader) (*Bloom, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(bloomMagic)+1)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, fmt.Errorf("Could not read bloom header: %w", err)
+	}
+	if string(head[:len(bloomMagic)]) != bloomMagic {
+		return nil, fmt.Errorf("Invalid bloom magic %q", head[:len(bloomMagic)])
+	}
+	if v := head[len(bloomMagic)]; v != bloomVersion {
+		return nil, fmt.Errorf("Unsupported bloom version %d", v)
+	}
+
+	k, err := binary.ReadUvarint(br)
+	if err != nil || k < 1 || k > 30 {
+		return nil, fmt.Errorf("Invalid bloom hash count %d: %v", k, err)
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil || n < 1 || n > 1<<40 {
+		return nil, fmt.Errorf("Invalid bloom size %d: %v", n, err)
+	}
+	// Avoid trusting the size for the allocation in case it is bogus
+	b := &Bloom{k: int(k), bits: make([]uint64, 0, min(n, 1<<16))}
+	var word [8]byte
+	for i := uint64(0); i < n; i++ {
+		if _, err := io.ReadFull(br, word[:]); err != nil {
+			return nil, fmt.Errorf("Could not read bloom filter: %w", err)
+		}
+		b.bits = append(b.bits, binary.LittleEndian.Uint64(word[:]))
+	}
+	return b, nil
+}
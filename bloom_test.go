@@ -0,0 +1,92 @@
+package wormdb_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+func TestBloom(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bloom.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBloom(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		if err := db.Add([]byte(fmt.Sprintf("bloom %05d", i*2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved bytes.Buffer
+	if err := db.Bloom().Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	bloom, err := bwdb.LoadBloom(bytes.NewReader(saved.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &countingReaderAt{ReaderAt: bytes.NewReader(raw)}
+	db, err = bwdb.OpenReaderAt(r, bwdb.WithSearch(bwdb.LoadBinarySearch(bs.Index)), bwdb.WithBloomFilter(bloom))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10000; i += 7 {
+		needle := fmt.Sprintf("bloom %05d", i*2)
+		var got string
+		if err := db.Get([]byte(needle), func(rec []byte) error {
+			got = string(rec)
+			return nil
+		}); err != nil || got != needle {
+			t.Fatalf("Get(%q) returned %q, %v", needle, got, err)
+		}
+	}
+
+	// A prefix lookup is not ruled out by the filter
+	if err := db.Get([]byte("bloom 0001"), func(rec []byte) error {
+		if string(rec) != "bloom 00010" {
+			t.Errorf("Get(prefix) found %q", rec)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := db.Find([]byte("bloom 0001")); err != nil || string(rec) != "bloom 00010" {
+		t.Errorf("Find(prefix) = %q, %v", rec, err)
+	}
+
+	// Only the false positives of the misses are read from disk
+	r.reads = 0
+	for i := 0; i < 10000; i++ {
+		if err := db.GetExact([]byte(fmt.Sprintf("bloom %05d", i*2+1)), func(rec []byte) error {
+			t.Fatalf("unexpected record %q", rec)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.reads > 300 {
+		t.Fatalf("expected about 1%% of the misses to be read, got %d reads for 10000", r.reads)
+	}
+
+	if _, err := bwdb.LoadBloom(bytes.NewReader(saved.Bytes()[:10])); err == nil {
+		t.Error("expected an error loading a truncated filter")
+	}
+}
@@ -0,0 +1,293 @@
+package wormdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// BuildFromReader builds a wormdb in file from the newline delimited and
+// already sorted records read from r, and returns it finalized and ready for
+// lookups.  Empty lines are skipped.  A record which is out of order stops the
+// build with an error giving its line number.
+func BuildFromReader(file *os.File, r io.Reader, options ...Option) (*DB, error) {
+	return BuildFromReaderSplit(file, r, bufio.ScanLines, options...)
+}
+
+// BuildFromReaderSplit is [BuildFromReader] with the records split apart by
+// the given function rather than by lines, such as [bufio.ScanWords] or one
+// splitting on NUL bytes.
+func BuildFromReaderSplit(file *os.File, r io.Reader, split bufio.SplitFunc, options ...Option) (*DB, error) {
+	db, err := New(file, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, max(bufio.MaxScanTokenSize, db.blocksize))
+	sc.Split(split)
+	var line int
+	for sc.Scan() {
+		line++
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		if err := db.Add(sc.Bytes()); err != nil {
+			return nil, fmt.Errorf("Could not add record %d: %w", line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read record %d: %w", line+1, err)
+	}
+	if err := db.Finalize(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// BuildFromSlices builds a wormdb in file from records already held in memory,
+// which may be in any order, and returns it finalized and ready for lookups.
+// The records are sorted in the order of the wormdb, see [WithCompare], and a
+// record which sorts the same as one before it is dropped, keeping the first
+// given.
+//
+// The records themselves are not copied, only the slice of them is, so the
+// build needs a further 24 bytes per record on top of the records, and they
+// must not be modified until it returns.  For more records than fit in memory
+// use [BuildFromUnsorted].
+func BuildFromSlices(file *os.File, recs [][]byte, options ...Option) (*DB, error) {
+	db, err := New(file, options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.sortUnique(slices.Clone(recs), db.Add); err != nil {
+		return nil, err
+	}
+	if err := db.Finalize(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// sortUnique sorts recs in the order of the wormdb and hands each to add,
+// skipping any which sort the same as the one before, so the first given of
+// them is kept.
+func (d *DB) sortUnique(recs [][]byte, add func([]byte) error) error {
+	slices.SortStableFunc(recs, d.compare)
+	for i, rec := range recs {
+		if i > 0 && d.compare(rec, recs[i-1]) == 0 {
+			continue
+		}
+		if err := add(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildFromUnsorted builds a wormdb in file from newline delimited records
+// read from in, which may come in any order.  Records are gathered in memory
+// until they take about maxMem bytes, then sorted and spilled to a temporary
+// file.  Once the input is read the sorted files are merged together into the
+// wormdb, which is finalized.  The records are sorted in the order of the
+// wormdb, see [WithCompare], and empty lines and records which sort the same
+// as one read before them are dropped.
+//
+// The temporary files are made in the default directory for temporary files,
+// need about as much space as the input, and are removed before returning.
+// No more than 64 of them are open at once, with larger sorts merged in
+// several passes.
+func BuildFromUnsorted(file *os.File, in io.Reader, maxMem int, options ...Option) error {
+	if maxMem <= 0 {
+		return fmt.Errorf("Could not sort records in %d bytes of memory", maxMem)
+	}
+	db, err := New(file, options...)
+	if err != nil {
+		return err
+	}
+
+	var (
+		chunk [][]byte
+		size  int
+		runs  []string // Sorted runs waiting to be merged
+		temps []string // Every temporary file made, for removing
+	)
+	defer func() {
+		for _, name := range temps {
+			os.Remove(name)
+		}
+	}()
+
+	// write creates a temporary file and writes out the records given to add
+	// by fill, one to a line
+	write := func(fill func(add func([]byte) error) error) (string, error) {
+		f, err := os.CreateTemp("", "wormdb-sort-*")
+		if err != nil {
+			return "", err
+		}
+		temps = append(temps, f.Name())
+		bw := bufio.NewWriter(f)
+		err = fill(func(rec []byte) error {
+			bw.Write(rec)
+			return bw.WriteByte('\n')
+		})
+		if err == nil {
+			err = bw.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return f.Name(), err
+	}
+
+	// spill sorts the records held in memory and writes them out as a run
+	spill := func() error {
+		name, err := write(func(add func([]byte) error) error {
+			return db.sortUnique(chunk, add)
+		})
+		if err != nil {
+			return err
+		}
+		runs = append(runs, name)
+		clear(chunk)
+		chunk, size = chunk[:0], 0
+		return nil
+	}
+
+	sc := bufio.NewScanner(in)
+	sc.Buffer(nil, max(bufio.MaxScanTokenSize, db.blocksize))
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		chunk = append(chunk, bytes.Clone(sc.Bytes()))
+		// Count the slice header along with the record
+		if size += len(sc.Bytes()) + 24; size >= maxMem {
+			if err := spill(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(runs) > 0 && len(chunk) > 0 {
+		if err := spill(); err != nil {
+			return err
+		}
+	}
+
+	if len(runs) == 0 {
+		// Everything fit in memory
+		if err := db.sortUnique(chunk, db.Add); err != nil {
+			return err
+		}
+		return db.Finalize()
+	}
+
+	// Merge the runs a group at a time until few enough are left to be open
+	// at once, keeping the groups in order so earlier runs still win
+	for len(runs) > mergeFanIn {
+		var merged []string
+		for i := 0; i < len(runs); i += mergeFanIn {
+			group := runs[i:min(i+mergeFanIn, len(runs))]
+			name, err := write(func(add func([]byte) error) error {
+				return db.mergeRuns(group, add)
+			})
+			if err != nil {
+				return err
+			}
+			for _, run := range group {
+				os.Remove(run)
+			}
+			merged = append(merged, name)
+		}
+		runs = merged
+	}
+	if err := db.mergeRuns(runs, db.Add); err != nil {
+		return err
+	}
+	return db.Finalize()
+}
+
+// mergeFanIn is the most sorted runs merged at once by [BuildFromUnsorted].
+const mergeFanIn = 64
+
+// mergeRuns merges the sorted run files named in runs, handing each record to
+// add in the order of the wormdb.  A record found in several runs is kept from
+// the earliest of them.
+func (d *DB) mergeRuns(runs []string, add func([]byte) error) error {
+	m := &merger{comp: func(a, b []byte) int {
+		if c := d.compare(a, b); c != 0 {
+			return c
+		}
+		return TakeAOnly
+	}}
+	for i, name := range runs {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rs := bufio.NewScanner(f)
+		rs.Buffer(nil, max(bufio.MaxScanTokenSize, d.blocksize))
+		m.items = append(m.items, mergeItem{w: rs, i: i})
+	}
+	for m.Scan() {
+		if err := add(m.Bytes()); err != nil {
+			return err
+		}
+	}
+	return m.Err()
+}
+
+// Dump writes every record of the wormdb to w, each followed by sep, such as
+// for diffing two wormdbs or loading the records elsewhere.  [Restore] builds
+// the wormdb again from the output.  Records are not escaped, so a record
+// holding sep is an error, as is an empty record since it could not be told
+// apart when restoring.
+func (d *DB) Dump(w io.Writer, sep byte) error {
+	bw := bufio.NewWriter(w)
+	wk := d.NewWalker()
+	defer wk.Release()
+	for wk.Scan() {
+		rec := wk.Bytes()
+		if len(rec) == 0 {
+			return fmt.Errorf("Could not dump an empty record")
+		}
+		if bytes.IndexByte(rec, sep) >= 0 {
+			return fmt.Errorf("Could not dump record %q holding the separator %q", rec, sep)
+		}
+		bw.Write(rec)
+		bw.WriteByte(sep)
+	}
+	if err := wk.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore builds a wormdb in file from the records read from r, each followed
+// by sep as written by [DB.Dump], and finalizes it.  The search given in the
+// options holds the index once done.
+func Restore(file *os.File, r io.Reader, sep byte, options ...Option) error {
+	_, err := BuildFromReaderSplit(file, r, splitOn(sep), options...)
+	return err
+}
+
+// splitOn returns a split function for records ending in sep, where the last
+// record may end at the end of the input instead.
+func splitOn(sep byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, sep); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
@@ -0,0 +1,262 @@
+package wormdb_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+func TestBuildFromReader(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.BuildFromReader(f, strings.NewReader("apple\nbanana\n\ncherry\n"),
+		bwdb.WithSearch(bwdb.NewBinarySearch()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := walkAll(t, db); !reflect.DeepEqual(got, []string{"apple", "banana", "cherry"}) {
+		t.Fatalf("unexpected records %q", got)
+	}
+
+	f, err = os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = bwdb.BuildFromReader(f, strings.NewReader("apple\ncherry\nbanana\n"),
+		bwdb.WithSearch(bwdb.NewBinarySearch()))
+	if err == nil || !strings.Contains(err.Error(), "record 3") {
+		t.Fatalf("expected an error naming record 3, got %v", err)
+	}
+}
+
+func TestBuildFromReaderSplit(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	splitNUL := func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+	db, err := bwdb.BuildFromReaderSplit(f, strings.NewReader("a b\x00a c\x00b"), bufio.SplitFunc(splitNUL),
+		bwdb.WithSearch(bwdb.NewBinarySearch()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := walkAll(t, db); !reflect.DeepEqual(got, []string{"a b", "a c", "b"}) {
+		t.Fatalf("unexpected records %q", got)
+	}
+}
+
+func TestBuildFromUnsorted(t *testing.T) {
+	// Keep the temporary files where they can be checked for
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	r := rand.New(rand.NewSource(1))
+	var in strings.Builder
+	seen := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		rec := fmt.Sprintf("unsorted %05d", r.Intn(3000))
+		seen[rec] = true
+		in.WriteString(rec + "\n")
+	}
+	var want []string
+	for rec := range seen {
+		want = append(want, rec)
+	}
+	slices.Sort(want)
+
+	// The smallest spills more runs than are merged at once
+	for _, maxMem := range []int{1 << 20, 4096, 256} {
+		f, err := os.CreateTemp(t.TempDir(), "*.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs := bwdb.NewBinarySearch()
+		if err := bwdb.BuildFromUnsorted(f, strings.NewReader(in.String()), maxMem, bwdb.WithSearch(bs)); err != nil {
+			t.Fatal(err)
+		}
+		db, err := bwdb.Open(f, bwdb.WithSearch(bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := walkAll(t, db); !reflect.DeepEqual(got, want) {
+			t.Fatalf("maxMem %d: expected %d records, got %d", maxMem, len(want), len(got))
+		}
+		db.Close()
+
+		if left, _ := os.ReadDir(tmp); len(left) > 0 {
+			t.Fatalf("maxMem %d: temporary files were left behind: %v", maxMem, left)
+		}
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := bwdb.BuildFromUnsorted(f, strings.NewReader(in.String()), 0, bwdb.WithSearch(bwdb.NewBinarySearch())); err == nil {
+		t.Fatal("expected an error sorting with no memory")
+	}
+}
+
+func TestBuildFromUnsortedOrder(t *testing.T) {
+	fold := func(a, b []byte) int {
+		return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+	}
+	// Both forms of each record are read in, the second half in reverse
+	var folded, keyed strings.Builder
+	for _, upper := range []bool{true, false} {
+		for i := 0; i < 500; i++ {
+			n := i
+			if !upper {
+				n = 499 - i
+			}
+			if upper {
+				fmt.Fprintf(&folded, "Case %03d\n", n)
+			} else {
+				fmt.Fprintf(&folded, "case %03d\n", n)
+			}
+			fmt.Fprintf(&keyed, "key %03d=%v\n", n, upper)
+		}
+	}
+	for _, maxMem := range []int{1 << 20, 4096, 128} {
+		for _, tc := range []struct {
+			in   string
+			opts []bwdb.Option
+			want string
+		}{
+			// Records which differ only by case sort the same, so the first read is kept
+			{folded.String(), []bwdb.Option{bwdb.WithCompare(fold)}, "Case 000"},
+			// Records which share a key are one record, so the first read is kept
+			{keyed.String(), []bwdb.Option{bwdb.WithKeySeparator('=')}, "key 000=true"},
+		} {
+			f, err := os.CreateTemp(t.TempDir(), "*.db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bs := bwdb.NewBinarySearch()
+			opts := append(tc.opts, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+			if err := bwdb.BuildFromUnsorted(f, strings.NewReader(tc.in), maxMem, opts...); err != nil {
+				t.Fatalf("maxMem %d: %v", maxMem, err)
+			}
+			db, err := bwdb.Open(f, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			if got := walkAll(t, db); len(got) != 500 || got[0] != tc.want {
+				t.Fatalf("maxMem %d: expected 500 records starting with %q, got %d starting with %q", maxMem, tc.want, len(got), got[0])
+			}
+		}
+	}
+}
+
+func TestBuildFromSlices(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var recs [][]byte
+	seen := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		rec := fmt.Sprintf("slice %04d", r.Intn(1500))
+		seen[rec] = true
+		recs = append(recs, []byte(rec))
+	}
+	var want []string
+	for rec := range seen {
+		want = append(want, rec)
+	}
+	slices.Sort(want)
+	given := slices.Clone(recs)
+
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.BuildFromSlices(f, recs, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := walkAll(t, db); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %d records, got %d", len(want), len(got))
+	}
+	if !reflect.DeepEqual(recs, given) {
+		t.Error("expected the records passed in to be left in their order")
+	}
+
+	// Records with the same key sort the same, so the first given is kept
+	f, err = os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = bwdb.BuildFromSlices(f, [][]byte{[]byte("b=2"), []byte("a=1"), []byte("b=1"), []byte("c=3")},
+		bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithKeySeparator('='))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := walkAll(t, db); !reflect.DeepEqual(got, []string{"a=1", "b=2", "c=3"}) {
+		t.Fatalf("unexpected records %q", got)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("dump %03d\twith a tab", i))
+	}
+	db, _ := buildDB(t, recs, bwdb.WithBlockSize(256))
+
+	var buf bytes.Buffer
+	if err := db.Dump(&buf, '\n'); err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(recs, "\n") + "\n"; buf.String() != want {
+		t.Fatal("dump does not match the records")
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	if err := bwdb.Restore(f, &buf, '\n', bwdb.WithSearch(bs), bwdb.WithBlockSize(256)); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := bwdb.Open(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if got := walkAll(t, restored); !slices.Equal(got, recs) {
+		t.Fatalf("restored %d records, want %d", len(got), len(recs))
+	}
+
+	// Records holding the separator can not be dumped
+	if err := db.Dump(io.Discard, '\t'); err == nil {
+		t.Error("expected an error dumping records holding the separator")
+	}
+}
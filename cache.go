@@ -2,8 +2,11 @@ package wormdb
 
 import (
 	"container/list"
+	"hash/maphash"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alphadose/haxmap"
 )
@@ -23,9 +26,27 @@ type CacheMap struct {
 	bufList   *list.List
 	bufMutex  sync.Mutex
 	max       int
+	maxBytes  int // When set, bounds the summed size instead of the count
+	bytes     int // Summed size of the entries in bufList
+	ttl       time.Duration
+	pool      sync.Pool // Evicted entries for reuse
+	noRecycle bool      // Evicted entries are left to the garbage collector
+
+	hits, misses, evictions, length atomic.Int64
 
 	// Set this function to handle when a cached value is hit
 	CountHit func(key string)
+
+	// Set this function to replace the clock used for expiring entries
+	Now func() time.Time
+}
+
+// CacheStats are the counters of a cache since it was created or last reset.
+type CacheStats struct {
+	Hits      int64 // Lookups answered from the cache
+	Misses    int64 // Lookups which had to be computed
+	Evictions int64 // Entries removed to keep within the size or as they expired
+	Len       int64 // Entries currently held
 }
 
 func NewCacheMap(size int) *CacheMap {
@@ -39,37 +60,306 @@ func NewCacheMap(size int) *CacheMap {
 	}
 }
 
+// Create a cache of the given size where entries expire once they have been
+// stored for longer than ttl.  An expired entry is treated as a miss and
+// removed when it is next looked up, call [CacheMap.Sweep] to also remove the
+// expired entries which are not being looked up.
+func NewCacheMapTTL(size int, ttl time.Duration) *CacheMap {
+	if Debug {
+		log.Println("Creating cache", size, "with ttl", ttl)
+	}
+	return &CacheMap{
+		max:       size,
+		ttl:       ttl,
+		lookupBuf: haxmap.New[string, *Result](),
+		bufList:   list.New(),
+	}
+}
+
+// Size charged to a cached lookup which found no record.
+const negativeCacheSize = 32
+
+// Create a cache which is bounded by the summed length of the cached records
+// rather than by their count.  Lookups which found no record are charged a
+// small fixed size.
+func NewCacheMapBytes(maxBytes int) *CacheMap {
+	if Debug {
+		log.Println("Creating cache of bytes", maxBytes)
+	}
+	return &CacheMap{
+		maxBytes:  maxBytes,
+		lookupBuf: haxmap.New[string, *Result](),
+		bufList:   list.New(),
+	}
+}
+
+// size returns what an entry is charged against a byte bounded cache.
+func (r *Result) size() int {
+	if len(r.dat) == 0 {
+		return negativeCacheSize
+	}
+	return len(r.dat)
+}
+
+// full reports whether the cache is over its bound.
+func (c *CacheMap) full() bool {
+	if c.maxBytes > 0 {
+		return c.bytes > c.maxBytes
+	}
+	return c.bufList.Len() > c.max
+}
+
+// GetOrCompute returns the cached result for the key, or stores the result of
+// value when there is none.  A hit moves the entry to the back of the eviction
+// list.  An entry which was evicted is reused in place of calling value.
+//
+// A new entry is not added to the eviction list until Stored is called for
+// it, so it can not be evicted while its result is still being computed.  A
+// hit holds on to the entry until it is given back with Release, so it is not
+// reused while it is still being read.
 func (c *CacheMap) GetOrCompute(K string, V func() *Result) (*Result, bool) {
-	myElm, found := c.lookupBuf.GetOrCompute(K, func() *Result {
-		val := V()
-
-		// Fork off the list amendment action
-		go func(K string) {
-			// Need to lock due to container.list not being thread safe!
-			c.bufMutex.Lock()
-			defer c.bufMutex.Unlock()
-
-			// Push the value to the end of the list
-			c.bufList.PushBack(K)
-
-			// If the list is too long, pop off the front and flush it
-			if int(c.bufList.Len()) > c.max {
-				if val, ok := c.bufList.Remove(c.bufList.Front()).(string); ok {
-					c.lookupBuf.Del(val)
-				}
+	value := func() *Result {
+		if r, ok := c.pool.Get().(*Result); ok {
+			return r
+		}
+		return V()
+	}
+	for {
+		myElm, found := c.lookupBuf.GetOrCompute(K, value)
+		if !found {
+			c.misses.Add(1)
+			return myElm, false
+		}
+
+		c.bufMutex.Lock()
+		if cur, ok := c.lookupBuf.Get(K); !ok || cur != myElm {
+			// Removed since it was looked up, so it may already be reused
+			c.bufMutex.Unlock()
+			continue
+		}
+		if myElm.elm != nil {
+			if c.ttl > 0 && c.expired(myElm, c.now()) {
+				// Drop the entry and try again to compute a new one
+				c.remove(K, myElm)
+				c.evictions.Add(1)
+				c.bufMutex.Unlock()
+				continue
 			}
-		}(K)
+			c.bufList.MoveToBack(myElm.elm)
+		}
+		myElm.refs++
+		c.bufMutex.Unlock()
+
+		c.hits.Add(1)
+		if c.CountHit != nil {
+			c.CountHit(K)
+		}
+		return myElm, true
+	}
+}
+
+// Stored adds the now populated entry to the back of the eviction list and
+// evicts the least recently used entries until the cache is within its size.
+// Entries which failed with an error are dropped instead of being kept.
+func (c *CacheMap) Stored(K string) {
+	myElm, ok := c.lookupBuf.Get(K)
+	if !ok {
+		return
+	}
 
-		// Return the created value
-		return val
-	})
+	// Need to lock due to container.list not being thread safe!
+	c.bufMutex.Lock()
+	defer c.bufMutex.Unlock()
 
-	if found && c.CountHit != nil {
-		c.CountHit(K)
+	if myElm.err != nil {
+		c.lookupBuf.Del(K)
+		return
+	}
+	if myElm.elm != nil {
+		// Already in the list
+		return
 	}
+	myElm.elm = c.bufList.PushBack(K)
+	c.length.Add(1)
+	if c.ttl > 0 {
+		myElm.stored = c.now()
+	}
+	c.bytes += myElm.size()
 
-	return myElm, found
+	// If the list is too long, pop off the front and flush it
+	for c.bufList.Len() > 0 && c.full() {
+		front := c.bufList.Front()
+		val := front.Value.(string)
+		if old, ok := c.lookupBuf.Get(val); ok && old.elm == front {
+			c.remove(val, old)
+		} else {
+			c.bufList.Remove(front)
+			c.length.Add(-1)
+		}
+		c.evictions.Add(1)
+	}
 }
 
-func (c *CacheMap) Stored(K string) {
+// Release gives back an entry returned by a hit from GetOrCompute once it is
+// no longer being read, so that it can be reused after it is evicted.
+func (c *CacheMap) Release(K string, r *Result) {
+	c.bufMutex.Lock()
+	defer c.bufMutex.Unlock()
+	if r.refs--; r.refs == 0 && r.evicted {
+		c.recycle(r)
+	}
+}
+
+// Delete removes the entry for the key, whether or not it has been stored,
+// such as to drop a lookup which found no record rather than keep it.
+func (c *CacheMap) Delete(K string) {
+	c.bufMutex.Lock()
+	defer c.bufMutex.Unlock()
+	r, ok := c.lookupBuf.Get(K)
+	if !ok {
+		return
+	}
+	if r.elm != nil {
+		c.remove(K, r)
+		return
+	}
+	c.lookupBuf.Del(K)
+}
+
+// recycle clears an evicted entry and pools it for reuse, the bufMutex must
+// be held.
+func (c *CacheMap) recycle(r *Result) {
+	if c.noRecycle {
+		return
+	}
+	*r = Result{c: make(chan struct{})}
+	c.pool.Put(r)
+}
+
+// Sweep removes every expired entry from the cache.
+func (c *CacheMap) Sweep() {
+	if c.ttl <= 0 {
+		return
+	}
+	c.bufMutex.Lock()
+	defer c.bufMutex.Unlock()
+
+	now := c.now()
+	for e := c.bufList.Front(); e != nil; {
+		next := e.Next()
+		val := e.Value.(string)
+		if old, ok := c.lookupBuf.Get(val); ok && c.expired(old, now) {
+			c.remove(val, old)
+			c.evictions.Add(1)
+		}
+		e = next
+	}
+}
+
+// Stats returns the counters of the cache, which are safe to read while the
+// cache is in use.
+func (c *CacheMap) Stats() CacheStats {
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Len:       c.length.Load(),
+	}
+}
+
+// Reset sets the hit, miss and eviction counters back to zero, which is useful
+// when sampling the stats periodically.
+func (c *CacheMap) Reset() {
+	c.hits.Store(0)
+	c.misses.Store(0)
+	c.evictions.Store(0)
+}
+
+// remove takes a stored entry out of the list and the map, the bufMutex must
+// be held.
+func (c *CacheMap) remove(K string, r *Result) {
+	c.bufList.Remove(r.elm)
+	r.elm = nil
+	c.length.Add(-1)
+	c.bytes -= r.size()
+	c.lookupBuf.Del(K)
+	if r.evicted = true; r.refs == 0 {
+		c.recycle(r)
+	}
+}
+
+// expired reports whether a stored entry has outlived the ttl.
+func (c *CacheMap) expired(r *Result, now time.Time) bool {
+	return now.Sub(r.stored) >= c.ttl
+}
+
+func (c *CacheMap) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// ShardedCacheMap spreads the keys over several independent [CacheMap]
+// shards, each with its own eviction list and lock, so that concurrent lookups
+// of different keys rarely wait on one another.
+type ShardedCacheMap struct {
+	seed   maphash.Seed
+	shards []*CacheMap
+}
+
+// Create a cache of the given size split over a number of shards, each shard
+// holds an equal part of the size.
+func NewShardedCacheMap(size, shards int) *ShardedCacheMap {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &ShardedCacheMap{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*CacheMap, shards),
+	}
+	for i := range c.shards {
+		c.shards[i] = NewCacheMap((size + shards - 1) / shards)
+	}
+	return c
+}
+
+// shard returns the shard holding the key.
+func (c *ShardedCacheMap) shard(K string) *CacheMap {
+	return c.shards[maphash.String(c.seed, K)%uint64(len(c.shards))]
+}
+
+func (c *ShardedCacheMap) GetOrCompute(K string, V func() *Result) (*Result, bool) {
+	return c.shard(K).GetOrCompute(K, V)
+}
+
+func (c *ShardedCacheMap) Stored(K string) {
+	c.shard(K).Stored(K)
+}
+
+func (c *ShardedCacheMap) Release(K string, r *Result) {
+	c.shard(K).Release(K, r)
+}
+
+func (c *ShardedCacheMap) Delete(K string) {
+	c.shard(K).Delete(K)
+}
+
+// Stats returns the counters summed over all the shards.
+func (c *ShardedCacheMap) Stats() (s CacheStats) {
+	for _, shard := range c.shards {
+		st := shard.Stats()
+		s.Hits += st.Hits
+		s.Misses += st.Misses
+		s.Evictions += st.Evictions
+		s.Len += st.Len
+	}
+	return
+}
+
+// Reset sets the hit, miss and eviction counters of every shard back to zero.
+func (c *ShardedCacheMap) Reset() {
+	for _, shard := range c.shards {
+		shard.Reset()
+	}
 }
@@ -0,0 +1,315 @@
+package wormdb_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+func TestCacheMapEviction(t *testing.T) {
+	c := bwdb.NewCacheMap(2)
+	add := func(key string) bool {
+		_, loaded := c.GetOrCompute(key, func() *bwdb.Result { return &bwdb.Result{} })
+		if !loaded {
+			c.Stored(key)
+		}
+		return loaded
+	}
+
+	add("a")
+	add("b")
+	if !add("a") {
+		t.Fatal("expected a to be cached")
+	}
+	// b is now the least recently used and is the one to go
+	add("c")
+	if !add("a") || !add("c") {
+		t.Fatal("expected a and c to be cached")
+	}
+	if add("b") {
+		t.Fatal("expected b to have been evicted")
+	}
+
+	// An entry which has not been stored yet can not be evicted
+	c.GetOrCompute("pending", func() *bwdb.Result { return &bwdb.Result{} })
+	for i := 0; i < 10; i++ {
+		add(fmt.Sprint(i))
+	}
+	if !add("pending") {
+		t.Fatal("expected the pending entry to still be cached")
+	}
+}
+
+func TestGetCache(t *testing.T) {
+	var recs []string
+	for i := 0; i < 1000; i++ {
+		recs = append(recs, fmt.Sprintf("cached %04d", i))
+	}
+	for _, cache := range []bwdb.Cache{bwdb.NewCacheMap(16), bwdb.NewShardedCacheMap(16, 4)} {
+		db, bs := buildDB(t, recs, bwdb.WithBlockSize(256), bwdb.WithCache(cache))
+		testGetCache(t, db, bs, recs)
+	}
+}
+
+// testGetCache queries the records from several goroutines at once.
+func testGetCache(t *testing.T, db *bwdb.DB, bs *bwdb.BinarySearch, recs []string) {
+	// Query records from the index, the blocks and ones which do not exist
+	needles := []string{string(bs.Index[1]), "cached 0500", "cached 0999", "cached 2000", "missing"}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				needle := needles[(g+i)%len(needles)]
+				if i%3 == 0 {
+					needle = recs[(g*97+i)%len(recs)]
+				}
+				var got string
+				if err := db.Get([]byte(needle), func(rec []byte) error {
+					got = string(rec)
+					return nil
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+				want := needle
+				if needle == "cached 2000" || needle == "missing" {
+					want = ""
+				}
+				if got != want {
+					t.Errorf("Get(%q) returned %q", needle, got)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestCacheMapBytes(t *testing.T) {
+	var recs []string
+	for i := 0; i < 100; i++ {
+		recs = append(recs, fmt.Sprintf("rec %03d %s", i, strings.Repeat("x", i*2)))
+	}
+	c := bwdb.NewCacheMapBytes(500)
+	var hits int
+	c.CountHit = func(string) { hits++ }
+	db, _ := buildDB(t, recs, bwdb.WithCache(c))
+
+	hit := func(needle string) bool {
+		before := hits
+		if err := db.Get([]byte(needle), func([]byte) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		return hits > before
+	}
+
+	// Two records of about 200 bytes fit, a third does not
+	hit("rec 099")
+	hit("rec 098")
+	if !hit("rec 098") || !hit("rec 099") {
+		t.Fatal("expected both records to be cached")
+	}
+	hit("rec 097")
+	if !hit("rec 099") || !hit("rec 097") {
+		t.Fatal("expected the recently used records to be cached")
+	}
+	if hit("rec 098") {
+		t.Fatal("expected the least recently used record to be evicted")
+	}
+
+	// Misses are charged a small size, so several fit alongside a record
+	hit("rec 098")
+	for i := 0; i < 3; i++ {
+		hit(fmt.Sprint("missing ", i))
+	}
+	if !hit("rec 098") || !hit("missing 0") || !hit("missing 2") {
+		t.Fatal("expected the misses to fit alongside the record")
+	}
+}
+
+func TestCacheMapTTL(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	c := bwdb.NewCacheMapTTL(10, time.Minute)
+	c.Now = func() time.Time { return now }
+	var hits int
+	c.CountHit = func(string) { hits++ }
+	db, _ := buildDB(t, []string{"apple", "banana", "cherry"}, bwdb.WithCache(c))
+
+	hit := func(needle string) bool {
+		before := hits
+		if err := db.Get([]byte(needle), func([]byte) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		return hits > before
+	}
+
+	hit("banana")
+	now = now.Add(30 * time.Second)
+	hit("cherry")
+	if !hit("banana") {
+		t.Fatal("expected banana to be cached")
+	}
+
+	// A hit does not extend the life of an entry
+	now = now.Add(31 * time.Second)
+	if hit("banana") {
+		t.Fatal("expected banana to have expired")
+	}
+	if !hit("banana") || !hit("cherry") {
+		t.Fatal("expected banana to be cached again and cherry to still be cached")
+	}
+
+	now = now.Add(time.Minute)
+	c.Sweep()
+	if hit("banana") || hit("cherry") {
+		t.Fatal("expected the sweep to remove the expired entries")
+	}
+}
+
+func TestShardedCacheMap(t *testing.T) {
+	c := bwdb.NewShardedCacheMap(4, 2)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		if _, loaded := c.GetOrCompute(key, func() *bwdb.Result { return &bwdb.Result{} }); loaded {
+			t.Fatalf("unexpected hit for %q", key)
+		}
+		c.Stored(key)
+	}
+
+	// Only the most recent keys of each shard are kept
+	var hits int
+	for i := 99; i >= 0; i-- {
+		key := fmt.Sprint(i)
+		if _, loaded := c.GetOrCompute(key, func() *bwdb.Result { return &bwdb.Result{} }); loaded {
+			hits++
+		} else {
+			c.Stored(key)
+		}
+	}
+	if hits == 0 || hits > 4 {
+		t.Fatalf("expected between 1 and 4 hits, got %d", hits)
+	}
+}
+
+func TestCacheMapStats(t *testing.T) {
+	c := bwdb.NewCacheMap(2)
+	for _, key := range []string{"a", "b", "a", "c", "a", "d"} {
+		if _, loaded := c.GetOrCompute(key, func() *bwdb.Result { return &bwdb.Result{} }); !loaded {
+			c.Stored(key)
+		}
+	}
+	want := bwdb.CacheStats{Hits: 2, Misses: 4, Evictions: 2, Len: 2}
+	if got := c.Stats(); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	c.Reset()
+	want = bwdb.CacheStats{Len: 2}
+	if got := c.Stats(); got != want {
+		t.Fatalf("expected %+v after a reset, got %+v", want, got)
+	}
+}
+
+func TestCacheMapRecycle(t *testing.T) {
+	var recs []string
+	for i := 0; i < 100; i++ {
+		recs = append(recs, fmt.Sprintf("recycle %03d", i))
+	}
+	// A cache much smaller than the records keeps evicting and reusing entries
+	db, _ := buildDB(t, recs, bwdb.WithCache(bwdb.NewCacheMap(4)))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				want := recs[(i*7+g)%len(recs)]
+				if err := db.Get([]byte(want), func(rec []byte) error {
+					if string(rec) != want {
+						return fmt.Errorf("expected %q, got %q", want, rec)
+					}
+					return nil
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func BenchmarkCacheMapMiss(b *testing.B) {
+	var recs []string
+	for i := 0; i < 1000; i++ {
+		recs = append(recs, fmt.Sprintf("miss %03d", i))
+	}
+	for _, recycle := range []bool{true, false} {
+		name := "pooled"
+		if !recycle {
+			name = "unpooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			// Cycle through far more records than the cache holds
+			c := bwdb.NewCacheMap(16)
+			if !recycle {
+				bwdb.NoRecycle(c)
+			}
+			db, _ := buildDB(b, recs, bwdb.WithCache(c))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.Get([]byte(recs[i%len(recs)]), func([]byte) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWithNegativeCache(t *testing.T) {
+	var recs []string
+	for i := 0; i < 1000; i++ {
+		recs = append(recs, fmt.Sprintf("cached %04d", i))
+	}
+	for _, enabled := range []bool{true, false} {
+		c := bwdb.NewCacheMap(16)
+		db, _ := buildDB(t, recs, bwdb.WithBlockSize(256), bwdb.WithCache(c), bwdb.WithNegativeCache(enabled))
+		get := func(needle string) string {
+			var got string
+			if err := db.Get([]byte(needle), func(rec []byte) error {
+				got = string(rec)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+		get("cached 0500")
+		for i := 0; i < 100; i++ {
+			if got := get(fmt.Sprint("missing ", i)); got != "" {
+				t.Fatalf("found %q for a missing needle", got)
+			}
+		}
+		st := c.Stats()
+		if enabled && st.Len != 16 || !enabled && st.Len != 1 {
+			t.Errorf("negative cache %v holds %d entries", enabled, st.Len)
+		}
+		c.Reset()
+		if got := get("cached 0500"); got != "cached 0500" || enabled == (c.Stats().Hits == 1) {
+			t.Errorf("negative cache %v got %q with %d hits", enabled, got, c.Stats().Hits)
+		}
+	}
+
+	// Missing needles are looked up from many goroutines at once
+	db, bs := buildDB(t, recs, bwdb.WithBlockSize(256),
+		bwdb.WithCache(bwdb.NewShardedCacheMap(16, 4)), bwdb.WithNegativeCache(false))
+	testGetCache(t, db, bs, recs)
+}
@@ -0,0 +1,108 @@
+package wormdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	combinedMagic   = "WORMCMB1"
+	combinedTrailer = 8 + 8 + len(combinedMagic) // Data offset, index offset and magic
+)
+
+// SaveCombined writes the data blocks of a finalized wormdb followed by its
+// index into w, so a single file holds everything [OpenCombined] needs.  The
+// blocks are written from the current position of w, and a trailer at the end
+// records where the blocks and the index begin.  The search must be able to
+// save itself, as a [BinarySearch] can.
+func (d *DB) SaveCombined(w io.WriteSeeker) error {
+	if d.writeBuf != nil {
+		return fmt.Errorf("Wormdb must be finalized before saving")
+	}
+	if !d.acquire() {
+		return fmt.Errorf("Could not save: %w", ErrClosed)
+	}
+	defer d.releaseReader()
+	s, ok := d.search.(interface{ Save(io.Writer) error })
+	if !ok {
+		return fmt.Errorf("Search method %T can not be saved", d.search)
+	}
+	size, err := d.size()
+	if err != nil {
+		return err
+	}
+	dataOff, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	n, err := io.Copy(bw, io.NewSectionReader(d.file, d.base(), max(size-d.base(), 0)))
+	if err != nil {
+		return fmt.Errorf("Could not copy the data blocks: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	indexOff := dataOff + n
+	if err := s.Save(w); err != nil {
+		return fmt.Errorf("Could not save the index: %w", err)
+	}
+
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(dataOff))
+	trailer = binary.BigEndian.AppendUint64(trailer, uint64(indexOff))
+	_, err = w.Write(append(trailer, combinedMagic...))
+	return err
+}
+
+// Open a wormdb written by [DB.SaveCombined], loading the index from the end
+// of the file into a [BinarySearch].  The options must be the same as those
+// the wormdb was built with, apart from the search and offsets, which are
+// taken from the file.  As the blocks are read through a section of the file,
+// ending where the index begins, [WithMmap] has no effect.
+func OpenCombined(f *os.File, options ...Option) (*DB, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := fi.Size() - int64(combinedTrailer)
+	if end < 0 {
+		return nil, fmt.Errorf("File is too short to hold a combined wormdb")
+	}
+	var trailer [combinedTrailer]byte
+	if _, err := f.ReadAt(trailer[:], end); err != nil {
+		return nil, fmt.Errorf("Could not read the combined trailer: %w", err)
+	}
+	if string(trailer[16:]) != combinedMagic {
+		return nil, fmt.Errorf("File is not a combined wormdb")
+	}
+	dataOff := int64(binary.BigEndian.Uint64(trailer[:8]))
+	indexOff := int64(binary.BigEndian.Uint64(trailer[8:16]))
+	if dataOff < 0 || indexOff < dataOff || indexOff > end {
+		return nil, fmt.Errorf("Combined trailer is corrupt, data at %d and index at %d of %d", dataOff, indexOff, end)
+	}
+
+	bs, err := LoadBinarySearchReader(io.NewSectionReader(f, indexOff, end-indexOff))
+	if err != nil {
+		return nil, err
+	}
+	data := &combinedFile{
+		SectionReader: io.NewSectionReader(f, 0, indexOff),
+		file:          f,
+	}
+	return OpenReaderAt(data, append(options, WithSearch(bs), WithOffset(0), WithByteOffset(dataOff))...)
+}
+
+// combinedFile limits the reads of a wormdb to its data blocks and closes the
+// whole file with the wormdb.
+type combinedFile struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (c *combinedFile) Close() error {
+	return c.file.Close()
+}
@@ -0,0 +1,77 @@
+package wormdb_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+func TestSaveCombined(t *testing.T) {
+	codec, err := bwdb.NewGzipCodec(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []string
+	for i := 0; i < 600; i++ {
+		recs = append(recs, fmt.Sprintf("combined %04d", i))
+	}
+	for name, opts := range map[string][]bwdb.Option{
+		"plain":    {bwdb.WithBlockSize(256)},
+		"checksum": {bwdb.WithBlockSize(256), bwdb.WithBlockChecksum()},
+		"compress": {bwdb.WithBlockSize(256), bwdb.WithCompression(codec)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, _ := buildDB(t, recs, opts...)
+
+			// Lead the blocks with a header to check they need not start the file
+			file := filepath.Join(t.TempDir(), "combined.db")
+			f, err := os.Create(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString("header")
+			if err := db.SaveCombined(f); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			if f, err = os.Open(file); err != nil {
+				t.Fatal(err)
+			}
+			db, err = bwdb.OpenCombined(f, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := walkAll(t, db); !slices.Equal(got, recs) {
+				t.Fatalf("walked %d records, want %d", len(got), len(recs))
+			}
+			for _, rec := range []string{recs[0], recs[301], recs[len(recs)-1]} {
+				var got string
+				if err := db.Get([]byte(rec), func(b []byte) error {
+					got = string(b)
+					return nil
+				}); err != nil || got != rec {
+					t.Errorf("Get(%q) = %q, %v", rec, got, err)
+				}
+			}
+			if err := db.Verify(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	f, err := os.Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bwdb.OpenCombined(f); err == nil {
+		t.Error("expected an error opening a file which is not combined")
+	}
+	f.Close()
+}
@@ -0,0 +1,234 @@
+package wormdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses and decompresses whole blocks for [WithCompression].
+type Codec interface {
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress appends the decompressed form of src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// Compress each block as it is written to disk and decompress it again after
+// it is read back.  The compressed blocks are packed one after another with a
+// 4 byte length header, so the file no longer has fixed size sectors.
+//
+// As the search index only knows the sector id of a block, a table of the
+// physical offset of every block is kept in memory.  It is built while the
+// wormdb is written, and when the wormdb is opened it is rebuilt by reading
+// the header of every block, so opening costs one small read per block.  Each
+// lookup still costs a single read, of the compressed block, plus the time to
+// decompress it.
+//
+// The same codec must be given again when opening, see [Option].  Without it
+// the packed blocks are read as fixed size blocks and misread, and another
+// codec fails to decompress them.
+func WithCompression(codec Codec) Option {
+	return func(d *DB) {
+		d.codec = codec
+	}
+}
+
+// GzipCodec compresses blocks with gzip at the given compression level.  When
+// reading, a block is only decompressed up to the block size, unless
+// [WithLargeRecords] is set, so a corrupt block fails before it can use up
+// memory.
+type GzipCodec struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// Create a gzip codec, the level is one of the compress/gzip levels such as
+// [gzip.BestSpeed] or [gzip.DefaultCompression].
+func NewGzipCodec(level int) (*GzipCodec, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return &GzipCodec{level: level}, nil
+}
+
+// appendWriter is an io.Writer which appends to a byte slice.
+type appendWriter struct {
+	b []byte
+}
+
+func (a *appendWriter) Write(p []byte) (int, error) {
+	a.b = append(a.b, p...)
+	return len(p), nil
+}
+
+func (g *GzipCodec) Compress(dst, src []byte) ([]byte, error) {
+	out := &appendWriter{b: dst}
+	zw, ok := g.writers.Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(out)
+	} else {
+		zw, _ = gzip.NewWriterLevel(out, g.level)
+	}
+	defer g.writers.Put(zw)
+	if _, err := zw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.b, nil
+}
+
+func (g *GzipCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return g.decompressLimit(dst, src, -1)
+}
+
+// decompressLimit is Decompress, failing as soon as more than limit bytes have
+// been decompressed, so a corrupt block can not grow without bound.  A
+// negative limit has none.
+func (g *GzipCodec) decompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	var err error
+	zr, ok := g.readers.Get().(*gzip.Reader)
+	if ok {
+		err = zr.Reset(bytes.NewReader(src))
+	} else {
+		zr, err = gzip.NewReader(bytes.NewReader(src))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer g.readers.Put(zr)
+
+	var r io.Reader = zr
+	if limit >= 0 {
+		// Read one byte past the limit to tell a block which overruns it
+		r = io.LimitReader(zr, int64(limit)+1)
+	}
+	start := len(dst)
+
+	// Read straight into the spare capacity of dst, only growing it when full
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if limit >= 0 && len(dst)-start > limit {
+			return nil, fmt.Errorf("Decompressed to more than %d bytes", limit)
+		}
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// storeCodec leaves the blocks as they are, for packing the blocks of
+// WithLargeRecords when no compression is wanted.
+type storeCodec struct{}
+
+func (storeCodec) Compress(dst, src []byte) ([]byte, error)   { return append(dst, src...), nil }
+func (storeCodec) Decompress(dst, src []byte) ([]byte, error) { return append(dst, src...), nil }
+
+// writeCompressed compresses the block and writes it out with its length
+// header, noting down where the block starts.
+func (d *DB) writeCompressed(b []byte) error {
+	z, err := d.codec.Compress(append(d.zbuf[:0], 0, 0, 0, 0), b)
+	if err != nil {
+		return err
+	}
+	d.zbuf = z
+	if err := d.checkSize(len(z)); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(z, uint32(len(z)-4))
+	d.offsets = append(d.offsets, d.written)
+	n, err := d.writeBuf.Write(z)
+	d.written += int64(n)
+	return err
+}
+
+// loadOffsets rebuilds the table of block offsets by reading the length
+// header of each compressed block.
+func (d *DB) loadOffsets() error {
+	var (
+		hdr  [4]byte
+		off  int64
+		base = d.base()
+	)
+	d.offsets = d.offsets[:0]
+	for {
+		n, err := d.file.ReadAt(hdr[:], base+off)
+		if n == 0 && err == io.EOF {
+			break
+		}
+		if n < len(hdr) {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("Compressed block header truncated at offset %d", off)
+			}
+			return err
+		}
+		d.offsets = append(d.offsets, off)
+		off += 4 + int64(binary.BigEndian.Uint32(hdr[:]))
+	}
+	d.offsets = append(d.offsets, off)
+	return nil
+}
+
+// readCompressed reads the compressed block n and decompresses it into buf.
+func (d *DB) readCompressed(buf []byte, n int64) ([]byte, error) {
+	if n < 0 || n >= int64(len(d.offsets)-1) {
+		return nil, io.EOF
+	}
+	base := d.base()
+	start, end := base+d.offsets[n], base+d.offsets[n+1]
+
+	var z []byte
+	if d.mmap != nil {
+		if end > int64(len(d.mmap)) {
+			return nil, fmt.Errorf("Compressed block %d is truncated", n)
+		}
+		z = d.mmap[start:end]
+	} else {
+		zb := d.zpool.Get().([]byte)
+		if int64(cap(zb)) < end-start {
+			zb = make([]byte, end-start)
+		}
+		defer d.zpool.Put(zb)
+		z = zb[:end-start]
+		if rn, err := d.file.ReadAt(z, start); rn < len(z) {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("Compressed block %d is truncated", n)
+			}
+			return nil, err
+		}
+	}
+
+	if len(z) < 4 || binary.BigEndian.Uint32(z) != uint32(len(z)-4) {
+		return nil, fmt.Errorf("Bad compressed block header at block %d", n)
+	}
+	var b []byte
+	var err error
+	if c, ok := d.codec.(interface {
+		decompressLimit(dst, src []byte, limit int) ([]byte, error)
+	}); ok && !d.large {
+		b, err = c.decompressLimit(buf[:0], z[4:], d.blocksize)
+	} else {
+		b, err = d.codec.Decompress(buf[:0], z[4:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not decompress block %d: %w", n, err)
+	}
+	if len(b) > d.blocksize && !d.large {
+		return nil, fmt.Errorf("Block %d decompressed to %d bytes", n, len(b))
+	}
+	return b, nil
+}
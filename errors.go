@@ -0,0 +1,48 @@
+package wormdb
+
+import "errors"
+
+// Errors returned by the wormdb, which are wrapped with the records or block
+// involved and so should be tested for with [errors.Is].
+var (
+	// A record was added which does not sort after the one before it.
+	ErrOutOfOrder = errors.New("Record out of order")
+
+	// A record of a wormdb being merged, see [WithMerge], does not sort after
+	// the record before it, as the wormdb is corrupt or was built in another
+	// order.
+	ErrMergeOrder = errors.New("Merged record out of order")
+
+	// Returned by the handler of a lookup, such as [DB.GetAll], to stop the
+	// lookup without it failing, much like [io/fs.SkipAll].  The lookup then
+	// returns nil, so it must be returned as is rather than wrapped, and must
+	// not be used to pass on a real failure.
+	ErrStopIteration = errors.New("Stop iteration")
+
+	// A lookup was made on a wormdb after it was closed.
+	ErrClosed = errors.New("Wormdb closed")
+
+	// A record was added after the wormdb or search was finalized.
+	ErrFinalized = errors.New("Already finalized")
+
+	// A record was added to a wormdb which was opened for reading.
+	ErrReadOnly = errors.New("Opened read-only")
+
+	// A record in a block runs past the end of the block.
+	ErrRecordTooShort = errors.New("Record too short")
+
+	// A record is too long to be stored.
+	ErrRecordTooLong = errors.New("Record too long")
+
+	// A block was written which would take the wormdb past its maximum size.
+	ErrMaxSizeExceeded = errors.New("Maximum size exceeded")
+
+	// A saved search index was built with a different data file.
+	ErrIndexMismatch = errors.New("Index does not match the data")
+
+	// The file ends before a block which the search index points to.
+	ErrTruncated = errors.New("File truncated")
+
+	// A record in a block re-uses more of the record before it than there is.
+	ErrBadPrefix = errors.New("Bad record prefix")
+)
@@ -0,0 +1,31 @@
+package wormdb
+
+import "bytes"
+
+// Probes returns the number of index entries compared while finding needle.
+func Probes(s Search, needle []byte) (n int) {
+	count := func(cmp func(a, b []byte) int) func(a, b []byte) int {
+		return func(a, b []byte) int {
+			n++
+			return cmp(a, b)
+		}
+	}
+	switch s := s.(type) {
+	case *BinarySearch:
+		s.search(needle, count(s.compare()))
+	case *InterpolationSearch:
+		s.interpolate(needle, count(bytes.Compare))
+	}
+	return
+}
+
+// HasWriteBuffers reports whether any of the buffers for building are held.
+func HasWriteBuffers(d *DB) bool {
+	return d.writeBuf != nil || d.block != nil || d.prev != nil
+}
+
+// NoRecycle has the cache allocate a new entry for every miss rather than
+// reuse those it evicts, for comparing the two.
+func NoRecycle(c *CacheMap) {
+	c.noRecycle = true
+}
@@ -0,0 +1,124 @@
+package wormdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Check that a saved index was built with the data file it is opened with,
+// which is on by default.  An index saved after the wormdb was finalized, and
+// loaded with [LoadBinarySearchReader], holds a fingerprint of the data file,
+// being the block size, the size of the data and a checksum of the first
+// block.  Opening it with any other file, or with a different block size,
+// fails with [ErrIndexMismatch] rather than reading the wrong blocks.  Turn it
+// off to pair an index with a file on purpose, such as a copy of the data
+// which has been moved within a larger file.
+func WithIndexCheck(enabled bool) Option {
+	return func(d *DB) {
+		d.noIndexCheck = !enabled
+	}
+}
+
+// fingerprint identifies the data file a search index was built with.
+type fingerprint struct {
+	blocksize int
+	size      int64  // Bytes of data after the offset
+	sum       uint32 // CRC32 of the first block
+}
+
+// append adds the fingerprint to b in the form it is saved with the index.
+func (f *fingerprint) append(b []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(f.blocksize))
+	b = binary.AppendUvarint(b, uint64(f.size))
+	return binary.BigEndian.AppendUint32(b, f.sum)
+}
+
+// readFingerprint reads a fingerprint saved with an index.
+func readFingerprint(r io.ByteReader) (*fingerprint, error) {
+	bs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	var sum [4]byte
+	for i := range sum {
+		if sum[i], err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+	if bs > 1<<30 || size > 1<<62 {
+		return nil, fmt.Errorf("Invalid block size %d or data size %d", bs, size)
+	}
+	return &fingerprint{
+		blocksize: int(bs),
+		size:      int64(size),
+		sum:       binary.BigEndian.Uint32(sum[:]),
+	}, nil
+}
+
+// fingerprint returns the fingerprint of the data file of the wormdb.
+func (d *DB) fingerprint() (*fingerprint, error) {
+	size, err := d.size()
+	if err != nil {
+		return nil, err
+	}
+	size = max(size-d.base(), 0)
+	first := make([]byte, min(int64(d.blocksize), size))
+	if _, err := d.file.ReadAt(first, d.base()); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &fingerprint{
+		blocksize: d.blocksize,
+		size:      size,
+		sum:       crc32.Checksum(first, castagnoli),
+	}, nil
+}
+
+// checkIndex returns an error when the search holds a fingerprint which does
+// not match the data file.
+func (d *DB) checkIndex() error {
+	s, ok := d.search.(interface{ dataFingerprint() *fingerprint })
+	if !ok || d.noIndexCheck {
+		return nil
+	}
+	want := s.dataFingerprint()
+	if want == nil {
+		return nil
+	}
+	got, err := d.fingerprint()
+	if err != nil {
+		// The store can not be checked, such as when its size is not known
+		if d.debugging() {
+			d.debugf("Could not check the index against the data file: %v", err)
+		}
+		return nil
+	}
+	switch {
+	case want.blocksize != got.blocksize:
+		return fmt.Errorf("%w, index was built with blocks of %d bytes, not %d", ErrIndexMismatch, want.blocksize, got.blocksize)
+	case want.size != got.size:
+		return fmt.Errorf("%w, index was built with %d bytes of data, the file holds %d", ErrIndexMismatch, want.size, got.size)
+	case want.sum != got.sum:
+		return fmt.Errorf("%w, the first block of the file differs", ErrIndexMismatch)
+	}
+	return nil
+}
+
+// setFingerprint records the data file the index has been built with.
+func (s *BinarySearch) setFingerprint(f *fingerprint) {
+	s.fp = f
+}
+
+// dataFingerprint returns the fingerprint loaded with a saved index, an index
+// built in memory is taken to be used with its own file.
+func (s *BinarySearch) dataFingerprint() *fingerprint {
+	if !s.loaded {
+		return nil
+	}
+	return s.fp
+}
@@ -0,0 +1,153 @@
+package wormdb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Framing encodes and decodes the records held within a block, see
+// [WithFraming].
+type Framing interface {
+	// Encode appends rec to dst in the form it is stored in the block, where
+	// prev is the record before it in the same block, or nil when rec is the
+	// first record of a block and so must be stored whole.
+	Encode(prev, rec, dst []byte) ([]byte, error)
+
+	// Decode reads the record at the start of b, which follows prev in the
+	// same block or is the first record of the block when prev is nil.  The
+	// record is appended to dst, which never shares memory with prev, and
+	// returned with the number of bytes of b it took up.  Decode returns 0
+	// bytes on reaching the zero padding after the last record of the block.
+	Decode(prev, b, dst []byte) (rec []byte, n int, err error)
+}
+
+// Store the records within each block with f, such as to try out a different
+// encoding of the lengths or of numeric keys, in place of the built in framing
+// set up by [WithVarint], [WithPrefixCompression] and
+// [WithSuffixCompression].  Every block is padded with zeros after its last
+// record, which the framing must tell apart from a record unless
+// [WithRecordCount] is used, as the count then says where the records end.
+// The same framing must be given again when opening, see [Option], as any
+// other decodes the records wrongly.
+func WithFraming(f Framing) Option {
+	return func(d *DB) {
+		d.framing = f
+	}
+}
+
+// byteFraming is the built in framing.  Each record is stored as the number of
+// bytes it shares with the start of the record before it, its length, and the
+// bytes which differ, and with suffix set the number of bytes shared with the
+// end of the record before it follows the length.  The first record of each
+// block, and every record when noPrefix is set, is stored whole behind its
+// length.
+type byteFraming struct {
+	varint   bool // Lengths are varints rather than single bytes
+	noPrefix bool // Records are stored whole
+	suffix   bool // Records also share a suffix with the record before
+	counted  bool // Blocks hold a record count, so a zero length is a record
+}
+
+func (f *byteFraming) Encode(prev, rec, dst []byte) ([]byte, error) {
+	// Lengths are single bytes unless varints are in use.  The re-used prefix
+	// can never be longer than the record, so it is covered by this check too.
+	if !f.varint && len(rec) > 255 {
+		return nil, fmt.Errorf("%w, %d bytes exceeds the 255-byte limit", ErrRecordTooLong, len(rec))
+	}
+	if prev == nil || f.noPrefix {
+		return append(f.appendLen(dst, len(rec)), rec...), nil
+	}
+
+	// Determine re-used bytes from previous record
+	var reuse, suffix int
+	for ; reuse < len(prev) && reuse < len(rec) && prev[reuse] == rec[reuse]; reuse++ {
+	}
+	if f.suffix {
+		// Keep at least one byte in the middle so the length is never zero,
+		// which would mark the end of the block.
+		most := min(len(prev), len(rec)-1) - reuse
+		for ; suffix < most && prev[len(prev)-1-suffix] == rec[len(rec)-1-suffix]; suffix++ {
+		}
+	}
+	body := rec[reuse : len(rec)-suffix]
+	dst = f.appendLen(f.appendLen(dst, reuse), len(body))
+	if f.suffix {
+		dst = f.appendLen(dst, suffix)
+	}
+	return append(dst, body...), nil
+}
+
+func (f *byteFraming) Decode(prev, b, dst []byte) ([]byte, int, error) {
+	if prev == nil || f.noPrefix {
+		// The first record in a block contains the record length, as do all
+		// the records when prefix compression is off
+		if b[0] == 0 && !f.counted {
+			return dst, 0, nil
+		}
+		l, n := f.getLen(b)
+		if n == 0 || uint64(len(b)-n) < l {
+			return nil, 0, ErrRecordTooShort
+		}
+		return append(dst, b[n:n+int(l)]...), n + int(l), nil
+	}
+
+	// A zero prefix and zero length marks the end of the records, as does the
+	// block ending on a single byte of padding.
+	if !f.counted && (len(b) == 1 || b[0] == 0 && b[1] == 0) {
+		if b[0] != 0 {
+			return nil, 0, ErrBadPrefix
+		}
+		return dst, 0, nil
+	}
+
+	// Determine the re-used portion of the record
+	reuse, n := f.getLen(b)
+	if n == 0 || uint64(len(prev)) < reuse {
+		return nil, 0, fmt.Errorf("%w, re-using %d bytes of %d", ErrBadPrefix, reuse, len(prev))
+	}
+	used := n
+	l, n := f.getLen(b[used:])
+	if n == 0 || l == 0 {
+		return nil, 0, ErrRecordTooShort
+	}
+	used += n
+
+	var suffix uint64
+	if f.suffix {
+		suffix, n = f.getLen(b[used:])
+		if n == 0 || uint64(len(prev))-reuse < suffix {
+			return nil, 0, fmt.Errorf("%w, re-using %d and %d bytes of %d", ErrBadPrefix, reuse, suffix, len(prev))
+		}
+		used += n
+	}
+	if uint64(len(b)-used) < l {
+		return nil, 0, ErrRecordTooShort
+	}
+	end := used + int(l)
+	dst = append(append(dst, prev[:reuse]...), b[used:end]...)
+	return append(dst, prev[len(prev)-int(suffix):]...), end, nil
+}
+
+// appendLen appends a record or prefix length to b.
+func (f *byteFraming) appendLen(b []byte, v int) []byte {
+	if f.varint {
+		return binary.AppendUvarint(b, uint64(v))
+	}
+	return append(b, byte(v))
+}
+
+// getLen reads a length from the start of b, returning the value and the
+// number of bytes it used or 0 when b is too short to hold it.
+func (f *byteFraming) getLen(b []byte) (uint64, int) {
+	if !f.varint {
+		if len(b) == 0 {
+			return 0, 0
+		}
+		return uint64(b[0]), 1
+	}
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0
+	}
+	return v, n
+}
@@ -0,0 +1,72 @@
+package wormdb_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+// fixedFraming stores records of a fixed width whole, taking the zero padding
+// at the end of a block for the end of the records.
+type fixedFraming struct{ width int }
+
+func (f fixedFraming) Encode(prev, rec, dst []byte) ([]byte, error) {
+	if len(rec) != f.width || rec[0] == 0 {
+		return nil, fmt.Errorf("Record %q is not %d bytes beginning with a non-zero byte", rec, f.width)
+	}
+	return append(dst, rec...), nil
+}
+
+func (f fixedFraming) Decode(prev, b, dst []byte) ([]byte, int, error) {
+	if len(b) < f.width || b[0] == 0 {
+		return dst, 0, nil
+	}
+	return append(dst, b[:f.width]...), f.width, nil
+}
+
+func TestWithFraming(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], 1<<56+uint64(i)*7919)
+		recs = append(recs, string(b[:]))
+	}
+	db, bs := buildDB(t, recs, bwdb.WithBlockSize(256), bwdb.WithFraming(fixedFraming{width: 8}))
+	if want := (len(recs) + 31) / 32; len(bs.Index) != want {
+		t.Errorf("got %d blocks, want %d", len(bs.Index), want)
+	}
+	if got := walkAll(t, db); !slices.Equal(got, recs) {
+		t.Fatalf("walked %d records, want %d", len(got), len(recs))
+	}
+	for _, rec := range []string{recs[0], recs[31], recs[32], recs[499]} {
+		var got string
+		err := db.Get([]byte(rec), func(b []byte) error {
+			got = string(b)
+			return nil
+		})
+		if err != nil || got != rec {
+			t.Errorf("Get(%q) = %q, %v", rec, got, err)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The framing decides which records can be stored
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithFraming(fixedFraming{width: 8}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Add([]byte("short")); err == nil {
+		t.Error("expected an error adding a record the framing rejects")
+	}
+}
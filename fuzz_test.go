@@ -0,0 +1,131 @@
+package wormdb_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+// fuzzOptions picks the block format options from the bits of a byte, so the
+// fuzzer covers every decoder.
+func fuzzOptions(flags byte) []bwdb.Option {
+	opts := []bwdb.Option{bwdb.WithBlockSize(256)}
+	if flags&1 != 0 {
+		opts = append(opts, bwdb.WithVarint())
+	}
+	if flags&2 != 0 {
+		opts = append(opts, bwdb.WithSuffixCompression())
+	}
+	if flags&4 != 0 {
+		opts = append(opts, bwdb.WithPrefixCompression(false))
+	}
+	if flags&8 != 0 {
+		opts = append(opts, bwdb.WithRecordCount())
+	}
+	return opts
+}
+
+// fuzzSeed builds a well formed wormdb to start the fuzzer off from.
+func fuzzSeed(f *testing.F, flags byte) []byte {
+	name := filepath.Join(f.TempDir(), "seed.db")
+	file, err := os.Create(name)
+	if err != nil {
+		f.Fatal(err)
+	}
+	db, err := bwdb.New(file, append(fuzzOptions(flags), bwdb.WithSearch(bwdb.NewBinarySearch()))...)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, rec := range []string{"apple", "apricot", "banana", "blueberry", "cherry", "grape", "grapefruit"} {
+		if err := db.Add([]byte(rec)); err != nil {
+			f.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		f.Fatal(err)
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return b
+}
+
+// FuzzScan walks a corrupted file forwards and backwards, which must end in
+// an error rather than a panic.
+func FuzzScan(f *testing.F) {
+	for _, flags := range []byte{0, 1, 2, 4, 8, 3} {
+		f.Add(flags, fuzzSeed(f, flags))
+	}
+	f.Fuzz(func(t *testing.T, flags byte, data []byte) {
+		opts := append(fuzzOptions(flags), bwdb.WithSearch(bwdb.LoadBinarySearch(nil)))
+		db, err := bwdb.OpenReaderAt(bytes.NewReader(data), opts...)
+		if err != nil {
+			return
+		}
+		for _, w := range []*bwdb.Walker{db.NewWalker(), db.NewReverseWalker()} {
+			for w.Scan() {
+				_ = w.Bytes()
+			}
+			w.Err()
+		}
+	})
+}
+
+// FuzzGet looks up needles in a single corrupted block, which must end in an
+// error or no match rather than a panic.  When the block walks cleanly with
+// its records in order, every record must still be found.
+func FuzzGet(f *testing.F) {
+	for _, flags := range []byte{0, 1, 2, 4, 8, 3} {
+		f.Add(flags, fuzzSeed(f, flags), []byte("apple"), []byte("gra"))
+	}
+	f.Fuzz(func(t *testing.T, flags byte, data, first, needle []byte) {
+		if len(data) > 256 {
+			data = data[:256]
+		}
+		var index [][]byte
+		if len(first) > 0 {
+			index = [][]byte{first}
+		}
+		opts := append(fuzzOptions(flags), bwdb.WithSearch(bwdb.LoadBinarySearch(index)))
+		db, err := bwdb.OpenReaderAt(bytes.NewReader(data), opts...)
+		if err != nil {
+			return
+		}
+		db.Get(needle, func(rec []byte) error {
+			if !bytes.HasPrefix(rec, needle) {
+				t.Errorf("Get(%q) found %q", needle, rec)
+			}
+			return nil
+		})
+		db.GetAll(needle, func([]byte) error { return nil })
+		db.GetBatch([][]byte{needle}, func(_, _ []byte) error { return nil })
+		db.FindNearest(needle)
+
+		// A sound block must resolve every record it holds
+		var recs [][]byte
+		w := db.NewWalker()
+		for w.Scan() {
+			if n := len(recs); n > 0 && bytes.Compare(recs[n-1], w.Bytes()) >= 0 {
+				return
+			}
+			recs = append(recs, bytes.Clone(w.Bytes()))
+		}
+		if w.Err() != nil || len(recs) == 0 || !bytes.Equal(recs[0], first) {
+			return
+		}
+		for _, rec := range recs {
+			var got []byte
+			err := db.Get(rec, func(b []byte) error {
+				got = bytes.Clone(b)
+				return nil
+			})
+			if err != nil || !bytes.Equal(got, rec) {
+				t.Errorf("Get(%q) = %q, %v", rec, got, err)
+			}
+		}
+	})
+}
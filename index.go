@@ -0,0 +1,148 @@
+package wormdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+)
+
+// secondary indexes every record by a key taken from it, see
+// [WithSecondaryIndex].
+type secondary struct {
+	key     func(rec []byte) []byte
+	entries []indexEntry
+	sorted  bool
+}
+
+// indexEntry is the key of a record and the sector which holds the record.
+type indexEntry struct {
+	key    []byte
+	sector int
+}
+
+// Index the records by a second key taken from each record by key, such as a
+// hash held within the record, which can then be looked up with [DB.GetBy]
+// under the given name.  Unlike the search, which holds the first record of
+// each block, this index holds the key and block of every record in memory,
+// and it is sorted when the wormdb is finalized.  A wormdb loaded with [Open]
+// walks every record to build the index again, so opening takes about as long
+// as reading the whole file.
+//
+// The key returned may be a part of the record, it is copied.
+func WithSecondaryIndex(name string, key func(rec []byte) []byte) Option {
+	return func(d *DB) {
+		if d.indexes == nil {
+			d.indexes = make(map[string]*secondary)
+		}
+		d.indexes[name] = &secondary{key: key}
+	}
+}
+
+// add indexes a record held by the sector.
+func (ix *secondary) add(rec []byte, sector int) {
+	ix.entries = append(ix.entries, indexEntry{key: bytes.Clone(ix.key(rec)), sector: sector})
+}
+
+// finalize sorts the entries by key, keeping the records in order for each
+// key.
+func (ix *secondary) finalize() {
+	slices.SortStableFunc(ix.entries, func(a, b indexEntry) int {
+		return bytes.Compare(a.key, b.key)
+	})
+	ix.sorted = true
+}
+
+// buildIndexes walks every record of an opened wormdb into the secondary
+// indexes.
+func (d *DB) buildIndexes() error {
+	blocks, err := d.blocks()
+	if err != nil {
+		return err
+	}
+	buf := d.readpool.Get().([]byte)
+	defer d.readpool.Put(buf)
+	c := d.newCursor()
+	for n := int64(0); n < blocks; n++ {
+		b, err := d.readBlock(buf, n)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		c.reset(b, n)
+		for {
+			ok, err := c.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			for _, ix := range d.indexes {
+				ix.add(c.rec, int(n))
+			}
+		}
+	}
+	for _, ix := range d.indexes {
+		ix.finalize()
+	}
+	return nil
+}
+
+// GetBy calls handler for every record whose key in the named secondary index
+// has needle as a prefix, in the order of the records.  See
+// [WithSecondaryIndex].  If the handler returns an error the lookup stops and
+// the error is returned, apart from [ErrStopIteration], which stops the lookup
+// and returns nil.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) GetBy(name string, needle []byte, handler func([]byte) error) error {
+	if !d.acquire() {
+		return fmt.Errorf("Could not look up %q: %w", needle, ErrClosed)
+	}
+	defer d.releaseReader()
+	ix, ok := d.indexes[name]
+	if !ok {
+		return fmt.Errorf("No secondary index named %q", name)
+	}
+	if !ix.sorted {
+		return fmt.Errorf("Secondary index %q is not ready until the wormdb is finalized", name)
+	}
+
+	// Gather the sectors holding a match, each one is read once
+	var sectors []int
+	for i := sort.Search(len(ix.entries), func(i int) bool {
+		return bytes.Compare(ix.entries[i].key, needle) >= 0
+	}); i < len(ix.entries) && bytes.HasPrefix(ix.entries[i].key, needle); i++ {
+		sectors = append(sectors, ix.entries[i].sector)
+	}
+	slices.Sort(sectors)
+	sectors = slices.Compact(sectors)
+
+	buf := d.readpool.Get().([]byte)
+	defer d.readpool.Put(buf)
+	c := d.newCursor()
+	for _, n := range sectors {
+		b, err := d.readSector(buf, int64(n))
+		if err != nil {
+			return err
+		}
+		c.reset(b, int64(n))
+		for {
+			ok, err := c.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if bytes.HasPrefix(ix.key(c.rec), needle) {
+				if err := handler(c.rec); err != nil {
+					return stopped(err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package wormdb_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+func TestSecondaryIndex(t *testing.T) {
+	// Records are an id followed by a hash, indexed by the hash
+	hash := func(rec []byte) []byte {
+		return rec[bytes.IndexByte(rec, '.')+1:]
+	}
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("%04d.h%03d", i, i*37%100))
+	}
+
+	name := filepath.Join(t.TempDir(), "index.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256), bwdb.WithSecondaryIndex("hash", hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if err := db.Add([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.GetBy("hash", []byte("h042"), func([]byte) error { return nil }); err == nil {
+		t.Error("expected an error looking up before Finalize")
+	}
+	if err := db.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	f, err = os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := bwdb.Open(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256), bwdb.WithSecondaryIndex("hash", hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opened.Close()
+
+	for _, db := range []*bwdb.DB{db, opened} {
+		for _, needle := range []string{"h042", "h04", "h1", "x", ""} {
+			var want []string
+			for _, rec := range recs {
+				if bytes.HasPrefix(hash([]byte(rec)), []byte(needle)) {
+					want = append(want, rec)
+				}
+			}
+			var got []string
+			if err := db.GetBy("hash", []byte(needle), func(rec []byte) error {
+				got = append(got, string(rec))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("get by %q: expected %q, got %q", needle, want, got)
+			}
+		}
+		if err := db.GetBy("missing", []byte("h042"), func([]byte) error { return nil }); err == nil {
+			t.Error("expected an error for an unknown index")
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package wormdb
+
+import (
+	"bytes"
+	"container/list"
+	"math"
+)
+
+// InterpolationSearch finds the block for a needle by estimating where the
+// needle lies between the two ends of the remaining range, instead of always
+// bisecting it.  This takes far fewer probes when the keys are spread evenly,
+// such as zero-padded numbers or hashes.
+//
+// Each index entry is reduced to a number made from the 8 bytes which follow
+// the prefix common to the whole index, where each byte counts as a digit
+// within the range of byte values seen at that position.  When an estimate
+// does not cut the range down by at least a quarter, the next probe bisects
+// the range, so badly distributed keys cost at most about twice the probes of
+// a [BinarySearch].
+type InterpolationSearch struct {
+	BinarySearch
+
+	prefix    []byte    // Prefix shared by every entry in the Index
+	low, high [8]byte   // Range of byte values at each position after the prefix
+	keys      []float64 // Numeric value of each entry after the prefix
+}
+
+// Build an interpolation search index in memory for the constructed wormdb,
+// see [NewBinarySearch].
+func NewInterpolationSearch() *InterpolationSearch {
+	return &InterpolationSearch{
+		BinarySearch: BinarySearch{
+			list: list.New(),
+		},
+	}
+}
+
+// Load an interpolation search from a memory 2-D byte slice.
+func LoadInterpolationSearch(index [][]byte) *InterpolationSearch {
+	s := &InterpolationSearch{
+		BinarySearch: BinarySearch{
+			Index: index,
+		},
+	}
+	s.makeKeys()
+	return s
+}
+
+// Do not call this directly, but instead wormdb calls this once the database
+// has been finalized.
+func (s *InterpolationSearch) Finalize() error {
+	err := s.BinarySearch.Finalize()
+	s.makeKeys()
+	return err
+}
+
+// makeKeys computes the numeric value of each entry used for interpolating.
+func (s *InterpolationSearch) makeKeys() {
+	s.prefix, s.keys = nil, nil
+	if len(s.Index) == 0 {
+		return
+	}
+	first, last := s.Index[0], s.Index[len(s.Index)-1]
+	p := 0
+	for p < len(first) && p < len(last) && first[p] == last[p] {
+		p++
+	}
+	s.prefix = first[:p]
+
+	for i := range s.low {
+		s.low[i], s.high[i] = 255, 0
+	}
+	for _, entry := range s.Index {
+		for i, c := range entry[p:min(len(entry), p+len(s.low))] {
+			s.low[i], s.high[i] = min(s.low[i], c), max(s.high[i], c)
+		}
+	}
+
+	s.keys = make([]float64, len(s.Index))
+	for i, entry := range s.Index {
+		s.keys[i] = s.key(entry)
+	}
+}
+
+// key returns the numeric value of a needle, clamped to the range of the index
+// when it does not share the common prefix.
+func (s *InterpolationSearch) key(needle []byte) float64 {
+	p := len(s.prefix)
+	if c := bytes.Compare(needle[:min(len(needle), p)], s.prefix); c < 0 || c == 0 && len(needle) < p {
+		return -1
+	} else if c > 0 {
+		return math.Inf(1)
+	}
+	var v float64
+	for i := range s.low {
+		if s.low[i] > s.high[i] {
+			// No entry is long enough to have a byte here
+			break
+		}
+		var digit byte
+		if p+i < len(needle) {
+			digit = min(max(needle[p+i], s.low[i]), s.high[i]) - s.low[i]
+		}
+		v = v*(float64(s.high[i]-s.low[i])+1) + float64(digit)
+	}
+	return v
+}
+
+// interpolate returns the position of the needle in the Index, or where it
+// would be inserted.
+func (s *InterpolationSearch) interpolate(needle []byte, cmp func(a, b []byte) int) (pos int, exactMatch bool) {
+	var (
+		lo, hi = 0, len(s.Index)
+		v      = s.key(needle)
+		bisect bool
+	)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if !bisect {
+			kl, kh := s.keys[lo], s.keys[hi-1]
+			switch {
+			case v <= kl:
+				mid = lo
+			case v >= kh:
+				mid = hi - 1
+			default:
+				mid = lo + int(float64(v-kl)/float64(kh-kl)*float64(hi-1-lo))
+			}
+		}
+
+		size := hi - lo
+		switch c := cmp(s.Index[mid], needle); {
+		case c < 0:
+			lo = mid + 1
+		case c > 0:
+			hi = mid
+		default:
+			return mid, true
+		}
+		// Fall back to bisecting when the estimate did not narrow the range
+		bisect = !bisect && hi-lo > size*3/4
+	}
+	return lo, false
+}
+
+// Find will search for a needle in the Index and return either the match or
+// the lower bound where the match would be located between two entries, see
+// [BinarySearch.Find].
+func (s *InterpolationSearch) Find(needle []byte) (pos int, lower []byte, exactMatch bool) {
+	if s.order != nil {
+		return s.BinarySearch.Find(needle)
+	}
+	pos, exactMatch = s.interpolate(needle, bytes.Compare)
+	return s.find(needle, pos, exactMatch)
+}
+
+// FindBounds will search for a needle in the Index and return either the match
+// or the lower and upper bound matches where the match would be located
+// between two entries, see [BinarySearch.FindBounds].
+func (s *InterpolationSearch) FindBounds(needle []byte) (pos int, lower, upper []byte, exactMatch bool) {
+	if s.order != nil {
+		return s.BinarySearch.FindBounds(needle)
+	}
+	pos, exactMatch = s.interpolate(needle, bytes.Compare)
+	return s.findBounds(needle, pos, exactMatch)
+}
@@ -0,0 +1,73 @@
+//go:build go1.23
+
+package wormdb
+
+import "iter"
+
+// All returns an iterator over every record in the wormdb, for use with a
+// range loop in place of a [Walker].  An error ends the loop early without
+// saying so; use [DB.AllErr] to see it.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) All() iter.Seq[[]byte] {
+	return walkSeq(d.NewWalker)
+}
+
+// Range returns an iterator over the records in the half-open interval
+// [start, end), see [DB.NewRangeWalker].  An error ends the loop early without
+// saying so; use [DB.RangeErr] to see it.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) Range(start, end []byte) iter.Seq[[]byte] {
+	return walkSeq(func() *Walker { return d.NewRangeWalker(start, end) })
+}
+
+// AllErr is [DB.All], also yielding the error which ended the walk, if any, as
+// the last pair with a nil record.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) AllErr() iter.Seq2[[]byte, error] {
+	return walkSeq2(d.NewWalker)
+}
+
+// RangeErr is [DB.Range], also yielding the error which ended the walk, if
+// any, as the last pair with a nil record.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) RangeErr(start, end []byte) iter.Seq2[[]byte, error] {
+	return walkSeq2(func() *Walker { return d.NewRangeWalker(start, end) })
+}
+
+// walkSeq yields the records of a new walker from newWalker, so each loop over
+// the iterator begins a fresh walk.
+func walkSeq(newWalker func() *Walker) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		w := newWalker()
+		defer w.Release()
+		for w.Scan() {
+			if !yield(w.Bytes()) {
+				return
+			}
+		}
+	}
+}
+
+// walkSeq2 is walkSeq, also yielding the error which ended the walk.
+func walkSeq2(newWalker func() *Walker) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		w := newWalker()
+		defer w.Release()
+		for w.Scan() {
+			if !yield(w.Bytes(), nil) {
+				return
+			}
+		}
+		if err := w.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
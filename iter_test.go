@@ -0,0 +1,60 @@
+//go:build go1.23
+
+package wormdb_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+func TestIterators(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("iterator %03d", i))
+	}
+	db, _ := buildDB(t, recs, bwdb.WithBlockSize(256))
+
+	var got []string
+	for rec := range db.All() {
+		got = append(got, string(rec))
+	}
+	if !slices.Equal(got, recs) {
+		t.Fatalf("All walked %d records, want %d", len(got), len(recs))
+	}
+
+	got = got[:0]
+	for rec, err := range db.RangeErr([]byte("iterator 100"), []byte("iterator 200")) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(rec))
+	}
+	if !slices.Equal(got, recs[100:200]) {
+		t.Fatalf("RangeErr walked %q", got)
+	}
+
+	// Breaking out of the loop stops the walk
+	got = got[:0]
+	for rec := range db.Range([]byte("iterator 250"), nil) {
+		if got = append(got, string(rec)); len(got) == 3 {
+			break
+		}
+	}
+	if !slices.Equal(got, recs[250:253]) {
+		t.Fatalf("Range walked %q", got)
+	}
+
+	var n int
+	for _, err := range db.AllErr() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != len(recs) {
+		t.Fatalf("AllErr walked %d records, want %d", n, len(recs))
+	}
+}
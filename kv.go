@@ -0,0 +1,86 @@
+package wormdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Split each record into a key and a value at the first sep, so the wormdb can
+// be used as a key value store with [DB.GetValue].  The records are ordered by
+// their keys alone, which must be unique, and the search and any bloom filter
+// work on the keys too.  A record without sep is all key, with an empty
+// value.
+//
+// Ordering by key is done as with [WithCompare], so the same limits on the
+// search apply, and a comparison given with WithCompare is used in its place.
+// The same separator must be given again when opening, see [Option].  Without
+// it the whole record is the key, so [DB.GetValue] finds nothing, and lookups
+// miss records wherever the keys sort apart from the whole records, as "a-b=2"
+// sorts before "a=1".
+func WithKeySeparator(sep byte) Option {
+	return func(d *DB) {
+		d.keySep, d.hasKeySep = sep, true
+	}
+}
+
+// key returns the key of a record, which is the whole record unless a key
+// separator is set.
+func (d *DB) key(rec []byte) []byte {
+	if d.hasKeySep {
+		if i := bytes.IndexByte(rec, d.keySep); i >= 0 {
+			return rec[:i]
+		}
+	}
+	return rec
+}
+
+// compareKeys orders records by their keys, for WithKeySeparator.
+func (d *DB) compareKeys(a, b []byte) int {
+	return bytes.Compare(d.key(a), d.key(b))
+}
+
+// GetValue looks up the record with the given key and returns a copy of its
+// value, the part after the key separator set with [WithKeySeparator].  The ok
+// result reports whether the key was found, as a value may be empty.  Without
+// a key separator the whole record is the key, and so the value is always
+// empty.  As with [DB.GetExact], a bloom filter rules out most missing keys
+// without a read.
+func (d *DB) GetValue(key []byte) (value []byte, ok bool, err error) {
+	err = d.GetExact(key, func(rec []byte) error {
+		value, ok = bytes.Clone(rec[len(key):]), true
+		if len(value) > 0 {
+			// Drop the separator
+			value = value[1:]
+		}
+		return nil
+	})
+	return
+}
+
+// AddReader adds the record of key followed by the value read from r, joined
+// by the key separator when one is set with [WithKeySeparator], for values
+// which are not already held in memory.  The value is read into memory, and
+// as a record must fit within a block, no more than a block of it is read
+// before a value too long to be stored fails with [ErrRecordTooLong].  With
+// [WithLargeRecords] there is no limit and the whole value is read.
+func (d *DB) AddReader(key []byte, r io.Reader) error {
+	rec := bytes.NewBuffer(make([]byte, 0, d.blocksize))
+	rec.Write(key)
+	if d.hasKeySep {
+		rec.WriteByte(d.keySep)
+	}
+	limit := int64(d.blocksize - rec.Len())
+	if d.large {
+		limit = math.MaxInt64 - 1
+	}
+	n, err := rec.ReadFrom(io.LimitReader(r, limit+1))
+	if err != nil {
+		return fmt.Errorf("Could not read the value of %q: %w", key, err)
+	}
+	if n > limit {
+		return fmt.Errorf("%w, the value of %q is more than %d bytes", ErrRecordTooLong, key, limit)
+	}
+	return d.Add(rec.Bytes())
+}
@@ -0,0 +1,108 @@
+package wormdb_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+func TestWithKeySeparator(t *testing.T) {
+	// Sorted by key, which differs from the order of the whole records
+	recs := []string{"a=1", "a-b=2", "b", "b0=", "c=x=y"}
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("key%03d=value %d", i, i))
+	}
+	for _, opts := range [][]bwdb.Option{nil, {bwdb.WithBloom(10)}} {
+		db, _ := buildDB(t, recs, append(opts, bwdb.WithBlockSize(256), bwdb.WithKeySeparator('='))...)
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			key, value string
+			ok         bool
+		}{
+			{"a", "1", true},
+			{"a-b", "2", true},
+			{"b", "", true},
+			{"b0", "", true},
+			{"c", "x=y", true},
+			{"key000", "value 0", true},
+			{"key150", "value 150", true},
+			{"key299", "value 299", true},
+			{"key", "", false},
+			{"key1", "", false},
+			{"a=1", "", false},
+			{"d", "", false},
+		} {
+			value, ok, err := db.GetValue([]byte(tc.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != tc.value || ok != tc.ok {
+				t.Errorf("GetValue(%q) = %q, %v, want %q, %v", tc.key, value, ok, tc.value, tc.ok)
+			}
+		}
+	}
+
+	// Keys must be unique
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithKeySeparator('='))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Add([]byte("k=1"))
+	if err := db.Add([]byte("k=2")); err == nil {
+		t.Error("expected an error adding a duplicate key")
+	}
+}
+
+func TestAddReader(t *testing.T) {
+	for _, opts := range [][]bwdb.Option{nil, {bwdb.WithKeySeparator('=')}} {
+		f, err := os.CreateTemp(t.TempDir(), "*.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := bwdb.New(f, append(opts, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithBlockSize(256), bwdb.WithVarint())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		values := map[string]string{}
+		for i := 0; i < 100; i++ {
+			key, value := fmt.Sprintf("key%03d", i), strings.Repeat("v", i)
+			if err := db.AddReader([]byte(key), strings.NewReader(value)); err != nil {
+				t.Fatal(err)
+			}
+			values[key] = value
+		}
+		if err := db.AddReader([]byte("key100"), strings.NewReader(strings.Repeat("v", 1000))); !errors.Is(err, bwdb.ErrRecordTooLong) {
+			t.Errorf("expected %v for a value longer than a block, got %v", bwdb.ErrRecordTooLong, err)
+		}
+		if err := db.AddReader([]byte("key101"), iotest.ErrReader(os.ErrClosed)); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("expected the read error, got %v", err)
+		}
+		if err := db.Finalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		sep := ""
+		if len(opts) > 0 {
+			sep = "="
+		}
+		for key, value := range values {
+			rec, found, err := db.Lookup([]byte(key + sep + value))
+			if err != nil || !found || string(rec) != key+sep+value {
+				t.Fatalf("Lookup(%q) = %q, %v, %v", key, rec, found, err)
+			}
+		}
+	}
+}
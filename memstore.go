@@ -0,0 +1,74 @@
+package wormdb
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MemStore is a backing store held in memory, such as for building and
+// querying a wormdb in tests without a file, see [NewReaderWriterAt] and
+// [OpenReaderAt].  It grows as it is written to and is safe for concurrent use.
+type MemStore struct {
+	mu  sync.RWMutex
+	dat []byte
+}
+
+// Create an empty in-memory store.
+func NewMemStore() *MemStore {
+	return &MemStore{}
+}
+
+// ReadAt reads len(p) bytes from the store at off, returning io.EOF when the
+// read runs past the end.
+func (m *MemStore) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset %d", off)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if off >= int64(len(m.dat)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.dat[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p to the store at off, growing it as needed, where any gap
+// before off reads as zeros.
+func (m *MemStore) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset %d", off)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(m.dat)) {
+		if end > int64(cap(m.dat)) {
+			// Grow by doubling so the many small writes of a build stay cheap
+			grown := make([]byte, end, max(end, 2*int64(cap(m.dat))))
+			copy(grown, m.dat)
+			m.dat = grown
+		} else {
+			m.dat = m.dat[:end]
+		}
+	}
+	return copy(m.dat[off:], p), nil
+}
+
+// Size returns the number of bytes in the store.
+func (m *MemStore) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.dat))
+}
+
+// Bytes returns the contents of the store, which must not be modified and are
+// only valid until the next write.
+func (m *MemStore) Bytes() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.dat
+}
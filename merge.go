@@ -0,0 +1,150 @@
+package wormdb
+
+import "container/heap"
+
+// source is a sorted stream of records which are merged in while building.
+type source interface {
+	Scan() bool
+	Bytes() []byte
+	Err() error
+}
+
+// merger does a k-way merge of several sources using a heap ordered by the
+// CompareFunc.
+type merger struct {
+	comp    CompareFunc
+	items   []mergeItem
+	started bool
+	rec     []byte
+	err     error
+}
+
+type mergeItem struct {
+	w source // Records being merged
+	i int    // Index of the source, lower is older
+}
+
+// order compares two items with the older record always provided as `a` to
+// the CompareFunc.  The result is flipped when the newer item comes first.
+func (m *merger) order(x, y mergeItem) int {
+	if x.i < y.i {
+		return m.comp(x.w.Bytes(), y.w.Bytes())
+	}
+	return -m.comp(y.w.Bytes(), x.w.Bytes())
+}
+
+func (m *merger) Len() int { return len(m.items) }
+func (m *merger) Less(a, b int) bool {
+	c := m.order(m.items[a], m.items[b])
+	if c == 0 {
+		return m.items[a].i < m.items[b].i
+	}
+	return c < 0
+}
+func (m *merger) Swap(a, b int) { m.items[a], m.items[b] = m.items[b], m.items[a] }
+func (m *merger) Push(x any)    { m.items = append(m.items, x.(mergeItem)) }
+func (m *merger) Pop() any {
+	x := m.items[len(m.items)-1]
+	m.items = m.items[:len(m.items)-1]
+	return x
+}
+
+// advance moves the source at position p of the heap to its next record.
+func (m *merger) advance(p int) {
+	if m.items[p].w.Scan() {
+		heap.Fix(m, p)
+		return
+	}
+	if err := m.items[p].w.Err(); err != nil && m.err == nil {
+		m.err = err
+	}
+	heap.Remove(m, p)
+}
+
+// Scan advances to the next record across all of the sources.
+func (m *merger) Scan() bool {
+	if !m.started {
+		m.started = true
+		items := m.items
+		m.items = nil
+		for _, it := range items {
+			if it.w.Scan() {
+				m.items = append(m.items, it)
+			} else if err := it.w.Err(); err != nil && m.err == nil {
+				m.err = err
+			}
+		}
+		heap.Init(m)
+	} else if len(m.items) > 0 {
+		// Move past the record handed out by the last call
+		m.advance(0)
+	}
+
+	for len(m.items) > 0 {
+		if len(m.items) > 1 {
+			// The second smallest is one of the children of the root
+			second := 1
+			if len(m.items) > 2 && m.Less(2, 1) {
+				second = 2
+			}
+			top, next := m.items[0], m.items[second]
+			older, newer := 0, second
+			if next.i < top.i {
+				older, newer = second, 0
+			}
+			switch m.comp(m.items[older].w.Bytes(), m.items[newer].w.Bytes()) {
+			case TakeAOnly: // Only the older record is wanted
+				m.advance(newer)
+				continue
+			case TakeBOnly: // Only the newer record is wanted
+				m.advance(older)
+				continue
+			}
+		}
+		m.rec = m.items[0].w.Bytes()
+		return true
+	}
+	m.rec = nil
+	return false
+}
+
+// Bytes returns the current record.
+func (m *merger) Bytes() []byte {
+	return m.rec
+}
+
+// Err returns the first error encountered by any of the sources.
+func (m *merger) Err() error {
+	return m.err
+}
+
+// filter is a source which skips over the records that keep rejects.
+type filter struct {
+	source
+	keep func(rec []byte) bool
+}
+
+// releaseSource lets go of the wormdbs held open by the walkers of s, for a
+// merge which stopped before reading all of them.
+func releaseSource(s source) {
+	switch s := s.(type) {
+	case *Walker:
+		s.Release()
+	case *filter:
+		releaseSource(s.source)
+	case *merger:
+		for _, item := range s.items {
+			releaseSource(item.w)
+		}
+	}
+}
+
+// Scan advances to the next record which is kept.
+func (f *filter) Scan() bool {
+	for f.source.Scan() {
+		if f.keep(f.source.Bytes()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package wormdb
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap is not available on this platform, so reads fall back to ReadAt.
+func mmap(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+// munmap releases a mapping made with mmap.
+func munmap(b []byte) error {
+	return nil
+}
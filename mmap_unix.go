@@ -0,0 +1,18 @@
+//go:build unix
+
+package wormdb
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps the first size bytes of the file read-only into memory.
+func mmap(f *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap releases a mapping made with mmap.
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
@@ -0,0 +1,82 @@
+package wormdb
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// WalkParallel calls fn with every record of the wormdb, splitting the blocks
+// into a run for each of the workers to walk at once, such as for a transform
+// of the whole wormdb which can use every core.  Each run begins on a block
+// boundary, where a record is always stored whole, so no run needs the record
+// before it.  A workers of 0 or less uses [runtime.GOMAXPROCS].
+//
+// The records of a run are handed to fn in order, but the runs interleave, so
+// fn MUST be safe to call from many goroutines at once.  The first error from
+// fn or from reading a block stops every worker and is returned, apart from
+// [ErrStopIteration], which stops them and returns nil.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) WalkParallel(workers int, fn func(rec []byte) error) error {
+	if !d.acquire() {
+		return fmt.Errorf("Could not walk: %w", ErrClosed)
+	}
+	defer d.releaseReader()
+	blocks, err := d.blocks()
+	if err != nil {
+		return err
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = int(min(int64(workers), blocks))
+
+	var (
+		wg      sync.WaitGroup
+		stop    atomic.Bool
+		errOnce sync.Once
+	)
+	fail := func(e error) {
+		errOnce.Do(func() { err = e })
+		stop.Store(true)
+	}
+	for i := 0; i < workers; i++ {
+		// Spread the remainder over the first runs
+		from, to := blocks*int64(i)/int64(workers), blocks*int64(i+1)/int64(workers)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := d.readpool.Get().([]byte)
+			defer d.readpool.Put(buf)
+			c := d.newCursor()
+			for n := from; n < to && !stop.Load(); n++ {
+				b, err := d.readBlock(buf, n)
+				if err != nil && err != io.EOF {
+					fail(err)
+					return
+				}
+				c.reset(b, n)
+				for !stop.Load() {
+					ok, err := c.next()
+					if err != nil {
+						fail(err)
+						return
+					}
+					if !ok {
+						break
+					}
+					if err := fn(c.rec); err != nil {
+						fail(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return stopped(err)
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package wormdb
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves the disk space for size bytes of the file from off,
+// extending the file to cover them.
+func fallocate(f *os.File, off, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, off, size)
+}
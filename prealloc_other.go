@@ -0,0 +1,14 @@
+//go:build !linux
+
+package wormdb
+
+import (
+	"errors"
+	"os"
+)
+
+// fallocate is not available on this platform, so the file is extended with
+// truncate instead.
+func fallocate(f *os.File, off, size int64) error {
+	return errors.New("fallocate is not supported on this platform")
+}
@@ -0,0 +1,50 @@
+package wormdb
+
+import "io"
+
+// Have a [Walker] read the given number of blocks from the file at once when
+// walking forward, rather than one block at a time, and serve the records
+// from them until they are used up.  Fewer and larger reads suit disks which
+// are slow to seek and storage reached over a network.  Each walker holds a
+// buffer of blocks times the block size.  The option does nothing for a
+// wormdb which is memory mapped or compressed.
+func WithReadAhead(blocks int) Option {
+	return func(d *DB) {
+		d.readAhead = blocks
+	}
+}
+
+// readBlock reads the block n for the walker, reading the following blocks
+// along with it when reading ahead.  The error is io.EOF when the block is the
+// last in the file.
+func (w *Walker) readBlock(n int64) ([]byte, error) {
+	d := w.db
+	if d.readAhead <= 1 || d.codec != nil || d.mmap != nil {
+		if w.buf == nil {
+			w.buf = d.readpool.Get().([]byte)
+		}
+		return d.readBlock(w.buf, n)
+	}
+
+	if w.ahead == nil || n < w.aheadN || (n-w.aheadN)<<d.shift >= int64(len(w.ahead)) && !w.aheadEOF {
+		if w.ahead == nil {
+			w.ahead = make([]byte, d.readAhead*d.blocksize)
+		}
+		rn, err := d.file.ReadAt(w.ahead[:cap(w.ahead)], d.base()+n<<d.shift)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		w.ahead, w.aheadN, w.aheadEOF = w.ahead[:rn], n, rn < cap(w.ahead) || err == io.EOF
+	}
+
+	off := (n - w.aheadN) << d.shift
+	if off >= int64(len(w.ahead)) {
+		return nil, io.EOF
+	}
+	end := min(off+int64(d.blocksize), int64(len(w.ahead)))
+	var err error
+	if w.aheadEOF && end == int64(len(w.ahead)) {
+		err = io.EOF
+	}
+	return d.checkBlock(w.ahead[off:end], n, err)
+}
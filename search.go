@@ -4,7 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"container/list"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
 	"log"
 	"os"
 	"slices"
@@ -38,11 +42,23 @@ type BinarySearch struct {
 	Index                [][]byte
 	list                 *list.List
 	lowerByte, upperByte []int
+	order                func(a, b []byte) int // Ordering of the entries, nil for bytes.Compare
+	fp                   *fingerprint          // Data file the index was built with, when known
+	loaded               bool                  // Loaded from a save, so fp is checked when opened
 
 	f    *os.File
 	disk *DB
 }
 
+// Count returns the number of entries in the index, one for each block,
+// including those still being added before Finalize.
+func (s *BinarySearch) Count() int {
+	if s.Index == nil && s.list != nil {
+		return s.list.Len()
+	}
+	return len(s.Index)
+}
+
 // Load a binary search from a memory 2-D byte slice.
 func LoadBinarySearch(index [][]byte) *BinarySearch {
 	bs := &BinarySearch{
@@ -65,6 +81,172 @@ func LoadDiskBinarySearch(file *os.File) (*BinarySearch, error) {
 	return bs, nil
 }
 
+// The saved index begins with this magic followed by a format version byte.
+// From version 2 the entries are followed by a CRC64 of the count and entries,
+// so a damaged index is caught on load rather than by a bad lookup later.
+// Version 3 begins with the fingerprint of the data file the index was built
+// with, and is only written for an index which has one.
+const (
+	indexMagic   = "WORMIX"
+	indexVersion = 3
+)
+
+var indexTable = crc64.MakeTable(crc64.ECMA)
+
+// hashReader hashes the bytes read through it.
+type hashReader struct {
+	r *bufio.Reader
+	h hash.Hash64
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	return n, err
+}
+
+func (h *hashReader) ReadByte() (byte, error) {
+	c, err := h.r.ReadByte()
+	if err == nil {
+		h.h.Write([]byte{c})
+	}
+	return c, err
+}
+
+// Load a binary search which was written out with [BinarySearch.Save].  An
+// index saved before the checksum was added, as version 1, is still loaded but
+// can not be checked.
+func LoadBinarySearchReader(r io.Reader) (*BinarySearch, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(indexMagic)+1)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, fmt.Errorf("Could not read index header: %w", err)
+	}
+	if string(head[:len(indexMagic)]) != indexMagic {
+		return nil, fmt.Errorf("Invalid index magic %q", head[:len(indexMagic)])
+	}
+	version := head[len(indexMagic)]
+	if version < 1 || version > indexVersion {
+		return nil, fmt.Errorf("Unsupported index version %d", version)
+	}
+	hr := &hashReader{r: br, h: crc64.New(indexTable)}
+
+	var fp *fingerprint
+	if version >= 3 {
+		var err error
+		if fp, err = readFingerprint(hr); err != nil {
+			return nil, fmt.Errorf("Could not read index fingerprint: %w", err)
+		}
+	}
+	count, err := binary.ReadUvarint(hr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read index length: %w", err)
+	}
+	// Avoid trusting the count for the allocation size in case it is bogus
+	index := make([][]byte, 0, min(count, 1<<16))
+	for i := uint64(0); i < count; i++ {
+		l, err := binary.ReadUvarint(hr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read index entry %d: %w", i, err)
+		}
+		if l > 1<<20 {
+			return nil, fmt.Errorf("Index entry %d has invalid length %d", i, l)
+		}
+		entry := make([]byte, l)
+		if _, err := io.ReadFull(hr, entry); err != nil {
+			return nil, fmt.Errorf("Could not read index entry %d: %w", i, err)
+		}
+		index = append(index, entry)
+	}
+
+	if version >= 2 {
+		var sum [8]byte
+		if _, err := io.ReadFull(br, sum[:]); err != nil {
+			return nil, fmt.Errorf("Could not read index checksum: %w", err)
+		}
+		if want, got := binary.BigEndian.Uint64(sum[:]), hr.h.Sum64(); want != got {
+			return nil, fmt.Errorf("Index checksum mismatch, expected %016x got %016x", want, got)
+		}
+	}
+	bs := LoadBinarySearch(index)
+	bs.fp, bs.loaded = fp, true
+	return bs, nil
+}
+
+// Save writes the finalized index out so it can be loaded again with
+// [LoadBinarySearchReader] without walking the data file.  An index built
+// with a wormdb holds a fingerprint of the data file, which is saved with it
+// so that opening the index with a different file is caught, see
+// [WithIndexCheck].
+func (s *BinarySearch) Save(w io.Writer) error {
+	if s.Index == nil && s.list != nil {
+		return fmt.Errorf("Index must be finalized before saving")
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString(indexMagic)
+
+	var (
+		tmp [binary.MaxVarintLen64]byte
+		h   = crc64.New(indexTable)
+		out = io.MultiWriter(bw, h)
+	)
+	if s.fp != nil {
+		bw.WriteByte(indexVersion)
+		out.Write(s.fp.append(nil))
+	} else {
+		// Readers from before the fingerprint can still load the index
+		bw.WriteByte(2)
+	}
+	out.Write(binary.AppendUvarint(tmp[:0], uint64(len(s.Index))))
+	for _, entry := range s.Index {
+		out.Write(binary.AppendUvarint(tmp[:0], uint64(len(entry))))
+		out.Write(entry)
+	}
+	bw.Write(binary.BigEndian.AppendUint64(tmp[:0], h.Sum64()))
+	return bw.Flush()
+}
+
+// WriteBoundaries writes the first record of each block, in order and one to a
+// line, such as for deciding where to split the records into shards.  Use
+// [BinarySearch.Save] to keep the index for loading again, as a record holding
+// a newline can not be written this way and is an error.
+func (s *BinarySearch) WriteBoundaries(w io.Writer) error {
+	if s.Index == nil && s.list != nil {
+		return fmt.Errorf("Index must be finalized before writing boundaries")
+	}
+	bw := bufio.NewWriter(w)
+	for i, entry := range s.Index {
+		if bytes.IndexByte(entry, '\n') >= 0 {
+			return fmt.Errorf("Index entry %d holds a newline: %q", i, entry)
+		}
+		bw.Write(entry)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// AddBoundary adds the first record of block sector to an index being built
+// with [NewBinarySearch], such as to rebuild the index from the boundaries
+// kept by [BinarySearch.WriteBoundaries] without walking the data file.  The
+// boundaries must be added in order, one for every block starting from 0, and
+// Finalize called after the last, after which Find works the same as on the
+// index first built with the wormdb.
+func (s *BinarySearch) AddBoundary(key []byte, sector int) error {
+	if s.list == nil {
+		return fmt.Errorf("Could not add boundary %q, the search is not being built in memory", key)
+	}
+	if n := s.list.Len(); sector != n {
+		return fmt.Errorf("Could not add boundary %q for block %d, the next block is %d", key, sector, n)
+	}
+	if back := s.list.Back(); back != nil {
+		prev := back.Value.([]byte)
+		if s.compare()(prev, key) >= 0 {
+			return fmt.Errorf("%w, boundary %q cannot come after %q", ErrOutOfOrder, key, prev)
+		}
+	}
+	return s.Add(key)
+}
+
 // Build a search index in memory for the constructed wormdb.  Please note that
 // there must be enough memory on the system for the Index when the database is
 // being built.  This is in opposed to the [NewFileBinarySearch], which uses disk
@@ -94,6 +276,7 @@ func NewDiskBinarySearch(file *os.File) *BinarySearch {
 		file:      file,
 		blocksize: 1 << 16, // 64k
 		prev:      make([]byte, 0, 256),
+		framing:   &byteFraming{},
 	}
 	db.offset = int64(db.offset / int64(db.blocksize))
 
@@ -142,7 +325,7 @@ func (s *BinarySearch) LoadIndexToMemory() error {
 // in memory and the list is disposed of.
 func (s *BinarySearch) Add(needle []byte) error {
 	if s.Index != nil {
-		return fmt.Errorf("Could not add %q as search has been finalized", needle)
+		return fmt.Errorf("Could not add %q to the search: %w", needle, ErrFinalized)
 	}
 	if s.list != nil {
 		tmp := make([]byte, len(needle))
@@ -186,44 +369,72 @@ func (s *BinarySearch) Finalize() error {
 // After a database has been loaded into memory from a save, call this to build
 // the lower and upper byte bounds for faster searching capabilities.
 func (s *BinarySearch) makeFirstByte() {
-	return
+	if len(s.Index) == 0 {
+		s.lowerByte, s.upperByte = nil, nil
+		return
+	}
 	var (
-		lb    = make([]int, 256)
-		ub    = make([]int, 256)
-		cur   = byte(255)
-		upper = len(s.Index)
+		lb = make([]int, 256)
+		ub = make([]int, 256)
+		i  int
 	)
-	for i := upper - 1; i >= 0; i-- {
-		if s.Index[i][0] != cur {
-			for cur > s.Index[i][0] {
-				ub[cur] = upper
-				lb[cur] = i
-				cur--
-			}
-			upper = i + 1
+	// The lower bound is the first entry starting with a byte at or above c,
+	// empty entries sort ahead of everything else.
+	for c := 0; c < 256; c++ {
+		for i < len(s.Index) && (len(s.Index[i]) == 0 || int(s.Index[i][0]) < c) {
+			i++
 		}
+		lb[c] = i
 	}
-	for cur > 0 {
-		ub[cur] = upper
-		cur--
+	// The upper bound is the lower bound of the next byte
+	for c := 0; c < 255; c++ {
+		ub[c] = lb[c+1]
 	}
-	ub[0] = upper
+	ub[255] = len(s.Index)
 	s.lowerByte, s.upperByte = lb, ub
-	//log.Printf("lb: %#v\n", s.lowerByte)
-	//log.Printf("ub: %#v\n", s.upperByte)
+}
+
+// setOrder has the search order the entries with cmp, see [WithCompare].
+func (s *BinarySearch) setOrder(cmp func(a, b []byte) int) {
+	s.order = cmp
+}
+
+// compare returns the order of the entries, bytes.Compare unless one was set.
+func (s *BinarySearch) compare() func(a, b []byte) int {
+	if s.order != nil {
+		return s.order
+	}
+	return bytes.Compare
+}
+
+// search returns the position of the needle in the Index, or where it would
+// be inserted, comparing with cmp, which must follow the order of the entries.
+// The first byte narrows the range when the entries are in byte order.
+func (s *BinarySearch) search(needle []byte, cmp func(a, b []byte) int) (pos int, exactMatch bool) {
+	// The first byte buckets only hold for byte ordering
+	if s.order == nil && len(s.lowerByte) > 0 && len(needle) > 0 {
+		fb := needle[0]
+		pos, exactMatch = slices.BinarySearchFunc(s.Index[s.lowerByte[fb]:s.upperByte[fb]], needle, cmp)
+		return pos + s.lowerByte[fb], exactMatch
+	}
+	return slices.BinarySearchFunc(s.Index, needle, cmp)
 }
 
 // Find will search for a needle in the Index and return either the match or
 // the lower bound where the match would be located between two entries.  The
 // purpose of the lower bound is to ensure that the match will be contained in
-// the block retrieved from slow storage, such as a disk.
+// the block retrieved from slow storage, such as a disk.  An empty Index finds
+// nothing, the same as a needle before the first entry.
 func (s *BinarySearch) Find(needle []byte) (pos int, lower []byte, exactMatch bool) {
-	if len(s.lowerByte) > 0 {
-		fb := needle[0]
-		pos, exactMatch = slices.BinarySearchFunc(s.Index[s.lowerByte[fb]:s.upperByte[fb]], needle, bytes.Compare)
-		pos += s.lowerByte[fb]
-	} else {
-		pos, exactMatch = slices.BinarySearchFunc(s.Index, needle, bytes.Compare)
+	pos, exactMatch = s.search(needle, s.compare())
+	return s.find(needle, pos, exactMatch)
+}
+
+// find turns the insertion point of the needle into the result for Find.
+func (s *BinarySearch) find(needle []byte, pos int, exactMatch bool) (int, []byte, bool) {
+	if len(s.Index) == 0 {
+		// An empty wormdb has nothing to find
+		return 0, nil, false
 	}
 	if !exactMatch {
 		if pos == 0 {
@@ -247,12 +458,15 @@ func (s *BinarySearch) Find(needle []byte) (pos int, lower []byte, exactMatch bo
 // disk) and the upper bound is useful for segmenting data to make sure the
 // result lies within the block.
 func (s *BinarySearch) FindBounds(needle []byte) (pos int, lower, upper []byte, exactMatch bool) {
-	if len(s.lowerByte) > 0 {
-		fb := needle[0]
-		pos, exactMatch = slices.BinarySearchFunc(s.Index[s.lowerByte[fb]:s.upperByte[fb]], needle, bytes.Compare)
-		pos += s.lowerByte[fb]
-	} else {
-		pos, exactMatch = slices.BinarySearchFunc(s.Index, needle, bytes.Compare)
+	pos, exactMatch = s.search(needle, s.compare())
+	return s.findBounds(needle, pos, exactMatch)
+}
+
+// findBounds turns the insertion point of the needle into the result for
+// FindBounds.
+func (s *BinarySearch) findBounds(needle []byte, pos int, exactMatch bool) (int, []byte, []byte, bool) {
+	if len(s.Index) == 0 {
+		return 0, nil, nil, false
 	}
 	if !exactMatch {
 		if pos == 0 {
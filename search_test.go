@@ -0,0 +1,526 @@
+package wormdb_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	bwdb "github.com/pschou/go-wormdb"
+)
+
+func TestBinarySearchSave(t *testing.T) {
+	var buf bytes.Buffer
+	if err := bwdb.LoadBinarySearch(index).Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := bwdb.LoadBinarySearchReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(bs.Index) != fmt.Sprint(index) {
+		t.Fatal("loaded index does not match the saved one")
+	}
+
+	// Truncated and foreign files must not load
+	if _, err := bwdb.LoadBinarySearchReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Error("expected an error loading a truncated index")
+	}
+	if _, err := bwdb.LoadBinarySearchReader(bytes.NewReader([]byte("NOTANINDEX"))); err == nil {
+		t.Error("expected an error loading a foreign file")
+	}
+
+	// A damaged entry must be caught by the checksum
+	bad := bytes.Clone(buf.Bytes())
+	bad[len(bad)-9] ^= 0x20
+	if _, err := bwdb.LoadBinarySearchReader(bytes.NewReader(bad)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected a checksum error loading a damaged index, got %v", err)
+	}
+
+	// An index saved as version 1 has no checksum and still loads
+	old := bytes.Clone(buf.Bytes()[:buf.Len()-8])
+	old[len("WORMIX")] = 1
+	if bs, err := bwdb.LoadBinarySearchReader(bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(bs.Index) != fmt.Sprint(index) {
+		t.Fatal("loaded version 1 index does not match the saved one")
+	}
+}
+
+// findReference is a brute force version of BinarySearch.Find
+func findReference(index [][]byte, needle []byte) (int, []byte, bool) {
+	pos := 0
+	for pos < len(index) && bytes.Compare(index[pos], needle) < 0 {
+		pos++
+	}
+	if pos < len(index) && bytes.Equal(index[pos], needle) {
+		return pos, index[pos], true
+	}
+	if pos == 0 {
+		if bytes.HasPrefix(index[0], needle) {
+			return 0, index[0], true
+		}
+		return 0, nil, false
+	}
+	return pos - 1, index[pos-1], false
+}
+
+// randomIndex builds a sorted index with a spread of first bytes.
+func randomIndex(r *rand.Rand, n int, alphabet string) [][]byte {
+	seen := make(map[string]bool)
+	var index [][]byte
+	for len(index) < n {
+		k := make([]byte, 1+r.Intn(6))
+		for i := range k {
+			k[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		if !seen[string(k)] {
+			seen[string(k)] = true
+			index = append(index, k)
+		}
+	}
+	slices.SortFunc(index, bytes.Compare)
+	return index
+}
+
+func TestBinarySearchFirstByte(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, alphabet := range []string{"a", "ab", "\x00az\xff", "0123456789abcdef"} {
+		for _, n := range []int{1, 2, 6, 100} {
+			if len(alphabet) == 1 {
+				// Only six unique keys can be made from a single letter
+				n = min(n, 6)
+			}
+			index := randomIndex(r, n, alphabet)
+			bs := bwdb.LoadBinarySearch(index)
+			for i := 0; i < 2000; i++ {
+				needle := make([]byte, r.Intn(7))
+				for j := range needle {
+					needle[j] = alphabet[r.Intn(len(alphabet))]
+				}
+				if i%10 == 0 {
+					needle = append(needle, byte(r.Intn(256)))
+				}
+				pos, lower, exact := bs.Find(needle)
+				wpos, wlower, wexact := findReference(index, needle)
+				if pos != wpos || !bytes.Equal(lower, wlower) || exact != wexact {
+					t.Fatalf("Find(%q) = %d %q %v, expected %d %q %v", needle, pos, lower, exact, wpos, wlower, wexact)
+				}
+				fpos, flower, _, fexact := bs.FindBounds(needle)
+				if fpos != wpos || !bytes.Equal(flower, wlower) || fexact != wexact {
+					t.Fatalf("FindBounds(%q) = %d %q %v, expected %d %q %v", needle, fpos, flower, fexact, wpos, wlower, wexact)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkBinarySearchFind(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	index := randomIndex(r, 1<<20, "0123456789abcdefghijklmnopqrstuvwxyz")
+	needles := make([][]byte, 4096)
+	for i := range needles {
+		needles[i] = append(index[r.Intn(len(index))], 'x')
+	}
+
+	for _, tc := range []struct {
+		name string
+		bs   *bwdb.BinarySearch
+	}{
+		{"bucketed", bwdb.LoadBinarySearch(index)},
+		{"full", &bwdb.BinarySearch{Index: index}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tc.bs.Find(needles[i%len(needles)])
+			}
+		})
+	}
+}
+
+// uniformIndex builds a sorted index of zero-padded numbers spread evenly.
+func uniformIndex(r *rand.Rand, n int) [][]byte {
+	seen := make(map[int64]bool)
+	var index [][]byte
+	for len(index) < n {
+		v := r.Int63n(1e12)
+		if !seen[v] {
+			seen[v] = true
+			index = append(index, []byte(fmt.Sprintf("key%012d", v)))
+		}
+	}
+	slices.SortFunc(index, bytes.Compare)
+	return index
+}
+
+func TestInterpolationSearch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	indexes := [][][]byte{uniformIndex(r, 1000), {[]byte("only")}}
+	for _, alphabet := range []string{"ab", "\x00az\xff", "0123456789abcdef"} {
+		indexes = append(indexes, randomIndex(r, 100, alphabet))
+	}
+	for _, index := range indexes {
+		s := bwdb.LoadInterpolationSearch(index)
+		for i := 0; i < 2000; i++ {
+			needle := slices.Clone(index[r.Intn(len(index))])
+			switch i % 4 {
+			case 1:
+				needle = append(needle, byte(r.Intn(256)))
+			case 2:
+				needle = needle[:r.Intn(len(needle)+1)]
+			case 3:
+				needle[r.Intn(len(needle))] = byte(r.Intn(256))
+			}
+			pos, lower, exact := s.Find(needle)
+			wpos, wlower, wexact := findReference(index, needle)
+			if pos != wpos || !bytes.Equal(lower, wlower) || exact != wexact {
+				t.Fatalf("Find(%q) = %d %q %v, expected %d %q %v", needle, pos, lower, exact, wpos, wlower, wexact)
+			}
+			fpos, flower, _, fexact := s.FindBounds(needle)
+			if fpos != wpos || !bytes.Equal(flower, wlower) || fexact != wexact {
+				t.Fatalf("FindBounds(%q) = %d %q %v, expected %d %q %v", needle, fpos, flower, fexact, wpos, wlower, wexact)
+			}
+		}
+	}
+
+	// Use it as the search while building a wormdb
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := bwdb.NewInterpolationSearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(s), bwdb.WithBlockSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, rec := range indexes[0] {
+		if err := db.Add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range indexes[0][:100] {
+		var found bool
+		if err := db.Get(rec, func(got []byte) error {
+			found = bytes.Equal(got, rec)
+			return nil
+		}); err != nil || !found {
+			t.Fatalf("Get(%q) found %v, %v", rec, found, err)
+		}
+	}
+}
+
+func BenchmarkInterpolationSearchFind(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	index := uniformIndex(r, 1<<20)
+	needles := make([][]byte, 4096)
+	for i := range needles {
+		needles[i] = append(index[r.Intn(len(index))], 'x')
+	}
+
+	for _, tc := range []struct {
+		name string
+		s    bwdb.Search
+	}{
+		{"binary", bwdb.LoadBinarySearch(index)},
+		{"interpolation", bwdb.LoadInterpolationSearch(index)},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tc.s.Find(needles[i%len(needles)])
+			}
+			var probes int
+			for _, needle := range needles {
+				probes += bwdb.Probes(tc.s, needle)
+			}
+			b.ReportMetric(float64(probes)/float64(len(needles)), "probes/op")
+		})
+	}
+}
+
+func TestTrieSearch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	indexes := [][][]byte{index, {[]byte("only")}, {{}, []byte("a"), []byte("ab"), []byte("b")}}
+	for _, alphabet := range []string{"a", "ab", "\x00az\xff", "0123456789abcdef"} {
+		for _, n := range []int{1, 2, 6, 100} {
+			if len(alphabet) == 1 {
+				n = min(n, 6)
+			}
+			indexes = append(indexes, randomIndex(r, n, alphabet))
+		}
+	}
+	for _, index := range indexes {
+		bs, ts := bwdb.LoadBinarySearch(index), bwdb.LoadTrieSearch(index)
+		for i := 0; i < 2000; i++ {
+			needle := slices.Clone(index[r.Intn(len(index))])
+			switch i % 4 {
+			case 1:
+				needle = append(needle, byte(r.Intn(256)))
+			case 2:
+				needle = needle[:r.Intn(len(needle)+1)]
+			case 3:
+				if len(needle) > 0 {
+					needle[r.Intn(len(needle))] = byte(r.Intn(256))
+				}
+			}
+			pos, lower, upper, exact := ts.FindBounds(needle)
+			wpos, wlower, wupper, wexact := bs.FindBounds(needle)
+			if pos != wpos || !bytes.Equal(lower, wlower) || !bytes.Equal(upper, wupper) || exact != wexact {
+				t.Fatalf("FindBounds(%q) = %d %q %q %v, expected %d %q %q %v",
+					needle, pos, lower, upper, exact, wpos, wlower, wupper, wexact)
+			}
+			if pos, lower, exact = ts.Find(needle); pos != wpos || !bytes.Equal(lower, wlower) || exact != wexact {
+				t.Fatalf("Find(%q) = %d %q %v, expected %d %q %v", needle, pos, lower, exact, wpos, wlower, wexact)
+			}
+		}
+	}
+}
+
+func TestWriteBoundaries(t *testing.T) {
+	bs := bwdb.NewBinarySearch()
+	for _, key := range []string{"apple", "banana", "cherry"} {
+		bs.Add([]byte(key))
+	}
+	var buf bytes.Buffer
+	if err := bs.WriteBoundaries(&buf); err == nil {
+		t.Error("expected an error before Finalize")
+	}
+	if bs.Count() != 3 {
+		t.Errorf("expected 3 entries while building, got %d", bs.Count())
+	}
+	bs.Finalize()
+	if err := bs.WriteBoundaries(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "apple\nbanana\ncherry\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if bs.Count() != 3 {
+		t.Errorf("expected 3 entries, got %d", bs.Count())
+	}
+
+	buf.Reset()
+	if err := bwdb.LoadBinarySearch([][]byte{[]byte("a\nb")}).WriteBoundaries(&buf); err == nil {
+		t.Error("expected an error for an entry holding a newline")
+	}
+}
+
+func TestAddBoundary(t *testing.T) {
+	var recs []string
+	for i := 0; i < 600; i++ {
+		recs = append(recs, fmt.Sprintf("boundary %04d", i))
+	}
+	_, bs := buildDB(t, recs, bwdb.WithBlockSize(256))
+	var buf bytes.Buffer
+	if err := bs.WriteBoundaries(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuild the index from the boundaries written out
+	rebuilt := bwdb.NewBinarySearch()
+	for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if err := rebuilt.AddBoundary([]byte(line), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rebuilt.Finalize()
+	if !slices.EqualFunc(rebuilt.Index, bs.Index, bytes.Equal) {
+		t.Fatalf("rebuilt %d entries, want %d", len(rebuilt.Index), len(bs.Index))
+	}
+	for _, needle := range []string{"", "boundary", "boundary 0123", "boundary 0599", "boundary 1", "zzz"} {
+		pos, lower, exact := rebuilt.Find([]byte(needle))
+		wpos, wlower, wexact := bs.Find([]byte(needle))
+		if pos != wpos || !bytes.Equal(lower, wlower) || exact != wexact {
+			t.Errorf("Find(%q) = %d %q %v, expected %d %q %v", needle, pos, lower, exact, wpos, wlower, wexact)
+		}
+	}
+
+	s := bwdb.NewBinarySearch()
+	if err := s.AddBoundary([]byte("b"), 1); err == nil {
+		t.Error("expected an error for a gap before the first block")
+	}
+	s.AddBoundary([]byte("b"), 0)
+	if err := s.AddBoundary([]byte("a"), 1); !errors.Is(err, bwdb.ErrOutOfOrder) {
+		t.Errorf("expected %v, got %v", bwdb.ErrOutOfOrder, err)
+	}
+	s.Finalize()
+	if err := s.AddBoundary([]byte("c"), 1); err == nil {
+		t.Error("expected an error after Finalize")
+	}
+}
+
+func TestSparseBinarySearch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	indexes := [][][]byte{index, {[]byte("only")}, {{}, []byte("a"), []byte("ab"), []byte("b")}}
+	for _, n := range []int{2, 7, 100, 1000} {
+		indexes = append(indexes, randomIndex(r, n, "0123456789abcdef"))
+	}
+	for _, index := range indexes {
+		for _, every := range []int{1, 3, 16} {
+			f, err := os.Create(filepath.Join(t.TempDir(), "sparse.idx"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			ss := bwdb.NewSparseBinarySearch(f, every)
+			for _, key := range index {
+				if err := ss.Add(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ss.Finalize(); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := bwdb.LoadSparseBinarySearch(f, every+1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.Count() != len(index) {
+				t.Fatalf("loaded %d entries, want %d", loaded.Count(), len(index))
+			}
+
+			bs := bwdb.LoadBinarySearch(index)
+			for i := 0; i < 500; i++ {
+				needle := slices.Clone(index[r.Intn(len(index))])
+				switch i % 4 {
+				case 1:
+					needle = append(needle, byte(r.Intn(256)))
+				case 2:
+					needle = needle[:r.Intn(len(needle)+1)]
+				case 3:
+					if len(needle) > 0 {
+						needle[r.Intn(len(needle))] = byte(r.Intn(256))
+					}
+				}
+				wpos, wlower, wupper, wexact := bs.FindBounds(needle)
+				for _, s := range []*bwdb.SparseBinarySearch{ss, loaded} {
+					pos, lower, upper, exact := s.FindBounds(needle)
+					if pos != wpos || !bytes.Equal(lower, wlower) || !bytes.Equal(upper, wupper) || exact != wexact {
+						t.Fatalf("FindBounds(%q) = %d %q %q %v, expected %d %q %q %v",
+							needle, pos, lower, upper, exact, wpos, wlower, wupper, wexact)
+					}
+					if pos, lower, exact = s.Find(needle); pos != wpos || !bytes.Equal(lower, wlower) || exact != wexact {
+						t.Fatalf("Find(%q) = %d %q %v, expected %d %q %v", needle, pos, lower, exact, wpos, wlower, wexact)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSparseBinarySearchGet(t *testing.T) {
+	var recs []string
+	for i := 0; i < 2000; i++ {
+		recs = append(recs, fmt.Sprintf("sparse %05d", i*3))
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	db, _ := buildDB(t, recs, bwdb.WithBlockSize(256), bwdb.WithSearch(bwdb.NewSparseBinarySearch(f, 8)))
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for _, needle := range []string{"sparse 00000", "sparse 00301", "sparse 02997", "sparse 05997", "sparse 9", "a"} {
+		var got string
+		if err := db.Get([]byte(needle), func(rec []byte) error {
+			got = string(rec)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		if i, ok := slices.BinarySearch(recs, needle); ok {
+			want = recs[i]
+		}
+		if got != want {
+			t.Errorf("Get(%q) = %q, want %q", needle, got, want)
+		}
+	}
+
+	// A failed read of the segment file is an error rather than a miss
+	if err := f.Truncate(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get([]byte(recs[1500]), func([]byte) error { return nil }); !errors.Is(err, bwdb.ErrTruncated) {
+		t.Errorf("expected %v from Get, got %v", bwdb.ErrTruncated, err)
+	}
+	if _, _, err := db.Lookup([]byte(recs[1500])); !errors.Is(err, bwdb.ErrTruncated) {
+		t.Errorf("expected %v from Lookup, got %v", bwdb.ErrTruncated, err)
+	}
+	f.Close()
+	if err := db.Verify(); err == nil {
+		t.Error("expected Verify to fail once the segment file is closed")
+	}
+}
+
+func TestIndexFingerprint(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("fingerprint %04d", i))
+	}
+	build := func(recs []string, blocksize int) (string, []byte) {
+		name := filepath.Join(t.TempDir(), "fp.db")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs := bwdb.NewBinarySearch()
+		db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(blocksize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			db.Add([]byte(rec))
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := bs.Save(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return name, buf.Bytes()
+	}
+	open := func(name string, saved []byte, options ...bwdb.Option) error {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		bs, err := bwdb.LoadBinarySearchReader(bytes.NewReader(saved))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = bwdb.Open(f, append(options, bwdb.WithSearch(bs))...)
+		return err
+	}
+
+	name, saved := build(recs, 256)
+	if saved[len("WORMIX")] != 3 {
+		t.Errorf("saved index version %d, want 3", saved[len("WORMIX")])
+	}
+	if err := open(name, saved, bwdb.WithBlockSize(256)); err != nil {
+		t.Fatal(err)
+	}
+	if err := open(name, saved, bwdb.WithBlockSize(512)); !errors.Is(err, bwdb.ErrIndexMismatch) {
+		t.Errorf("wrong block size: expected %v, got %v", bwdb.ErrIndexMismatch, err)
+	}
+	other, _ := build(recs[1:], 256)
+	if err := open(other, saved, bwdb.WithBlockSize(256)); !errors.Is(err, bwdb.ErrIndexMismatch) {
+		t.Errorf("wrong data file: expected %v, got %v", bwdb.ErrIndexMismatch, err)
+	}
+	if err := open(other, saved, bwdb.WithBlockSize(256), bwdb.WithIndexCheck(false)); err != nil {
+		t.Errorf("check turned off: %v", err)
+	}
+}
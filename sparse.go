@@ -0,0 +1,212 @@
+package wormdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// SparseBinarySearch keeps only the first record of every Kth block in
+// memory, with the first records of all the blocks written out to a segment
+// file.  A lookup bisects the records in memory to find the run of K blocks
+// holding the needle, then reads the first records of that run from the
+// segment file with a single read to find the block.  This cuts the memory of
+// the index by about K times over a [BinarySearch], such as for a wormdb too
+// large for every block to be held in memory, at the cost of the extra read.
+//
+// The results are the same as a [BinarySearch] over the same records.  As the
+// records are read from the segment file, the lower and upper bounds returned
+// are allocated on each call.  A failed read of the segment file is returned
+// by the lookups of the wormdb using the search, while Find and FindBounds,
+// which have no way to return it, find nothing.
+type SparseBinarySearch struct {
+	every   int      // Blocks in each run
+	count   int      // Blocks in the index
+	firsts  [][]byte // First record of the first block of each run
+	offsets []int64  // Offset of each run in the segment file, and of the end
+	order   func(a, b []byte) int
+
+	f       *os.File
+	w       *bufio.Writer // Writes the segment file while building
+	written int64
+}
+
+// Build a sparse search index for the constructed wormdb, which writes the
+// first records of the blocks into file and keeps the first record of every
+// Kth block in memory.  The file holds the part of the index not in memory,
+// and is needed to load the search again with [LoadSparseBinarySearch].
+func NewSparseBinarySearch(file *os.File, every int) *SparseBinarySearch {
+	return &SparseBinarySearch{
+		every: max(every, 1),
+		f:     file,
+		w:     bufio.NewWriter(file),
+	}
+}
+
+// Load a sparse search from the segment file written by a
+// [NewSparseBinarySearch], keeping the first record of every Kth block in
+// memory.  The whole file is read through once, and K need not be the same
+// as when the file was written.
+func LoadSparseBinarySearch(file *os.File, every int) (*SparseBinarySearch, error) {
+	s := &SparseBinarySearch{
+		every: max(every, 1),
+		f:     file,
+	}
+	var (
+		br  = bufio.NewReader(io.NewSectionReader(file, 0, 1<<62))
+		off int64
+	)
+	for {
+		l, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read entry %d of the sparse index: %w", s.count, err)
+		}
+		key := make([]byte, l)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return nil, fmt.Errorf("Could not read entry %d of the sparse index: %w", s.count, err)
+		}
+		s.add(key, off)
+		off += int64(uvarintLen(l)) + int64(l)
+	}
+	s.offsets = append(s.offsets, off)
+	return s, nil
+}
+
+// Add the first record of the next block, writing it to the segment file.
+func (s *SparseBinarySearch) Add(needle []byte) error {
+	if s.w == nil {
+		return fmt.Errorf("Could not add %q to the search: %w", needle, ErrFinalized)
+	}
+	s.add(needle, s.written)
+	n, err := s.w.Write(binary.AppendUvarint(nil, uint64(len(needle))))
+	s.written += int64(n)
+	if err != nil {
+		return err
+	}
+	n, err = s.w.Write(needle)
+	s.written += int64(n)
+	return err
+}
+
+// add counts in the first record of a block held at off in the segment file,
+// keeping it in memory when it begins a run.
+func (s *SparseBinarySearch) add(needle []byte, off int64) {
+	if s.count%s.every == 0 {
+		s.firsts = append(s.firsts, bytes.Clone(needle))
+		s.offsets = append(s.offsets, off)
+	}
+	s.count++
+}
+
+// Do not call this directly, but instead wormdb calls this once the database
+// has been finalized.
+func (s *SparseBinarySearch) Finalize() error {
+	if s.w == nil {
+		return nil
+	}
+	var w *bufio.Writer
+	w, s.w = s.w, nil
+	s.offsets = append(s.offsets, s.written)
+	return w.Flush()
+}
+
+// Count returns the number of entries in the index, one for each block.
+func (s *SparseBinarySearch) Count() int {
+	return s.count
+}
+
+// setOrder has the search order the entries with cmp, see [WithCompare].
+func (s *SparseBinarySearch) setOrder(cmp func(a, b []byte) int) {
+	s.order = cmp
+}
+
+// run reads the first records of the run of blocks which would hold the
+// needle, followed by the first record of the next run when there is one, and
+// returns them as an index starting at block base.  A nil index means there is
+// nothing to search.
+func (s *SparseBinarySearch) run(needle []byte) (bs *BinarySearch, base int, err error) {
+	if s.count == 0 || s.w != nil {
+		return nil, 0, nil
+	}
+	cmp := bytes.Compare
+	if s.order != nil {
+		cmp = s.order
+	}
+	g, exact := slices.BinarySearchFunc(s.firsts, needle, cmp)
+	if !exact && g > 0 {
+		g--
+	}
+
+	buf := make([]byte, s.offsets[g+1]-s.offsets[g])
+	if n, err := s.f.ReadAt(buf, s.offsets[g]); n < len(buf) {
+		if err == nil || err == io.EOF {
+			return nil, 0, fmt.Errorf("%w, run %d of the sparse index is cut short", ErrTruncated, g)
+		}
+		return nil, 0, fmt.Errorf("Could not read run %d of the sparse index: %w", g, err)
+	}
+	index := make([][]byte, 0, s.every+1)
+	for len(buf) > 0 {
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < l {
+			return nil, 0, fmt.Errorf("Run %d of the sparse index is corrupt", g)
+		}
+		index = append(index, buf[n:n+int(l):n+int(l)])
+		buf = buf[n+int(l):]
+	}
+	if g+1 < len(s.firsts) {
+		index = append(index, s.firsts[g+1])
+	}
+	return &BinarySearch{Index: index, order: s.order}, g * s.every, nil
+}
+
+// Find will search for a needle in the index and return either the match or
+// the lower bound where the match would be located between two entries, see
+// [BinarySearch.Find].
+func (s *SparseBinarySearch) Find(needle []byte) (pos int, lower []byte, exactMatch bool) {
+	pos, lower, exactMatch, _ = s.findErr(needle)
+	return
+}
+
+// FindBounds will search for a needle in the index and return either the
+// match or the lower and upper bound matches where the match would be located
+// between two entries, see [BinarySearch.FindBounds].
+func (s *SparseBinarySearch) FindBounds(needle []byte) (pos int, lower, upper []byte, exactMatch bool) {
+	pos, lower, upper, exactMatch, _ = s.findBoundsErr(needle)
+	return
+}
+
+// findErr is Find, also returning a failure to read the segment file.
+func (s *SparseBinarySearch) findErr(needle []byte) (int, []byte, bool, error) {
+	bs, base, err := s.run(needle)
+	if bs == nil {
+		return 0, nil, false, err
+	}
+	pos, lower, exactMatch := bs.Find(needle)
+	return base + pos, lower, exactMatch, nil
+}
+
+// findBoundsErr is FindBounds, also returning a failure to read the segment
+// file.
+func (s *SparseBinarySearch) findBoundsErr(needle []byte) (int, []byte, []byte, bool, error) {
+	bs, base, err := s.run(needle)
+	if bs == nil {
+		return 0, nil, nil, false, err
+	}
+	pos, lower, upper, exactMatch := bs.FindBounds(needle)
+	return base + pos, lower, upper, exactMatch, nil
+}
+
+// uvarintLen returns the number of bytes v takes as a uvarint.
+func uvarintLen(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
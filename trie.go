@@ -0,0 +1,195 @@
+package wormdb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// TrieSearch keeps the first record of each block in a radix tree, so a
+// prefix shared by neighbouring records is only held in memory once.  Keys
+// such as URLs or file paths, where consecutive blocks start with long common
+// prefixes, need far less memory than with a [BinarySearch].
+//
+// The results are the same as a [BinarySearch] over the same records.  As
+// the records are not held whole, the lower and upper bounds returned are
+// rebuilt, and so allocated, on each call.
+type TrieSearch struct {
+	root      trieNode
+	count     int
+	first     []byte
+	finalized bool
+}
+
+// trieNode is an edge of the radix tree and the key which ends there, if any.
+type trieNode struct {
+	label    []byte      // Bytes along the edge leading to this node
+	sector   int         // Sector whose first record ends at this node, or -1
+	children []*trieNode // Sorted by the first byte of their label
+}
+
+// Build a trie search index in memory for the constructed wormdb.
+func NewTrieSearch() *TrieSearch {
+	return &TrieSearch{
+		root: trieNode{sector: -1},
+	}
+}
+
+// Load a trie search from a memory 2-D byte slice, such as the Index of a
+// [BinarySearch].
+func LoadTrieSearch(index [][]byte) *TrieSearch {
+	s := NewTrieSearch()
+	for _, needle := range index {
+		s.Add(needle)
+	}
+	s.Finalize()
+	return s
+}
+
+// Add the first record of the next block into the tree.
+func (s *TrieSearch) Add(needle []byte) error {
+	if s.finalized {
+		return fmt.Errorf("Could not add %q to the search: %w", needle, ErrFinalized)
+	}
+	n := &s.root
+	for len(needle) > 0 {
+		i := sort.Search(len(n.children), func(i int) bool { return n.children[i].label[0] >= needle[0] })
+		if i == len(n.children) || n.children[i].label[0] != needle[0] {
+			// Nothing shares this edge, hang the remainder off a new leaf
+			leaf := &trieNode{label: bytes.Clone(needle), sector: -1}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = leaf
+			n = leaf
+			break
+		}
+		c := n.children[i]
+		l := 0
+		for l < len(c.label) && l < len(needle) && c.label[l] == needle[l] {
+			l++
+		}
+		if l < len(c.label) {
+			// Split the edge where the needle leaves it
+			mid := &trieNode{label: c.label[:l], sector: -1, children: []*trieNode{c}}
+			c.label = c.label[l:]
+			n.children[i] = mid
+			c = mid
+		}
+		n, needle = c, needle[l:]
+	}
+	n.sector = s.count
+	s.count++
+	return nil
+}
+
+// Do not call this directly, but instead wormdb calls this once the database
+// has been finalized.
+func (s *TrieSearch) Finalize() error {
+	s.finalized = true
+	if s.count > 0 {
+		_, s.first = s.root.min([]byte{})
+	}
+	return nil
+}
+
+// min returns the smallest key within the subtree, appended to key.
+func (n *trieNode) min(key []byte) (*trieNode, []byte) {
+	for n.sector < 0 {
+		n = n.children[0]
+		key = append(key, n.label...)
+	}
+	return n, key
+}
+
+// max returns the largest key within the subtree, appended to key.
+func (n *trieNode) max(key []byte) (*trieNode, []byte) {
+	for len(n.children) > 0 {
+		n = n.children[len(n.children)-1]
+		key = append(key, n.label...)
+	}
+	return n, key
+}
+
+// floor returns the largest key in the subtree which is at or before the
+// needle, where key is the path to n and needle the part left after it.
+func (n *trieNode) floor(key, needle []byte) (*trieNode, []byte) {
+	if len(needle) > 0 {
+		i := sort.Search(len(n.children), func(i int) bool { return n.children[i].label[0] > needle[0] })
+		if i > 0 {
+			if c := n.children[i-1]; c.label[0] == needle[0] {
+				i--
+				if bytes.HasPrefix(needle, c.label) {
+					if f, k := c.floor(append(key, c.label...), needle[len(c.label):]); f != nil {
+						return f, k
+					}
+				} else if bytes.Compare(c.label, needle) < 0 {
+					return c.max(append(key, c.label...))
+				}
+			}
+			if i > 0 {
+				c := n.children[i-1]
+				return c.max(append(key, c.label...))
+			}
+		}
+	}
+	if n.sector >= 0 {
+		return n, key
+	}
+	return nil, nil
+}
+
+// ceil returns the smallest key in the subtree which is after the needle,
+// where key is the path to n and needle the part left after it.
+func (n *trieNode) ceil(key, needle []byte) (*trieNode, []byte) {
+	i := 0
+	if len(needle) > 0 {
+		i = sort.Search(len(n.children), func(i int) bool { return n.children[i].label[0] >= needle[0] })
+		if i < len(n.children) {
+			if c := n.children[i]; c.label[0] == needle[0] {
+				if bytes.HasPrefix(needle, c.label) {
+					if f, k := c.ceil(append(key, c.label...), needle[len(c.label):]); f != nil {
+						return f, k
+					}
+					i++
+				} else if bytes.Compare(c.label, needle) < 0 {
+					i++
+				}
+			}
+		}
+	}
+	if i < len(n.children) {
+		c := n.children[i]
+		return c.min(append(key, c.label...))
+	}
+	return nil, nil
+}
+
+// Find will search for a needle in the tree and return either the match or
+// the lower bound where the match would be located between two entries, see
+// [BinarySearch.Find].
+func (s *TrieSearch) Find(needle []byte) (pos int, lower []byte, exactMatch bool) {
+	if s.count == 0 {
+		return 0, nil, false
+	}
+	if f, key := s.root.floor([]byte{}, needle); f != nil {
+		return f.sector, key, bytes.Equal(key, needle)
+	}
+	if bytes.HasPrefix(s.first, needle) {
+		return 0, s.first, true
+	}
+	return 0, nil, false
+}
+
+// FindBounds will search for a needle in the tree and return either the match
+// or the lower and upper bound matches where the match would be located
+// between two entries, see [BinarySearch.FindBounds].
+func (s *TrieSearch) FindBounds(needle []byte) (pos int, lower, upper []byte, exactMatch bool) {
+	pos, lower, exactMatch = s.Find(needle)
+	if lower == nil {
+		return 0, nil, s.first, false
+	}
+	if c, key := s.root.ceil([]byte{}, lower); c != nil {
+		upper = key
+	}
+	return pos, lower, upper, exactMatch
+}
@@ -0,0 +1,101 @@
+package wormdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Verify reads every block of a finalized wormdb and checks that it is sound,
+// such as before serving from a file written by a build which may have
+// crashed.  The checks are:
+//
+//   - each record length and re-used prefix is within the block and the
+//     record before it, and the checksum matches when blocks have one,
+//   - the padding after the last record of a block is all zeros, or the pad
+//     byte set by [WithPadByte] after the zeros which end the records,
+//   - every record sorts after the one before it, across the whole file,
+//   - the search index, when there is one, finds the first record of each
+//     block at that block.
+//
+// The error returned names the first block which failed.  Verify reads the
+// whole file, so it takes about as long as walking every record.
+func (d *DB) Verify() error {
+	if d.writeBuf != nil {
+		return fmt.Errorf("Wormdb must be finalized before verifying")
+	}
+	if !d.acquire() {
+		return fmt.Errorf("Could not verify: %w", ErrClosed)
+	}
+	defer d.releaseReader()
+	blocks, err := d.blocks()
+	if err != nil {
+		return err
+	}
+
+	var (
+		buf  = d.readpool.Get().([]byte)
+		c    = d.newCursor()
+		prev []byte
+	)
+	defer d.readpool.Put(buf)
+	for n := int64(0); n < blocks; n++ {
+		b, err := d.readBlock(buf, n)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Could not read block %d: %w", n, err)
+		}
+		c.reset(b, n)
+		for i := 0; ; i++ {
+			ok, err := c.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				if i == 0 {
+					return fmt.Errorf("Block %d holds no records", n)
+				}
+				break
+			}
+			if prev != nil && d.compare(prev, c.rec) >= 0 {
+				return fmt.Errorf("%w at block %d, %q comes after %q", ErrOutOfOrder, n, c.rec, prev)
+			}
+			prev = append(prev[:0], c.rec...)
+
+			if i == 0 && d.search != nil {
+				pos, lower, exact, err := d.find(c.rec)
+				if err != nil {
+					return fmt.Errorf("Could not find block %d in the index: %w", n, err)
+				}
+				if int64(pos) != n || !exact || !bytes.Equal(lower, c.rec) {
+					return fmt.Errorf("Index does not match block %d, first record %q found at block %d as %q", n, c.rec, pos, lower)
+				}
+			}
+		}
+		if !d.padded(b[c.pos:]) {
+			return fmt.Errorf("Block %d has data after the end of its records at %d", n, c.pos)
+		}
+	}
+	return nil
+}
+
+// padded reports whether b, the rest of a block after its last record, is all
+// zeros or is the padding written by WithPadByte.  The last block of a file is
+// only padded with zeros.
+func (d *DB) padded(b []byte) bool {
+	zeros := 0
+	for zeros < len(b) && b[zeros] == 0 {
+		zeros++
+	}
+	if zeros == len(b) {
+		return true
+	}
+	if d.pad == 0 || zeros != padEnd {
+		return false
+	}
+	for _, p := range b[zeros:] {
+		if p != d.pad {
+			return false
+		}
+	}
+	return true
+}
@@ -3,14 +3,25 @@ package wormdb
 import (
 	"bufio"
 	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Turn on debug logging
+// Turn on debug logging to the standard logger, for any wormdb without its
+// own logger set by [WithLogger].
 var Debug bool
 
 // noCopy implements sync.Locker so that go vet can trigger
@@ -22,37 +33,116 @@ func (c *noCopy) Unlock() {}
 
 type DB struct {
 	_        noCopy
-	file     *os.File
+	file     io.ReaderAt
 	offset   int64 // steps of blocksize
+	byteOff  int64 // bytes before the first block, beyond the offset
 	shift    int   // must be in shift bits
 	readpool sync.Pool
 
 	// Writing functions (only available when newly created before finalize)
 	prev          []byte
 	writeBuf      *bufio.Writer
-	written       int64
+	noSync        bool  // Skip the fsync when finalizing
+	maxSize       int64 // Limit on the bytes written, 0 for none
+	prealloc      int64 // Bytes reserved in the file before writing, 0 for none
+	written       int64 // Bytes flushed to the file
 	blocksize     int
 	blocksizeMask int64
-	block         []byte
+	block         []byte     // Block being built
+	used          int        // Bytes used in the block being built
+	recs          int        // Records in the block being built
+	nblocks       int        // Blocks begun, including the one being built
+	reserved      int        // Bytes reserved at the end of each block
+	pad           byte       // Fills each block after the end of its records
+	enc           []byte     // Scratch space for encoding a record
+	count         int64      // Number of records added, -1 when unknown
+	built         BuildStats // Counters of the blocks and records written
+	reused        int64      // Prefix bytes the records written share with the one before
+	filled        int64      // Bytes of the blocks written holding records
 
-	old  *Walker     // When merging, this field is set to the old DB.
-	comp CompareFunc // Comparison function for merging records together.
+	old     source                            // When merging, this field is set to the old DB.
+	oldHeld bool                              // The old DB has a current record yet to be merged
+	comp    CompareFunc                       // Comparison function for merging records together.
+	sources int                               // Number of sources being merged
+	trace   func(rec []byte, sourceIndex int) // Told the source of each record written
+
+	order        func(a, b []byte) int // Ordering of the records, nil for bytes.Compare
+	noOrderCheck bool                  // Trust the records to be added in order
+
+	keySep    byte // Byte splitting the key of a record from its value
+	hasKeySep bool // Records are split into a key and value at keySep
+
+	equal  func(a, b []byte) bool   // Records which are to be reduced together.
+	reduce func(a, b []byte) []byte // Reducer for records which are equal.
 
 	// Lookup buffer
-	cache  Cache
-	search Search
+	cache        Cache
+	noNegCache   bool // Lookups which found no record are not kept in the cache
+	noIndexCheck bool // Skip checking a saved index against the data file
+	search       Search
+
+	checksum bool    // Blocks end with a CRC32 of their contents
+	varint   bool    // Record and prefix lengths are stored as varints
+	large    bool    // A record too long for a block is given a block of its own
+	noPrefix bool    // Records are stored whole without sharing a prefix
+	suffix   bool    // Records also share a suffix with the record before
+	head     int     // Bytes at the start of each block for its record count
+	framing  Framing // Encoding of the records within a block
+
+	logger *slog.Logger // Debug messages, nil for the standard logger
+
+	readers atomic.Int64 // Readers holding the wormdb open, negative once shut
+	closing atomic.Bool  // Close has been called
+
+	useMmap   bool        // Map the file into memory for reading
+	readAhead int         // Blocks read at once by a walker
+	recHint   int         // Initial capacity of the record buffers
+	mmap      []byte      // Read-only mapping of the file
+	bcache    *blockCache // Blocks recently read, when enabled
+
+	bloom       *Bloom   // Filter of every record for skipping misses
+	bloomBits   int      // Bits for each record when building a bloom filter
+	bloomHashes []uint64 // Hashes of the records until the filter is built
+
+	indexes map[string]*secondary // Indexes by keys taken from the records
+
+	codec   Codec     // Compression for each block
+	offsets []int64   // Physical offset of each compressed block
+	zbuf    []byte    // Scratch space for compressing a block
+	zpool   sync.Pool // Buffers for reading compressed blocks
 }
 
 type Walker struct {
+	cursor        // Decoder for the current block
 	db     *DB    // Pointer to underlying database
 	done   bool   // Done reading.
+	hold   bool   // Return the current record on the next Scan.
+	held   bool   // The wormdb is held open for the walk.
 	atEOF  bool   // End of file hit.
-	rec    []byte // Current record handle.
-	n      int64  // Current block in database
-	b, buf []byte // Buffer for reading from file
+	n      int64  // Next block in database to read
+	buf    []byte // Buffer for reading from file
 	err    error  // Error holding from last read
+
+	start, end []byte // Optional bounds for a range walk
+	from       []byte // Start of the walk, kept for Reset
+
+	reverse bool    // Walk the records in descending order
+	rc      cursor  // Decoder for the current block when in reverse
+	stack   []byte  // Decoded records of the current block when in reverse
+	ends    []int   // End of each record within the stack
+	offs    []int64 // File offset of each record within the stack
+	off     int64   // File offset of the current record when in reverse
+
+	ahead    []byte // Blocks read at once when reading ahead
+	aheadN   int64  // First block held in ahead
+	aheadEOF bool   // The end of the file was hit filling ahead
 }
 
+// An Option sets up a wormdb when it is created or opened.  The file holds
+// only the blocks, so the options which change how they are laid out, such as
+// [WithBlockSize], [WithBlockChecksum] or [WithCompression], are not recorded
+// in it and must be given again, the same, whenever the wormdb is opened.
+// Each of those options says what goes wrong when it is not.
 type Option func(*DB)
 
 // Include an optional cache to help with speeding up repeat calls.
@@ -62,6 +152,17 @@ func WithCache(c Cache) Option {
 	}
 }
 
+// Keep the lookups which found no record in the cache, which is on by default.
+// Turning it off stops a flood of needles which are not in the wormdb from
+// pushing the records which were found out of the cache, at the cost of
+// searching for each missing needle again.  The cache must be able to delete
+// an entry, as [CacheMap] and [ShardedCacheMap] can.
+func WithNegativeCache(enabled bool) Option {
+	return func(d *DB) {
+		d.noNegCache = !enabled
+	}
+}
+
 // Include a call back for the search function to use.  The built option uses
 // the binary search to find records within the index.
 func WithSearch(s Search) Option {
@@ -78,6 +179,18 @@ func WithOffset(v int64) Option {
 	}
 }
 
+// Offset in bytes at the beginning of the file to ignore, which unlike
+// [WithOffset] can be any size, such as when the wormdb follows a header of
+// varying length in a larger file.  The blocks are then no longer aligned to
+// the pages of the file, so a block read may touch one more page than it
+// otherwise would.  The same offset must be provided when the wormdb is
+// opened.
+func WithByteOffset(v int64) Option {
+	return func(d *DB) {
+		d.byteOff = v
+	}
+}
+
 // Define a custom block size, if left unset the value of 4096 is used.
 func WithBlockSize(v int) Option {
 	return func(d *DB) {
@@ -85,49 +198,495 @@ func WithBlockSize(v int) Option {
 	}
 }
 
+// Commit the file to stable storage when the wormdb is finalized, which is on
+// by default.  Turning it off saves the wait on the disk for a wormdb which
+// can be rebuilt from its inputs, as the records are still written out to
+// the file by Finalize and Close, only without the fsync.
+func WithSync(enabled bool) Option {
+	return func(d *DB) {
+		d.noSync = !enabled
+	}
+}
+
+// Start the buffers which records are decoded into, by lookups and walkers,
+// with a capacity of n bytes rather than 256, so that large records do not
+// grow the buffers several times over on every lookup.  A hint near the size
+// of the larger records is best, as a buffer still grows to fit any record.
+func WithRecordBufferHint(n int) Option {
+	return func(d *DB) {
+		d.recHint = n
+	}
+}
+
+// Limit the size of the wormdb being built to v bytes, so that unbounded input
+// fails fast with [ErrMaxSizeExceeded] rather than filling the disk.  The
+// limit is checked as each block is written out, so the file is never grown
+// past it; the records of the block which would have passed it are dropped,
+// and the wormdb can only be closed.
+func WithMaxSize(v int64) Option {
+	return func(d *DB) {
+		d.maxSize = v
+	}
+}
+
+// Reserve v bytes of disk space for the blocks of the wormdb before any are
+// written, such as when the size of the build is known, so that the file
+// system can lay the file out in fewer pieces than when it grows a block at a
+// time.  Space is reserved with fallocate where the platform and file system
+// support it, otherwise the file is extended with truncate.  The file is cut
+// back to the blocks written once the wormdb is finalized.  This only applies
+// to a wormdb built in an [os.File] with [New].
+func WithPreallocate(v int64) Option {
+	return func(d *DB) {
+		d.prealloc = v
+	}
+}
+
+// Fill the unused space at the end of each block with b rather than zeros, so
+// recovery tools can tell where the records of a damaged block end.  The
+// records are still ended by two zero bytes, which are left in front of the
+// padding, so reading the wormdb does not need this option; only [DB.Verify]
+// does, to check the padding.  A custom [Framing] must therefore end the
+// records on two zero bytes, unless [WithRecordCount] is used.
+func WithPadByte(b byte) Option {
+	return func(d *DB) {
+		d.pad = b
+	}
+}
+
+// padEnd is the number of zero bytes kept after the last record of a block
+// before any padding set by WithPadByte, as two zeros end the records.
+const padEnd = 2
+
+// Reserve the last 4 bytes of each block for a CRC32 of the block contents,
+// which is verified every time the block is read back from disk to catch
+// silent corruption.  It must be given again when opening, see [Option]:
+// without it the checksums go unchecked and are read as though they were
+// records, and with it a wormdb built without checksums fails on every block.
+func WithBlockChecksum() Option {
+	return func(d *DB) {
+		d.checksum = true
+		d.reserved = 4
+	}
+}
+
+// Store the record and prefix lengths as varints rather than single bytes, so
+// records longer than 255 bytes can be held.  Records must still fit within a
+// single block, unless [WithLargeRecords] is used.  It must be given again when
+// opening, see [Option].  As lengths under 128 are stored the same either way,
+// a wormdb opened with the wrong setting can read correctly up to the first
+// longer record or prefix, which is then misread.
+func WithVarint() Option {
+	return func(d *DB) {
+		d.varint = true
+	}
+}
+
+// Allow records too long to fit in a block, such as for the occasional large
+// value.  Such a record is written alone in a block of its own, which runs on
+// for as long as the record needs, and the records after it begin a new block.
+// The block holds a single entry in the search index like any other, so
+// lookups and walks read the whole record back in one piece.
+//
+// As the blocks are then no longer all the same size, they are packed one
+// after another with a length header as with [WithCompression], and the same
+// table of block offsets is kept.  Lengths over 255 bytes also need
+// [WithVarint].  It must be given again when opening, see [Option], as without
+// it the packed blocks are read as fixed size blocks and misread.
+func WithLargeRecords() Option {
+	return func(d *DB) {
+		d.large = true
+	}
+}
+
+// Turn prefix compression of the records on or off, it is on by default.  With
+// it off, each record is stored whole behind its length, which saves the work
+// of finding the shared prefix and a byte per record when the records have
+// little in common, such as hashes.  It must be given again when opening, see
+// [Option], as otherwise the length of each record is read as the prefix it
+// shares, or the other way around, and the records are misread.
+func WithPrefixCompression(enabled bool) Option {
+	return func(d *DB) {
+		d.noPrefix = !enabled
+	}
+}
+
+// Share the trailing bytes of a record with the record before it as well as
+// the leading bytes, so only the differing middle of a record is stored.  This
+// suits records such as reversed host names, where neighbours often end alike.
+// Each record costs one more length in its header, so the records need to
+// share some of their ending for this to pay off.  It must be given again when
+// opening, see [Option], as otherwise the extra length is read as part of the
+// record, or looked for where there is none, and decoding fails.
+func WithSuffixCompression() Option {
+	return func(d *DB) {
+		d.suffix = true
+	}
+}
+
+// UNSAFE: skip checking that each record added sorts after the one before it,
+// trusting the caller to add them in order, such as the output of sort(1) for
+// a build of billions of records where the comparison is measurable.  A
+// record added out of order, or twice, is NOT caught and silently corrupts the
+// wormdb: lookups and walks will miss records or return the wrong ones, and
+// nothing reports it short of [DB.Verify].  Only use this for input which has
+// already been checked to be sorted and free of duplicates.
+func WithUnsafeNoOrderCheck() Option {
+	return func(d *DB) {
+		d.noOrderCheck = true
+	}
+}
+
+// Order the records with cmp instead of [bytes.Compare], such as to sort them
+// without regard to case.  Records must be added in the order given by cmp,
+// and the search is handed cmp so that it finds blocks in the same order.  The
+// first-byte buckets of a [BinarySearch] and the estimates of an
+// [InterpolationSearch] rely on byte order and are not used with cmp, and a
+// [TrieSearch] can not be used at all.
+//
+// Lookups still match needles as a prefix of the bytes of a record, so cmp
+// must keep the records which share a prefix next to each other, and a record
+// must sort before any record it is a prefix of, which [DB.Add] returns
+// [ErrOutOfOrder] for.  It must be given again when opening, see [Option], as
+// the search finds the block to read with cmp, and without it lookups read the
+// wrong blocks and miss records.
+func WithCompare(cmp func(a, b []byte) int) Option {
+	return func(d *DB) {
+		d.order = cmp
+	}
+}
+
+// Begin each block with a count of the records it holds, instead of ending the
+// records with a zero length.  This costs 4 bytes a block and allows an empty
+// record to be stored, which then sorts ahead of every other record.  It must
+// be given again when opening, see [Option]: without it the leading zero of
+// each count reads as the end of the records, so the wormdb silently looks
+// empty, and with it a wormdb built without counts is misread.
+func WithRecordCount() Option {
+	return func(d *DB) {
+		d.head = blockHeadSize
+	}
+}
+
+// Size of the record count at the start of a block, see [WithRecordCount].
+const blockHeadSize = 4
+
+// Send the debug messages of the wormdb to l at debug level, in place of the
+// standard logger and the global [Debug] switch.  Use [slog.Logger.With] to
+// tell apart the messages of each wormdb in a server holding many.
+func WithLogger(l *slog.Logger) Option {
+	return func(d *DB) {
+		d.logger = l
+	}
+}
+
+// debugging reports whether debug messages are to be logged, so callers can
+// skip building them when not.
+func (d *DB) debugging() bool {
+	if d.logger != nil {
+		return d.logger.Enabled(context.Background(), slog.LevelDebug)
+	}
+	return Debug
+}
+
+// debugf logs a debug message to the logger of the wormdb, or to the standard
+// logger when there is none.
+func (d *DB) debugf(format string, args ...any) {
+	if d.logger != nil {
+		d.logger.Debug(fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Map the file read-only into memory so reads slice directly into the mapping
+// rather than copying each block out of the file with ReadAt.  This is only
+// possible when the wormdb is backed by an os.File; if the mapping cannot be
+// made the reads fall back to ReadAt.  A wormdb being built is mapped once it
+// has been finalized.
+func WithMmap() Option {
+	return func(d *DB) {
+		d.useMmap = true
+	}
+}
+
+// mapFile maps the backing file into memory when requested with WithMmap.
+func (d *DB) mapFile() {
+	if !d.useMmap || d.mmap != nil {
+		return
+	}
+	f, ok := d.file.(*os.File)
+	if !ok {
+		return
+	}
+	size, err := d.size()
+	if err != nil || size == 0 {
+		return
+	}
+	m, err := mmap(f, size)
+	if err != nil {
+		if d.debugging() {
+			d.debugf("Falling back to ReadAt as mmap failed: %v", err)
+		}
+		return
+	}
+	d.mmap = m
+}
+
+// preallocate reserves the space requested with WithPreallocate, falling back
+// to extending the file when fallocate is not available.  The space is only a
+// hint, so a failure is not an error.
+func (d *DB) preallocate() {
+	f, ok := d.file.(*os.File)
+	if !ok || d.prealloc <= 0 {
+		return
+	}
+	err := fallocate(f, d.base(), d.prealloc)
+	if err == nil {
+		return
+	}
+	if d.debugging() {
+		d.debugf("Falling back to truncate as fallocate failed: %v", err)
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() < d.base()+d.prealloc {
+		if err := f.Truncate(d.base() + d.prealloc); err != nil && d.debugging() {
+			d.debugf("Could not preallocate %d bytes: %v", d.prealloc, err)
+		}
+	}
+}
+
+// base returns the position in the file of the first block.
+func (d *DB) base() int64 {
+	return d.offset<<d.shift + d.byteOff
+}
+
+// compare orders two records the way the wormdb is sorted.
+func (d *DB) compare(a, b []byte) int {
+	if d.order != nil {
+		return d.order(a, b)
+	}
+	return bytes.Compare(a, b)
+}
+
+// castagnoli is used for the block checksums as it is hardware accelerated
+// on most platforms.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 // Compare returns an integer comparing two byte slices lexicographically. The
 // result will be 0 if a == b, -1 if a < b, and +1 if a > b. A nil argument is
 // equivalent to an empty slice.
 //
 // Record removal is also possible, if -2 is provided then only `a` will be
-// used and if +2 is provided then only `b` will be used.
+// used and if +2 is provided then only `b` will be used.  The results are
+// named by the constants [TakeAOnly] through [TakeBOnly].
 //
 // This is mainly used with the WithMerge function. Note that the previous
 // merged-to database will always be `a` and the incoming data will be `b`.
 type CompareFunc func(a, b []byte) int
 
-// Build from a previous wormDB and merge the records.
+// Results of a [CompareFunc].
+const (
+	TakeAOnly = -2 // Only the existing record `a` is kept, `b` is dropped
+	AFirst    = -1 // The existing record `a` sorts first
+	Equal     = 0  // The records are equal, and `a` is written first
+	BFirst    = 1  // The incoming record `b` sorts first
+	TakeBOnly = 2  // Only the incoming record `b` is kept, `a` is dropped
+)
+
+// PreferIncoming is a [CompareFunc] ordering the records with [bytes.Compare]
+// which, when a record is in both, keeps only the incoming one.
+func PreferIncoming(a, b []byte) int {
+	if c := bytes.Compare(a, b); c != 0 {
+		return c
+	}
+	return TakeBOnly
+}
+
+// PreferExisting is a [CompareFunc] ordering the records with [bytes.Compare]
+// which, when a record is in both, keeps only the existing one.
+func PreferExisting(a, b []byte) int {
+	if c := bytes.Compare(a, b); c != 0 {
+		return c
+	}
+	return TakeAOnly
+}
+
+// Build from a previous wormDB and merge the records.  Should the previous
+// wormdb hold records out of order, [DB.Add] or [DB.Finalize] returns
+// [ErrMergeOrder] rather than writing them.
 func WithMerge(old *DB, comp CompareFunc) Option {
 	return func(d *DB) {
 		d.old = old.NewWalker()
 		d.comp = comp
+		d.sources = 1
+	}
+}
+
+// Build from a previous wormDB and merge the records, collapsing any record
+// which is considered equal to an incoming record into the one record returned
+// by reduce.  As with [WithMerge], the previous record is `a` and the incoming
+// record is `b`, so returning `b` gives last-write-wins.  Records are otherwise
+// ordered by [bytes.Compare], and the reduced record must sort between its
+// neighbors just as the originals did.
+func WithMergeReduce(old *DB, equal func(a, b []byte) bool, reduce func(a, b []byte) []byte) Option {
+	return func(d *DB) {
+		d.old = old.NewWalker()
+		d.comp = bytes.Compare
+		d.sources = 1
+		d.equal = equal
+		d.reduce = reduce
+	}
+}
+
+// Build from a previous wormDB, keeping only the records for which keep
+// returns true, such as to drop expired keys while compacting.  Any records
+// added are merged in as with [WithMerge] and are not filtered.
+func WithFilter(old *DB, keep func(rec []byte) bool) Option {
+	return func(d *DB) {
+		d.old = &filter{source: old.NewWalker(), keep: keep}
+		d.comp = bytes.Compare
+		d.sources = 1
+	}
+}
+
+// Build from several previous wormDBs and merge the records in a single pass.
+// The sources are ordered from oldest to newest, so when comp is called the
+// record from the older source is always `a`, and any records added are newer
+// than all of the sources.  The result matches merging the sources in one at a
+// time with [WithMerge], including the -2 and +2 removal semantics.
+func WithMergeN(sources []*DB, comp CompareFunc) Option {
+	return func(d *DB) {
+		m := &merger{comp: comp}
+		for i, s := range sources {
+			m.items = append(m.items, mergeItem{w: s.NewWalker(), i: i})
+		}
+		d.old = m
+		d.comp = comp
+		d.sources = len(sources)
+	}
+}
+
+// Call fn with each record as it is written while merging, along with the
+// index of the source it came from, such as for an audit log of which source
+// each record survived from.  The sources are numbered as they are given to
+// [WithMergeN], or 0 for the old wormdb of [WithMerge], and the records passed
+// to Add are numbered one past the last source.  A record made by the reduce
+// of [WithMergeReduce] is numbered as one passed to Add.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func WithMergeTrace(fn func(rec []byte, sourceIndex int)) Option {
+	return func(d *DB) {
+		d.trace = fn
 	}
 }
 
+// Result is a cached lookup, which is ready once c has been closed.
 type Result struct {
-	c   chan struct{}
-	dat []byte
+	c      chan struct{}
+	dat    []byte
+	sector int // Block the record was found in
+	err    error
+
+	elm     *list.Element // Place in the eviction list once stored
+	stored  time.Time     // When the entry was stored
+	refs    int           // Lookups still reading the entry
+	evicted bool          // Removed from the cache, to be recycled once unused
+}
+
+// ReaderWriterAt is the backing store needed to build a wormdb.
+type ReaderWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
 }
 
 // Create a WORM db using the os.File handle to write a Write-Once-Read-Many
 // ordered database optimized for reading based on sectors.
 func New(file *os.File, options ...Option) (*DB, error) {
-	db, err := Open(file, options...)
+	return NewReaderWriterAt(file, options...)
+}
+
+// Create a WORM db on any backing store which can be read and written at an
+// offset, such as an in-memory buffer.  If the store implements Sync() error
+// it is called when the wormdb is finalized, unless turned off with
+// [WithSync], and if it implements io.Closer it is closed with the wormdb.
+func NewReaderWriterAt(rw ReaderWriterAt, options ...Option) (*DB, error) {
+	db, err := open(rw, options...)
 	if err != nil {
 		return db, err
 	}
 
-	db.writeBuf = bufio.NewWriterSize(file, int(db.blocksize*8))
+	// Only a wormdb being built needs the write side buffers
+	w := io.NewOffsetWriter(rw, db.base())
+	db.writeBuf = bufio.NewWriterSize(w, int(db.blocksize*8))
+	db.block = make([]byte, db.blocksize)
+	db.prev = make([]byte, 0, db.recHint)
+	db.count = 0
+	db.preallocate()
 
 	return db, nil
 }
 
 // Open a wormdb for use, note that the index must be provided out of band.
 func Open(file *os.File, options ...Option) (*DB, error) {
+	return OpenReaderAt(file, options...)
+}
+
+// Open a wormdb for use from any backing store which can be read at an offset.
+// If the store implements io.Closer it is closed with the wormdb.  Note that
+// the index must be provided out of band.
+func OpenReaderAt(r io.ReaderAt, options ...Option) (*DB, error) {
+	db, err := open(r, options...)
+	if err != nil {
+		return db, err
+	}
+	if err := db.checkIndex(); err != nil {
+		return nil, err
+	}
+	db.mapFile()
+	if db.codec != nil {
+		if err := db.loadOffsets(); err != nil {
+			return nil, err
+		}
+	}
+	if len(db.indexes) > 0 {
+		if err := db.buildIndexes(); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// Open a wormdb held in a file system, such as one embedded with go:embed.
+// The file is read from in place when it can be read at an offset, as the
+// files of an embed.FS and [os.DirFS] can, otherwise it is read into memory
+// whole.  The index must be provided out of band.
+func OpenFS(fsys fs.FS, name string, options ...Option) (*DB, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := f.(io.ReaderAt); ok {
+		db, err := OpenReaderAt(r, options...)
+		if err != nil {
+			f.Close()
+		}
+		return db, err
+	}
+	dat, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %q: %w", name, err)
+	}
+	return OpenReaderAt(bytes.NewReader(dat), options...)
+}
+
+// open applies the options and prepares the wormdb for reading.
+func open(r io.ReaderAt, options ...Option) (*DB, error) {
 	db := &DB{
-		file:      file,
+		file:      r,
 		blocksize: 4096,
-		prev:      make([]byte, 0, 256),
+		count:     -1,
 	}
 	for _, o := range options {
 		o(db)
@@ -138,6 +697,31 @@ func Open(file *os.File, options ...Option) (*DB, error) {
 		return nil, fmt.Errorf("Search method must be defined")
 	}
 
+	if db.recHint <= 0 {
+		db.recHint = 256
+	}
+	if db.hasKeySep && db.order == nil {
+		db.order = db.compareKeys
+	}
+	if db.order != nil {
+		s, ok := db.search.(interface{ setOrder(func(a, b []byte) int) })
+		if !ok {
+			return nil, fmt.Errorf("Search method %T can not use a custom comparison", db.search)
+		}
+		s.setOrder(db.order)
+	}
+
+	if db.suffix && db.noPrefix {
+		return nil, fmt.Errorf("Suffix compression needs prefix compression")
+	}
+	if db.large && db.codec == nil {
+		// The blocks are not all the same size, so they are packed
+		db.codec = storeCodec{}
+	}
+	if db.framing == nil {
+		db.framing = &byteFraming{varint: db.varint, noPrefix: db.noPrefix, suffix: db.suffix, counted: db.head > 0}
+	}
+
 	// Make sure the blocksize is a power of 2
 	if db.blocksize < 256 || db.blocksize&(db.blocksize-1) != 0 {
 		return nil, fmt.Errorf("Invalid block size %d.", db.blocksize)
@@ -148,124 +732,723 @@ func Open(file *os.File, options ...Option) (*DB, error) {
 		return nil, fmt.Errorf("Offset %d must be a step of block size %d.", db.offset, db.blocksize)
 	}
 	db.offset = int64(db.offset / int64(db.blocksize))
+	if db.byteOff < 0 {
+		return nil, fmt.Errorf("Byte offset %d must not be negative.", db.byteOff)
+	}
 
 	shift := 0
 	for ; 1<<shift < db.blocksize; shift++ {
 	}
 	db.shift = shift
 	db.blocksizeMask = int64(db.blocksize) - 1
-	db.block = make([]byte, db.blocksize)
 	db.readpool = sync.Pool{New: func() interface{} { return make([]byte, db.blocksize) }}
+	db.zpool = sync.Pool{New: func() interface{} { return make([]byte, db.blocksize) }}
 
 	return db, nil
 }
 
 // Search for a record in a wormdb and call func if a match is found.  Only the
 // first matching prefix will be returned, so larger matches will be ignored.
+// To retrieve every match use [DB.GetAll].
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) Get(needle []byte, handler func([]byte) error) error {
+	return d.GetWithSector(needle, func(rec []byte, _ int) error { return handler(rec) })
+}
+
+// GetExact is [DB.Get], only calling handler when the record found equals key
+// rather than merely beginning with it, as suits a strict key lookup.  With
+// [WithKeySeparator] it is the key of the record which must equal key.  As the
+// records are sorted, a record equal to key is always the first one which has
+// key as a prefix, so this costs no more than Get.  With a bloom filter, see
+// [WithBloom], a key which is not in the wormdb is mostly ruled out without a
+// read.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) GetExact(key []byte, handler func([]byte) error) error {
+	if d.bloom != nil && !d.bloom.Has(key) {
+		// The key is certainly not in the wormdb
+		return nil
+	}
+	return d.Get(key, func(rec []byte) error {
+		if !bytes.Equal(d.key(rec), key) {
+			return nil
+		}
+		return handler(rec)
+	})
+}
+
+// GetWithSector is [DB.Get], with the handler also given the number of the
+// block which the record was found in, such as for finding which blocks are
+// read the most.  The record may have come from the search index or the cache
+// rather than a read of the block.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) GetWithSector(needle []byte, handler func(rec []byte, sector int) error) error {
+	_, err := d.getSource(needle, handler)
+	return err
+}
+
+// Source says where the answer to a [DB.GetSource] came from.
+type Source int
+
+const (
+	SourceMiss       Source = iota // No record matched, found without the cache
+	SourceCache                    // The cache held the record, or that there was none
+	SourceIndexExact               // The record is the first of its block, held in the search index
+	SourceDisk                     // The record was read from its block
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceMiss:
+		return "miss"
+	case SourceCache:
+		return "cache"
+	case SourceIndexExact:
+		return "index"
+	case SourceDisk:
+		return "disk"
+	}
+	return fmt.Sprintf("Source(%d)", int(s))
+}
+
+// GetSource is [DB.Get], also returning where the answer came from, such as for
+// measuring how often the cache is hit.
 //
 // The slice MUST be copied to a local variable as the underlying byte slice
 // will be reused in future function calls.
-func (d DB) Get(needle []byte, handler func([]byte) error) error {
+func (d *DB) GetSource(needle []byte, handler func(rec []byte) error) (Source, error) {
+	return d.getSource(needle, func(rec []byte, _ int) error { return handler(rec) })
+}
+
+// getSource looks up the needle for the Get functions, returning where the
+// answer came from.
+func (d *DB) getSource(needle []byte, handler func(rec []byte, sector int) error) (Source, error) {
+	var l lookup
+	defer d.release(&l)
+	if err := d.lookup(needle, &l); err != nil || l.rec == nil {
+		return l.src, err
+	}
+	return l.src, stopped(handler(l.rec, l.sector))
+}
+
+// stopped returns the error from a handler, where [ErrStopIteration] is a
+// clean stop and so is no error.
+func stopped(err error) error {
+	if err == ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+// GetBuf is [DB.Get] without the handler, returning the record itself.  A nil
+// record means there was no match.
+//
+// THE RECORD IS ONLY VALID UNTIL RELEASE IS CALLED.  It may point into a
+// pooled read buffer, the cache or the search index, which are reused or
+// recycled once released, so the record must not be modified, nor used or
+// kept after release.  Release must be called exactly once, even when there
+// is no match or an error, or the buffers leak out of their pools.  Use
+// [DB.Get] unless copying the record is too costly.
+func (d *DB) GetBuf(needle []byte) (rec []byte, release func(), err error) {
+	l := new(lookup)
+	err = d.lookup(needle, l)
+	return l.rec, func() { d.release(l) }, err
+}
+
+// lookup holds the answer to a Get, and the buffers it lives in until it is
+// released.
+type lookup struct {
+	rec    []byte
+	sector int
+	src    Source
+	buf    []byte  // Pooled read buffer
+	key    string  // Cache key of held
+	held   *Result // Cache entry which rec lives in
+
+	acquired bool // The wormdb is held open for the lookup
+}
+
+// lookup finds the first record with needle as a prefix into l, by way of the
+// cache when there is one.
+func (d *DB) lookup(needle []byte, l *lookup) error {
+	if !d.acquire() {
+		return fmt.Errorf("Could not look up %q: %w", needle, ErrClosed)
+	}
+	l.acquired = true
 	if d.search == nil {
 		return fmt.Errorf("No search method defined for finding %q", needle)
 	}
 	var hasRec *Result
 	// Do the cache check first to avoid walking or searching if a cache already exists
 	if d.cache != nil {
-		if Debug {
-			log.Printf("Querying cache for %q", needle)
+		if d.debugging() {
+			d.debugf("Querying cache for %q", needle)
 		}
 		var ok bool
-		hasRec, ok = d.cache.GetOrCompute(string(needle), func() *Result { return &Result{c: make(chan (struct{}))} })
+		l.key = string(needle)
+		hasRec, ok = d.cache.GetOrCompute(l.key, func() *Result { return &Result{c: make(chan (struct{}))} })
 		if ok {
-			if Debug {
-				log.Printf("Using cache for %q", needle)
+			if d.debugging() {
+				d.debugf("Using cache for %q", needle)
 			}
-			if len(hasRec.dat) == 0 {
-				<-hasRec.c // Ensure the record is ready for use (channel is closed)
+			l.held, l.src = hasRec, SourceCache
+			<-hasRec.c // Ensure the record is ready for use (channel is closed)
+			if hasRec.err != nil {
+				return hasRec.err
 			}
-			if len(hasRec.dat) > 0 {
+			if hasRec.dat != nil {
 				// A record has been found!
-				return handler(hasRec.dat)
+				l.rec, l.sector = hasRec.dat, hasRec.sector
+				return nil
 			}
 			// Buffered a failed to find entry record
-			if Debug {
-				log.Printf("No record cache for %q", needle)
+			if d.debugging() {
+				d.debugf("No record cache for %q", needle)
 			}
 			return nil
 		}
-		defer close(hasRec.c)
-		if Debug {
-			log.Printf("Making cache for %q", needle)
-		}
-	}
-
-	// Do the semi expensive search to find the sector on disk where the record should be located.
-	n, first, matched := d.search.Find(needle)
-	if matched {
-		return handler(first)
-	}
-	if len(first) == 0 {
-		// An error happened, first in index was not found. Do not continue.
-		return nil
-	}
-
-	// Do the expensive part and read the sector from the disk where the record should be located.
-	var b []byte
-	{
-		// Pull a buffer from the pool to read to
-		buf := d.readpool.Get().([]byte)
-		defer d.readpool.Put(buf)
-
-		// Read the sector from disk where the record should be at
-		rn, err := d.file.ReadAt(buf, (int64(n)+d.offset)<<d.shift)
-		if err != nil && err != io.EOF {
-			return err
+		if d.debugging() {
+			d.debugf("Making cache for %q", needle)
 		}
-
-		// Trim down the result, this should only happen at the end of the file.
-		b = buf[0:rn]
 	}
 
-	rec := make([]byte, 0, 256)
+	l.buf = d.readpool.Get().([]byte)
+	rec, sector, src, err := d.get(needle, l.buf)
 
-	for len(b) > 0 && b[0] > 0 {
-		// The first in a sector contains the record length
-		if len(b) <= int(b[0]) {
-			return fmt.Errorf("Record too short at block %d", n)
+	if hasRec != nil {
+		if d.debugging() {
+			d.debugf("Storing cache for %q", needle)
 		}
-		rec = append(rec, b[1:int(b[0])+1]...)
-
-		// Test if match is found
-		if bytes.HasPrefix(rec, needle) {
-			if hasRec != nil {
-				if Debug {
-					log.Printf("Storing cache for %q", needle)
-				}
-				// Create a copy in memory to store value
-				tmp := make([]byte, len(rec))
-				copy(tmp, rec)
-				hasRec.dat = tmp
-
-				d.cache.Stored(b2s(tmp[:len(needle)]))
-			}
-			return handler(rec)
+		if rec != nil {
+			// Create a copy in memory to store value
+			hasRec.dat = bytes.Clone(rec)
+			hasRec.sector = sector
 		}
-		// Trim off the record from the block
-		b = b[b[0]+1:]
-		if len(b) == 0 {
-			return nil
+		hasRec.err = err
+		close(hasRec.c)
+		if c, ok := d.cache.(interface{ Delete(string) }); ok && rec == nil && err == nil && d.noNegCache {
+			// Keep the cache for the records which were found
+			c.Delete(l.key)
+		} else {
+			d.cache.Stored(l.key)
 		}
+	}
 
-		// Determine the re-used portion of the record
-		if len(rec) < int(b[0]) {
-			return fmt.Errorf("Record prefix size too big at block %d", n)
-		}
-		rec = rec[:b[0]]
-		b = b[1:]
-		//return nil, nil
+	l.src = src
+	if err == nil && rec != nil {
+		l.rec, l.sector = rec, sector
 	}
-	return nil
+	return err
+}
+
+// release hands back the buffers of a finished lookup.
+func (d *DB) release(l *lookup) {
+	if l.buf != nil {
+		d.readpool.Put(l.buf)
+	}
+	if l.held != nil {
+		if r, ok := d.cache.(interface{ Release(string, *Result) }); ok {
+			// Let the cache recycle the entry once done with it
+			r.Release(l.key, l.held)
+		}
+	}
+	if l.acquired {
+		d.releaseReader()
+	}
+	*l = lookup{}
+}
+
+// find looks needle up in the search index, see [Search.Find], also returning
+// the failure of a search which reads its index as it goes.
+func (d *DB) find(needle []byte) (int, []byte, bool, error) {
+	if s, ok := d.search.(interface {
+		findErr([]byte) (int, []byte, bool, error)
+	}); ok {
+		return s.findErr(needle)
+	}
+	n, lower, exact := d.search.Find(needle)
+	return n, lower, exact, nil
+}
+
+// findBounds is find for [Search.FindBounds].
+func (d *DB) findBounds(needle []byte) (int, []byte, []byte, bool, error) {
+	if s, ok := d.search.(interface {
+		findBoundsErr([]byte) (int, []byte, []byte, bool, error)
+	}); ok {
+		return s.findBoundsErr(needle)
+	}
+	n, lower, upper, exact := d.search.FindBounds(needle)
+	return n, lower, upper, exact, nil
+}
+
+// get finds the first record with needle as a prefix, which is either in buf
+// or the index, and the sector holding it.  A nil record means there was no
+// match.
+func (d *DB) get(needle, buf []byte) ([]byte, int, Source, error) {
+	// Do the semi expensive search to find the sector on disk where the record should be located.
+	n, first, matched, err := d.find(needle)
+	if err != nil {
+		return nil, 0, SourceMiss, err
+	}
+	if matched {
+		return first, n, SourceIndexExact, nil
+	}
+	if first == nil {
+		// An error happened, first in index was not found. Do not continue.
+		return nil, 0, SourceMiss, nil
+	}
+
+	// Do the expensive part and read the sector from the disk where the record should be located.
+	b, err := d.readSector(buf, int64(n))
+	if err != nil {
+		return nil, 0, SourceDisk, err
+	}
+
+	c := d.newCursor()
+	c.reset(b, int64(n))
+	for {
+		ok, err := c.next()
+		if err != nil {
+			return nil, 0, SourceDisk, err
+		}
+		if !ok {
+			return nil, 0, SourceMiss, nil
+		}
+
+		// Test if match is found
+		if bytes.HasPrefix(c.rec, needle) {
+			return c.rec, n, SourceDisk, nil
+		}
+	}
+}
+
+// Find returns a copy of the first record which has qry as a prefix, like
+// [DB.Get], or nil when there is none.  The cache is not used.
+//
+// As a miss is also a nil record, an empty record stored with
+// [WithRecordCount] cannot be told apart from a miss, and [DB.Lookup] should
+// be used instead.
+func (d *DB) Find(qry []byte) ([]byte, error) {
+	rec, _, _, err := d.FindWithPos(qry)
+	return rec, err
+}
+
+// Lookup is [DB.Find], also reporting whether a record was found, so that a
+// miss is not mistaken for an empty record.  This is the preferred way to
+// find a single record.
+func (d *DB) Lookup(qry []byte) (rec []byte, found bool, err error) {
+	rec, block, _, err := d.FindWithPos(qry)
+	if err != nil || block < 0 {
+		return nil, false, err
+	}
+	if rec == nil {
+		rec = []byte{}
+	}
+	return rec, true, nil
+}
+
+// FindWithPos is [DB.Find], also returning where the record is stored, as the
+// block holding it and the position of its header within the block, the same
+// position [Walker.Offset] gives within the block.  The block and position are
+// -1 when there is no match.
+func (d *DB) FindWithPos(qry []byte) (rec []byte, block int, intra int, err error) {
+	if !d.acquire() {
+		return nil, -1, -1, fmt.Errorf("Could not look up %q: %w", qry, ErrClosed)
+	}
+	defer d.releaseReader()
+	if d.search == nil {
+		return nil, -1, -1, fmt.Errorf("No search method defined for finding %q", qry)
+	}
+	n, first, matched, err := d.find(qry)
+	if err != nil {
+		return nil, -1, -1, err
+	}
+	if matched {
+		// The first record of a block follows the record count, if any
+		return bytes.Clone(first), n, d.head, nil
+	}
+	if first == nil {
+		return nil, -1, -1, nil
+	}
+
+	buf := d.readpool.Get().([]byte)
+	defer d.readpool.Put(buf)
+	b, err := d.readSector(buf, int64(n))
+	if err != nil {
+		return nil, -1, -1, err
+	}
+	c := d.newCursor()
+	c.reset(b, int64(n))
+	for {
+		ok, err := c.next()
+		if !ok {
+			return nil, -1, -1, err
+		}
+		if bytes.HasPrefix(c.rec, qry) {
+			return bytes.Clone(c.rec), n, c.pos, nil
+		}
+	}
+}
+
+// FindNearest returns the record equal to needle, or when there is none the
+// greatest record which sorts before it, such as for suggesting the closest
+// key.  When needle sorts before every record the first record is returned
+// instead, and a nil record means the wormdb is empty.  The exact result
+// reports whether the record equals needle.  The record returned is a copy.
+func (d *DB) FindNearest(needle []byte) (rec []byte, exact bool, err error) {
+	if !d.acquire() {
+		return nil, false, fmt.Errorf("Could not look up %q: %w", needle, ErrClosed)
+	}
+	defer d.releaseReader()
+	if d.search == nil {
+		return nil, false, fmt.Errorf("No search method defined for finding %q", needle)
+	}
+	n, lower, upper, _, err := d.findBounds(needle)
+	if err != nil {
+		return nil, false, err
+	}
+	if lower == nil {
+		// Before the first record, so the first record is the nearest
+		return bytes.Clone(upper), false, nil
+	}
+
+	buf := d.readpool.Get().([]byte)
+	defer d.readpool.Put(buf)
+	b, err := d.readSector(buf, int64(n))
+	if err != nil {
+		return nil, false, err
+	}
+	c := d.newCursor()
+	c.reset(b, int64(n))
+	for {
+		ok, err := c.next()
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			break
+		}
+		cmp := d.compare(c.rec, needle)
+		if cmp > 0 && rec != nil {
+			break
+		}
+		// Hold on to the first record in case none come before the needle
+		rec, exact = append(rec[:0], c.rec...), cmp == 0
+		if cmp >= 0 {
+			break
+		}
+	}
+	return rec, exact, nil
+}
+
+// Bounds returns the first records of the block which could hold needle and
+// of the block after it, which bound the records that block holds.  A nil
+// lower means the needle comes before every record in the wormdb, and a nil
+// upper means the needle falls in the last block.  No data is read from disk.
+func (d *DB) Bounds(needle []byte) (lower, upper []byte, err error) {
+	if !d.acquire() {
+		return nil, nil, fmt.Errorf("Could not look up %q: %w", needle, ErrClosed)
+	}
+	defer d.releaseReader()
+	if d.search == nil {
+		return nil, nil, fmt.Errorf("No search method defined for finding %q", needle)
+	}
+	_, lower, upper, _, err = d.findBounds(needle)
+	return lower, upper, err
+}
+
+// GetBatch looks up many needles at once and calls handler with each needle
+// and the first record which has it as a prefix, like [DB.Get].  Needles with
+// no match are skipped.  The needles must be sorted in ascending order, which
+// lets every sector be read only once no matter how many needles land in it;
+// unsorted needles are an error.  The cache is not used.  The handler may
+// return [ErrStopIteration] to stop the lookups without an error.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) GetBatch(needles [][]byte, handler func(needle, rec []byte) error) error {
+	if !d.acquire() {
+		return fmt.Errorf("Could not look up a batch: %w", ErrClosed)
+	}
+	defer d.releaseReader()
+	if d.search == nil {
+		return fmt.Errorf("No search method defined for finding a batch")
+	}
+	buf := d.readpool.Get().([]byte)
+	defer d.readpool.Put(buf)
+
+	var (
+		c      = d.newCursor()
+		sector = -1
+		have   bool // The cursor holds a record not yet passed over
+		done   bool // The cursor is at the end of the block
+	)
+	for i, needle := range needles {
+		if i > 0 && d.compare(needles[i-1], needle) > 0 {
+			return fmt.Errorf("%w, batch needle %q comes after %q", ErrOutOfOrder, needle, needles[i-1])
+		}
+		n, first, matched, err := d.find(needle)
+		if err != nil {
+			return err
+		}
+		if matched {
+			if err := handler(needle, first); err != nil {
+				return stopped(err)
+			}
+			continue
+		}
+		if first == nil {
+			// The needle comes before the first record in the index.
+			continue
+		}
+
+		if n != sector {
+			b, err := d.readSector(buf, int64(n))
+			if err != nil {
+				return err
+			}
+			c.reset(b, int64(n))
+			sector, have, done = n, false, false
+		}
+
+		// The records are sorted, so the first record with the prefix is the
+		// first one at or after the needle.
+		for !done && (!have || d.compare(c.rec, needle) < 0) {
+			ok, err := c.next()
+			if err != nil {
+				return err
+			}
+			have, done = ok, !ok
+		}
+		if have && bytes.HasPrefix(c.rec, needle) {
+			if err := handler(needle, c.rec); err != nil {
+				return stopped(err)
+			}
+		}
+	}
+	return nil
+}
+
+// GetAll calls handler for every record which has needle as a prefix, in
+// order.  Unlike [DB.Get], the walk continues past the first match and into the
+// following sectors for as long as the records still share the prefix.  If the
+// handler returns an error the walk stops and the error is returned, apart
+// from [ErrStopIteration], which stops the walk and returns nil.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) GetAll(needle []byte, handler func([]byte) error) error {
+	if !d.acquire() {
+		return fmt.Errorf("Could not look up %q: %w", needle, ErrClosed)
+	}
+	defer d.releaseReader()
+	if d.search == nil {
+		return fmt.Errorf("No search method defined for finding %q", needle)
+	}
+
+	n, first, upper, _, err := d.findBounds(needle)
+	if err != nil {
+		return err
+	}
+	if first == nil {
+		// The needle comes before the first record in the index.
+		return nil
+	}
+
+	buf := d.readpool.Get().([]byte)
+	defer d.readpool.Put(buf)
+	c := d.newCursor()
+
+	for {
+		b, err := d.readSector(buf, int64(n))
+		if err != nil {
+			return err
+		}
+		c.reset(b, int64(n))
+		for {
+			ok, err := c.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if bytes.HasPrefix(c.rec, needle) {
+				if err := handler(c.rec); err != nil {
+					return stopped(err)
+				}
+			} else if d.compare(c.rec, needle) > 0 {
+				// Past the last record which could match
+				return nil
+			}
+		}
+
+		// The next sector can only hold matches if its first record does.
+		if len(upper) == 0 || !bytes.HasPrefix(upper, needle) {
+			return nil
+		}
+		if n, _, upper, _, err = d.findBounds(upper); err != nil {
+			return err
+		}
+	}
+}
+
+// readBlock reads the block n from disk into buf and returns the portion of
+// buf which was filled.  The error is io.EOF when the end of the file was hit
+// during the read.
+//
+// When the file is memory mapped, or the block is held by the block cache, the
+// slice returned points into the mapping or the cache instead of buf, and so
+// must not be written to.
+func (d *DB) readBlock(buf []byte, n int64) (b []byte, err error) {
+	cache := d.bcache != nil && d.mmap == nil
+	if cache {
+		if b, eof, ok := d.bcache.get(n); ok {
+			if eof {
+				return b, io.EOF
+			}
+			return b, nil
+		}
+	}
+	off := d.base() + n<<d.shift
+	if d.codec != nil {
+		b, err = d.readCompressed(buf, n)
+		if err != nil {
+			return nil, err
+		}
+	} else if d.mmap != nil {
+		if off >= int64(len(d.mmap)) {
+			return nil, io.EOF
+		}
+		b = d.mmap[off:min(off+int64(d.blocksize), int64(len(d.mmap)))]
+		if len(b) < d.blocksize {
+			err = io.EOF
+		}
+	} else {
+		var rn int
+		rn, err = d.file.ReadAt(buf, off)
+		b = buf[:rn]
+	}
+
+	b, err = d.checkBlock(b, n, err)
+	if cache && len(b) > 0 && (err == nil || err == io.EOF) {
+		// Copy the block out of the read buffer, which is reused
+		d.bcache.put(n, bytes.Clone(b), err == io.EOF)
+	}
+	return b, err
+}
+
+// readSector reads the block n which the search index pointed to, where a
+// block missing from the file means the index and the file do not belong
+// together.
+func (d *DB) readSector(buf []byte, n int64) ([]byte, error) {
+	b, err := d.readBlock(buf, n)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w, block %d from the index is past the end", ErrTruncated, n)
+	}
+	return b, nil
+}
+
+// checkBlock verifies the checksum of the block n when blocks have one, and
+// returns the block without it.
+func (d *DB) checkBlock(b []byte, n int64, err error) ([]byte, error) {
+	if d.checksum && len(b) > 0 {
+		if len(b) < d.blocksize {
+			return nil, fmt.Errorf("Block %d is truncated to %d bytes", n, len(b))
+		}
+		// The checksum ends the block, which is longer than the block size
+		// when it holds a large record
+		end := len(b) - 4
+		want := binary.BigEndian.Uint32(b[end:])
+		if got := crc32.Checksum(b[:end], castagnoli); got != want {
+			return nil, fmt.Errorf("Checksum mismatch at block %d, expected %08x got %08x", n, want, got)
+		}
+		return b[:end], err
+	}
+	return b, err
+}
+
+// cursor decodes the prefix compressed records held within a single block.
+type cursor struct {
+	d     *DB    // Database the block belongs to, for the format options
+	b     []byte // Unread remainder of the block
+	rec   []byte // Current record
+	n     int64  // Block number, used for error reporting
+	first bool   // Next record is the first, and full, record of the block
+	spare []byte // Buffer the following record is decoded into
+	size  int    // Length of the block
+	pos   int    // Position of the current record within the block
+	left  int    // Records left in the block when it has a count, else -1
+}
+
+// newCursor returns a cursor for decoding the blocks of the wormdb.
+func (d *DB) newCursor() cursor {
+	return cursor{d: d, rec: make([]byte, 0, d.recHint), spare: make([]byte, 0, d.recHint)}
+}
+
+// reset prepares the cursor to decode the block b.
+func (c *cursor) reset(b []byte, n int64) {
+	c.b, c.n, c.first = b, n, true
+	c.rec = c.rec[:0]
+	c.size, c.pos, c.left = len(b), 0, -1
+	if c.d.head > 0 {
+		c.left = 0
+		if len(b) >= c.d.head {
+			c.left = int(binary.BigEndian.Uint32(b))
+			c.b = b[c.d.head:]
+		}
+	}
+}
+
+// offset returns the position of the current record within the file.
+func (c *cursor) offset() int64 {
+	return c.d.base() + c.n<<c.d.shift + int64(c.pos)
+}
+
+// next decodes the following record of the block into rec.  It returns false
+// once the end of the block has been reached.
+func (c *cursor) next() (bool, error) {
+	b := c.b
+	c.pos = c.size - len(b)
+	if len(b) == 0 {
+		return false, nil
+	}
+	if c.left == 0 {
+		// Every record counted in the block has been read
+		c.b = nil
+		return false, nil
+	}
+
+	// The framing is told of the first record of a block by a nil prev, so
+	// the records decoded must never be nil themselves.
+	var prev []byte
+	if !c.first {
+		prev = c.rec
+	}
+	if c.spare == nil {
+		c.spare = make([]byte, 0, c.d.recHint)
+	}
+	rec, n, err := c.d.framing.Decode(prev, b, c.spare[:0])
+	if err != nil {
+		return false, fmt.Errorf("%w at block %d", err, c.n)
+	}
+	if n == 0 {
+		c.b = nil
+		return false, nil
+	}
+	c.first = false
+	c.rec, c.spare = rec, c.rec
+	c.b = b[n:]
+	c.left--
+	return true, nil
 }
 
 // NewWalker will return all the records in a wormdb with a scanner like interface.
@@ -273,7 +1456,228 @@ func (d DB) Get(needle []byte, handler func([]byte) error) error {
 // The slice MUST be copied to a local variable as the underlying byte slice
 // will be reused in future function calls.
 func (d *DB) NewWalker() *Walker {
-	return &Walker{rec: make([]byte, 0, 256), db: d, n: d.offset}
+	return &Walker{cursor: d.newCursor(), db: d}
+}
+
+// NewRangeWalker will return the records in the half-open interval [start,
+// end) with a scanner like interface.  The walk begins at the block which
+// could hold start, so only the records in that one block are skipped over.  A
+// nil end walks until the end of the wormdb.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) NewRangeWalker(start, end []byte) *Walker {
+	w := d.NewWalker()
+	w.start, w.end, w.from = start, end, start
+	if len(start) > 0 && d.acquire() {
+		defer d.releaseReader()
+		// Every block begins with a full record, so starting at the block
+		// boundary leaves nothing behind in an earlier block.
+		if d.search != nil {
+			if n, first, _ := d.search.Find(start); first != nil {
+				w.n = int64(n)
+			}
+		}
+	}
+	return w
+}
+
+// NewPrefixWalker will return the records which begin with prefix with a
+// scanner like interface, stopping at the first record past them.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) NewPrefixWalker(prefix []byte) *Walker {
+	return d.NewRangeWalker(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key which sorts after every key beginning
+// with prefix, or nil when there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			end := bytes.Clone(prefix[:i+1])
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// NewReverseWalker will return all the records in a wormdb in descending order
+// with a scanner like interface.
+//
+// As the records within a block are prefix compressed against the record
+// before them, each block is fully decoded into memory before the records are
+// handed back in reverse.  This costs one extra buffer per walker which is as
+// large as the sum of the full lengths of every record in a block.
+//
+// The slice MUST be copied to a local variable as the underlying byte slice
+// will be reused in future function calls.
+func (d *DB) NewReverseWalker() *Walker {
+	w := &Walker{db: d, reverse: true, rc: d.newCursor()}
+	blocks, err := d.blocks()
+	if err != nil {
+		w.err, w.done = err, true
+	}
+	w.n = blocks - 1
+	return w
+}
+
+// size returns the size of the backing store, which must either have a Size
+// method or a Stat method like an os.File.
+func (d *DB) size() (int64, error) {
+	switch f := d.file.(type) {
+	case interface{ Size() int64 }:
+		return f.Size(), nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	return 0, fmt.Errorf("Unable to determine the size of %T", d.file)
+}
+
+// blocks returns the number of blocks in the file, the last of which may be
+// partially filled.
+func (d *DB) blocks() (int64, error) {
+	if d.codec != nil {
+		return int64(len(d.offsets) - 1), nil
+	}
+	size, err := d.size()
+	if err != nil {
+		return 0, err
+	}
+	size -= d.base()
+	if size <= 0 {
+		return 0, nil
+	}
+	return (size + int64(d.blocksize) - 1) >> d.shift, nil
+}
+
+// Seek repositions the [Walker] so the next call to [Walker.Scan] returns the
+// first record greater than or equal to needle, or for a reverse walker the
+// last record less than or equal to needle.  The block to start from is found
+// with the search index and the pooled read buffer is kept for reuse.  If no
+// such record exists Seek returns false and [Walker.Err] will say why.
+func (w *Walker) Seek(needle []byte) bool {
+	w.b, w.rec = nil, w.rec[:0]
+	w.done, w.hold, w.atEOF, w.err = false, false, false, nil
+	w.start, w.from = needle, needle
+	w.n = 0
+	if w.reverse {
+		w.start = nil
+		w.stack, w.ends, w.offs = w.stack[:0], w.ends[:0], w.offs[:0]
+	}
+	if !w.acquire() {
+		return false
+	}
+	if w.db.search != nil {
+		if n, first, _ := w.db.search.Find(needle); first != nil {
+			w.n = int64(n)
+		}
+	}
+
+	if w.reverse {
+		// The block found may also hold records after the needle
+		for w.Scan() {
+			if w.db.compare(w.rec, needle) <= 0 {
+				w.hold = true
+				return true
+			}
+		}
+		if w.err == nil {
+			w.err = fmt.Errorf("Seek %q is before the start of the database", needle)
+		}
+		return false
+	}
+
+	if !w.Scan() {
+		if w.err == nil {
+			w.err = fmt.Errorf("Seek %q is past the end of the database", needle)
+		}
+		return false
+	}
+	w.hold = true
+	return true
+}
+
+// SkipBlocks moves the [Walker] n blocks on from the block holding the
+// current record, without reading the blocks in between, so the next call to
+// [Walker.Scan] returns the first record of that block.  Before the first Scan
+// the walker counts from the block it is about to read.  A reverse walker
+// moves n blocks towards the start and resumes from the last record of that
+// block.  Skipping is by whole blocks rather than records, as each block holds
+// a varying number of records, which suits sampling a large wormdb.  It
+// returns false when the block is past the end of the wormdb, and Scan then
+// returns false too.
+func (w *Walker) SkipBlocks(n int) bool {
+	if n < 0 {
+		w.err = fmt.Errorf("Can not skip back %d blocks", -n)
+		w.done, w.rec = true, nil
+		return false
+	}
+	w.hold = false
+	if w.reverse {
+		cur := w.n
+		if w.rec != nil {
+			cur++
+		}
+		w.n, w.rec = cur-int64(n), nil
+		w.stack, w.ends, w.offs = w.stack[:0], w.ends[:0], w.offs[:0]
+		if w.n < 0 {
+			w.done, w.rec = true, nil
+			return false
+		}
+		return !w.done
+	}
+
+	cur := w.n
+	if w.b != nil {
+		cur--
+	}
+	blocks, err := w.db.blocks()
+	if err != nil {
+		w.err = err
+		w.done, w.rec = true, nil
+		return false
+	}
+	w.n = cur + int64(n)
+	w.b, w.rec = nil, w.rec[:0]
+	w.atEOF = false
+	if w.n >= blocks {
+		w.done, w.rec = true, nil
+		return false
+	}
+	return !w.done
+}
+
+// Reset rewinds the [Walker] so the next call to [Walker.Scan] returns the
+// first record of the walk again, which is the start of the range for a range
+// walker or the needle of the last [Walker.Seek].  The read buffer is kept, so
+// a long lived walker can make many passes without allocating.
+func (w *Walker) Reset() {
+	w.n = 0
+	if w.reverse {
+		blocks, err := w.db.blocks()
+		w.n = blocks - 1
+		w.stack, w.ends, w.offs = w.stack[:0], w.ends[:0], w.offs[:0]
+		w.done, w.err, w.rec = err != nil, err, nil
+		return
+	}
+	w.start = w.from
+	w.b, w.rec = nil, w.rec[:0]
+	w.done, w.hold, w.atEOF, w.err = false, false, false, nil
+	if !w.acquire() {
+		return
+	}
+	if w.db.search != nil && len(w.from) > 0 {
+		if n, first, _ := w.db.search.Find(w.from); first != nil {
+			w.n = int64(n)
+		}
+	}
 }
 
 // Err returns the first non-EOF error that was encountered by the [Walker].
@@ -303,213 +1707,736 @@ func (s *Walker) Text() string {
 // After Scan returns false, the [Walker.Err] method will return any error that
 // occurred during scanning, except that if it was [io.EOF], [Walker.Err]
 // will return nil.
+//
+// The walk holds the wormdb open from the first Scan until Scan returns false,
+// so a [DB.Close] in the meantime leaves the file open until then.  A walk
+// left before its end must be let go of with [Walker.Release].
 func (w *Walker) Scan() bool {
-	if w.done {
-		return false
+	if w.hold {
+		w.hold = false
+		return true
 	}
-	// Pull a buffer from the pool to read to do the expensive part and read the
-	// sector from the disk where the record should be located.
-	if w.buf == nil {
-		w.buf = w.db.readpool.Get().([]byte)
-		//defer d.readpool.Put(buf)
+	if !w.acquire() {
+		return false
 	}
-
-	if len(w.b) > 0 {
-		// Determine the re-used portion of the record
-		if len(w.b) < 2 || len(w.rec) < int(w.b[0]) {
-			w.err = fmt.Errorf("Bad record prefix at block %d", w.n)
+	for w.scan() {
+		if w.start != nil {
+			if w.db.compare(w.rec, w.start) < 0 {
+				continue
+			}
+			// Past the start, no need to check again
+			w.start = nil
+		}
+		if w.end != nil && w.db.compare(w.rec, w.end) >= 0 {
 			w.done, w.rec = true, nil
-			return false
+			break
 		}
-		w.rec = w.rec[:w.b[0]]
-		w.b = w.b[1:]
-
-		if w.b[0] > 0 {
-			if len(w.b) < int(w.b[0])+1 {
-				w.err = fmt.Errorf("Bad record size at block %d", w.n)
-				w.done, w.rec = true, nil
-				return false
-			}
-			w.rec = append(w.rec, w.b[1:int(w.b[0])+1]...)
+		return true
+	}
+	w.Release()
+	return false
+}
 
-			// Trim off the record from the block
-			w.b = w.b[w.b[0]+1:]
-			return true
-		} else {
-			// Truncate to prepare for next record
-			w.b = nil
-		}
+// Release lets go of the wormdb held open by a walk which is left before
+// [Walker.Scan] returns false, so that a [DB.Close] made during the walk can
+// close the file.  The walker must not be used again until [Walker.Reset] or
+// [Walker.Seek].  Releasing more than once is harmless.
+func (w *Walker) Release() {
+	if w.held {
+		w.held = false
+		w.db.releaseReader()
 	}
+}
 
-	if w.atEOF {
+// acquire holds the wormdb open for the walk, failing the walk with
+// [ErrClosed] once the wormdb has been closed.
+func (w *Walker) acquire() bool {
+	if w.held || w.done {
+		return true
+	}
+	if !w.db.acquire() {
+		w.err = fmt.Errorf("Could not walk: %w", ErrClosed)
 		w.done, w.rec = true, nil
 		return false
 	}
+	w.held = true
+	return true
+}
 
-	// Proceed to read the next block when nothing is left of the current block
-	// or the next record size is 0, the indicator that the block is complete.
+// Offset returns the position in the file of the current record, where its
+// header begins within the block holding it.  A finalized wormdb is never
+// changed, so offsets can be stored away and used later.  Only the first
+// record of a block is stored whole; to decode any other record, read the
+// block holding it and walk it up to the record.
+//
+// The offsets of a compressed wormdb are within the uncompressed blocks, as
+// though the blocks had been stored one after another without compression.
+func (w *Walker) Offset() int64 {
+	if w.reverse {
+		return w.off
+	}
+	return w.cursor.offset()
+}
 
-	// Read the sector from disk where the record should be at
-	rn, err := w.db.file.ReadAt(w.buf, (int64(w.n)+w.db.offset)<<w.db.shift)
-	w.atEOF = err == io.EOF
-	if err != nil && err != io.EOF {
-		w.err = err
-		w.db.readpool.Put(w.buf)
-		return false
+// Reuse returns the number of bytes at the start of the current record which
+// are shared with the record before it in the same block, and so were not
+// stored again by prefix compression.  It is 0 for the first record of a
+// block, which is stored whole, and when prefix compression is off.
+func (w *Walker) Reuse() int {
+	if w.rec == nil || w.db.noPrefix {
+		return 0
+	}
+	if w.reverse {
+		// The record before is the next one on the stack
+		last := len(w.ends) - 1
+		if last < 0 {
+			return 0
+		}
+		var begin int
+		if last > 0 {
+			begin = w.ends[last-1]
+		}
+		return commonPrefix(w.stack[begin:w.ends[last]], w.rec)
 	}
-	// Trim down the result, this should only happen at the end of the file.
-	w.b = w.buf[0:rn]
+	if w.pos == w.db.head {
+		return 0
+	}
+	// The record before was swapped out to be decoded into next
+	return commonPrefix(w.spare, w.rec)
+}
 
-	// The first byte in a block contains the record length
-	if len(w.b) == 0 || len(w.b) <= int(w.b[0])+1 {
-		w.err = fmt.Errorf("Record too short at block %d", w.n)
-		w.done, w.rec = true, nil
+// scan decodes the next record, reading in the following block from disk as
+// needed.
+func (w *Walker) scan() bool {
+	if w.done {
 		return false
 	}
-	w.n++
+	if w.reverse {
+		return w.scanReverse()
+	}
 
-	// First record in block is always a full record
-	w.rec = w.rec[:0]
-	w.rec = append(w.rec, w.b[1:int(w.b[0])+1]...)
+	for {
+		ok, err := w.next()
+		if err != nil {
+			w.err = err
+			w.done, w.rec = true, nil
+			return false
+		}
+		if ok {
+			return true
+		}
+
+		if w.atEOF {
+			w.done, w.rec = true, nil
+			return false
+		}
 
-	// Trim off the record from the block
-	w.b = w.b[w.b[0]+1:]
+		// Proceed to read the next block when nothing is left of the current
+		// block or the next record size is 0, the indicator that the block is
+		// complete.
 
+		// Read the sector from disk where the record should be at
+		b, err := w.readBlock(w.n)
+		w.atEOF = err == io.EOF
+		if err != nil && err != io.EOF {
+			w.err = err
+			w.done, w.rec = true, nil
+			return false
+		}
+		if len(b) == 0 {
+			// Nothing left to read, the previous block was the last.
+			w.done, w.rec = true, nil
+			return false
+		}
+		w.reset(b, w.n)
+		w.n++
+	}
+}
+
+// scanReverse hands back the records of the decoded block from last to first,
+// decoding the previous block from disk once the current one is used up.
+func (w *Walker) scanReverse() bool {
+	for len(w.ends) == 0 {
+		if w.n < 0 {
+			w.done, w.rec = true, nil
+			return false
+		}
+		if w.buf == nil {
+			w.buf = w.db.readpool.Get().([]byte)
+		}
+		b, err := w.db.readBlock(w.buf, w.n)
+		if err != nil && err != io.EOF {
+			w.err = err
+			w.done, w.rec = true, nil
+			return false
+		}
+
+		// Decode the whole block onto the stack
+		c := &w.rc
+		c.reset(b, w.n)
+		w.stack = w.stack[:0]
+		for {
+			ok, err := c.next()
+			if err != nil {
+				w.err = err
+				w.done, w.rec = true, nil
+				return false
+			}
+			if !ok {
+				break
+			}
+			w.stack = append(w.stack, c.rec...)
+			w.ends = append(w.ends, len(w.stack))
+			w.offs = append(w.offs, c.offset())
+		}
+		w.n--
+	}
+
+	// Pop the last record off the stack
+	last := len(w.ends) - 1
+	var begin int
+	if last > 0 {
+		begin = w.ends[last-1]
+	}
+	w.rec = w.stack[begin:w.ends[last]:w.ends[last]]
+	w.off = w.offs[last]
+	w.ends, w.offs = w.ends[:last], w.offs[:last]
 	return true
 }
 
-// Add a record to a wormdb when it is in write mode.
+// AddChannel returns a channel which records can be sent down to be added to
+// the wormdb from a single goroutine, so that several producers may share one
+// wormdb.  The records must still arrive in sorted order and a record must not
+// be modified once it has been sent.
+//
+// Closing the records channel finalizes the wormdb.  The first error, from
+// either an Add or the Finalize, is sent on the error channel, which is then
+// closed once the wormdb is finalized.  After an error the remaining records
+// are drained and dropped so the producers do not block.
+func (d *DB) AddChannel(bufferSize int) (chan<- []byte, <-chan error) {
+	recs := make(chan []byte, bufferSize)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		var err error
+		for rec := range recs {
+			if err == nil {
+				err = d.Add(rec)
+			}
+		}
+		if ferr := d.Finalize(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			errc <- err
+		}
+	}()
+	return recs, errc
+}
+
+// Add a record to a wormdb when it is in write mode.  A wormdb loaded with
+// [Open] returns [ErrReadOnly], and one which has been finalized returns
+// [ErrFinalized].
 func (d *DB) Add(rec []byte) (err error) {
+	if d.writeBuf == nil {
+		if d.block == nil {
+			return fmt.Errorf("Could not add %q: %w", rec, ErrReadOnly)
+		}
+		return fmt.Errorf("Could not add %q: %w", rec, ErrFinalized)
+	}
 	if d.old == nil {
 		// Simple case where records have not already been read
-		return d.add(rec)
+		return d.addNew(rec)
 	}
-	if len(d.old.rec) == 0 {
-		// Start the walk
-		if !d.old.Scan() {
+	if !d.oldHeld {
+		// Start the walk, as an empty first record cannot be told from one
+		// not yet read
+		if d.oldHeld = d.old.Scan(); !d.oldHeld {
 			// At the end
 			d.old = nil
-			return d.add(rec)
+			return d.addNew(rec)
 		}
 	}
 
 	for todo := true; todo; {
-		x := d.comp(d.old.rec, rec)
+		if d.equal != nil && d.equal(d.old.Bytes(), rec) {
+			// Collapse the two records into one, which is written before the
+			// walk moves on as it may point into the old record.
+			if err := d.addNew(d.reduce(d.old.Bytes(), rec)); err != nil {
+				return err
+			}
+			d.oldHeld = d.old.Scan()
+			return d.old.Err()
+		}
+		x := d.comp(d.old.Bytes(), rec)
 		switch x {
-		case -2: // A is wanted more, so it goes first and B is ignored
-			if err := d.add(d.old.rec); err != nil {
+		case TakeAOnly: // A is wanted more, so it goes first and B is ignored
+			if err := d.addOld(); err != nil {
 				return err
 			}
-			d.old.Scan()
+			d.oldHeld = d.old.Scan()
 			return d.old.Err()
-		case -1, 0: // A is less, so it goes first
-			if err := d.add(d.old.rec); err != nil {
+		case AFirst, Equal: // A is less, so it goes first
+			if err := d.addOld(); err != nil {
 				return err
 			}
-			todo = d.old.Scan()
-		case 1: // B is less, so it goes first
-			return d.add(rec)
-		case 2: // B is wanted more, so it goes first and A is ignored
-			d.old.Scan()
-			return d.add(rec)
+			d.oldHeld = d.old.Scan()
+			todo = d.oldHeld
+		case BFirst: // B is less, so it goes first
+			return d.addNew(rec)
+		case TakeBOnly: // B is wanted more, so it goes first and A is ignored
+			d.oldHeld = d.old.Scan()
+			return d.addNew(rec)
 		}
 	}
-	return d.add(rec)
+	return d.addNew(rec)
 }
 
-func (d *DB) add(rec []byte) (err error) {
-	if d.written&d.blocksizeMask == 0 {
-		// Add the new block to the search index
-		if d.search != nil {
-			d.search.Add(rec)
-		}
+// addOld adds the current record of the sources being merged.  The order is
+// checked even with [WithUnsafeNoOrderCheck], as the sources are not the
+// caller's records and a corrupt one would otherwise go unnoticed.
+func (d *DB) addOld() error {
+	rec := d.old.Bytes()
+	var src int
+	if m, ok := d.old.(*merger); ok {
+		src = m.items[0].i
+	}
+	if (d.written > 0 || d.recs > 0) && d.compare(d.prev, rec) >= 0 {
+		return fmt.Errorf("%w, %q from source %d cannot come after %q", ErrMergeOrder, rec, src, d.prev)
 	}
+	if err := d.add(rec); err != nil || d.trace == nil {
+		return err
+	}
+	d.trace(rec, src)
+	return nil
+}
 
-	// Handle first record case
-	if d.written == 0 {
-		d.writeBuf.WriteByte(byte(len(rec)))
-		d.written++
-		var n int
-		n, err = d.writeBuf.Write(rec)
-		d.written += int64(n)
-		d.prev = append(d.prev, rec...)
-		return
+// addNew adds a record passed to Add.
+func (d *DB) addNew(rec []byte) error {
+	if err := d.add(rec); err != nil || d.trace == nil {
+		return err
 	}
+	d.trace(rec, d.sources)
+	return nil
+}
 
-	// Ensure ordering
-	if bytes.Compare(d.prev, rec) >= 0 {
-		return fmt.Errorf("Record %q cannot come after %q", rec, d.prev)
+func (d *DB) add(rec []byte) (err error) {
+	if len(rec) == 0 && d.head == 0 {
+		// A zero length marks the end of the records in a block
+		return fmt.Errorf("Empty records can only be stored with a record count")
 	}
 
-	// Determine re-used bytes from previous record
-	var reuse int
-	for ; reuse < len(d.prev) && reuse < len(rec) && d.prev[reuse] == rec[reuse]; reuse++ {
+	if (d.written > 0 || d.recs > 0) && !d.noOrderCheck {
+		// Ensure ordering
+		if d.compare(d.prev, rec) >= 0 {
+			return fmt.Errorf("%w, %q cannot come after %q", ErrOutOfOrder, rec, d.prev)
+		}
+		// Only possible with WithCompare, and not stored as the record would
+		// share all of its bytes with the one before
+		if d.order != nil && len(rec) < len(d.prev) && bytes.HasPrefix(d.prev, rec) {
+			return fmt.Errorf("%w, %q cannot come after %q which it is a prefix of", ErrOutOfOrder, rec, d.prev)
+		}
 	}
 
-	// Check if space is available in current block
-	avail := d.blocksize - int(d.written&d.blocksizeMask)
-	if avail >= len(rec)-reuse+2 {
-		d.writeBuf.WriteByte(byte(reuse))
-		d.writeBuf.WriteByte(byte(len(rec) - reuse))
-		d.written += 2
-		var n int
-		n, err = d.writeBuf.Write(rec[reuse:])
-		d.written += int64(n)
-		d.prev = d.prev[:0]
-		d.prev = append(d.prev, rec...)
-		return
+	if d.recs > 0 {
+		if d.enc, err = d.framing.Encode(d.prev, rec, d.enc[:0]); err != nil {
+			return
+		}
+
+		// Check if space is available in current block
+		if avail := d.blocksize - d.reserved - d.used; avail >= len(d.enc) {
+			d.used += copy(d.block[d.used:], d.enc)
+			d.recorded(rec)
+			if d.used == d.blocksize {
+				return d.flushBlock()
+			}
+			return
+		}
+
+		if err = d.flushBlock(); err != nil {
+			return
+		}
 	}
 
-	d.written += int64(avail)
-	d.writeBuf.Write(d.block[:avail])
+	// The first record in a block is always a full record
+	if d.enc, err = d.framing.Encode(nil, rec, d.enc[:0]); err != nil {
+		return
+	}
+	if d.head+len(d.enc) > d.blocksize-d.reserved {
+		if d.large {
+			return d.addLarge(rec)
+		}
+		return fmt.Errorf("%w, %q does not fit in block size %d", ErrRecordTooLong, rec, d.blocksize)
+	}
 
 	// Add the new block to the search index
 	if d.search != nil {
 		d.search.Add(rec)
 	}
 
-	d.writeBuf.WriteByte(byte(len(rec)))
-	d.written++
-	var n int
-	n, err = d.writeBuf.Write(rec)
-	d.written += int64(n)
-	d.prev = d.prev[:0]
-	d.prev = append(d.prev, rec...)
+	d.used = d.head + copy(d.block[d.head:], d.enc)
+	d.nblocks++
+	d.built.Blocks++
+	d.recorded(rec)
+	if d.used == d.blocksize {
+		return d.flushBlock()
+	}
 	return
 }
 
+// addLarge writes out rec, which is already encoded in enc, in a block of its
+// own which is as long as the record needs, for WithLargeRecords.
+func (d *DB) addLarge(rec []byte) error {
+	if d.search != nil {
+		d.search.Add(rec)
+	}
+	b := make([]byte, d.head+len(d.enc)+d.reserved)
+	copy(b[d.head:], d.enc)
+	d.nblocks++
+	d.built.Blocks++
+	d.recorded(rec)
+	if d.head > 0 {
+		binary.BigEndian.PutUint32(b, 1)
+	}
+	if d.checksum {
+		sum := crc32.Checksum(b[:len(b)-4], castagnoli)
+		binary.BigEndian.PutUint32(b[len(b)-4:], sum)
+	}
+	d.filled += int64(len(b) - d.reserved)
+	d.used, d.recs = 0, 0
+	return d.writeBlock(b)
+}
+
+// flushBlock pads out the block being built, adds the checksum if enabled,
+// and writes it to the file.
+func (d *DB) flushBlock() error {
+	d.filled += int64(d.used)
+	d.built.Padding += int64(d.blocksize - d.reserved - d.used)
+	clear(d.block[d.used:])
+	if d.pad != 0 && d.used+padEnd < d.blocksize-d.reserved {
+		fill := d.block[d.used+padEnd : d.blocksize-d.reserved]
+		for i := range fill {
+			fill[i] = d.pad
+		}
+	}
+	if d.checksum {
+		sum := crc32.Checksum(d.block[:d.blocksize-4], castagnoli)
+		binary.BigEndian.PutUint32(d.block[d.blocksize-4:], sum)
+	}
+	d.used, d.recs = 0, 0
+	return d.writeBlock(d.block)
+}
+
+// recorded keeps track of a record once it has been added to the block being
+// built, updating the count at the start of the block when there is one.
+func (d *DB) recorded(rec []byte) {
+	if d.recs > 0 && !d.noPrefix {
+		d.reused += int64(commonPrefix(d.prev, rec))
+	}
+	d.built.Records++
+	d.prev = append(d.prev[:0], rec...)
+	if d.count >= 0 {
+		d.count++
+	}
+	d.recs++
+	if d.head > 0 {
+		binary.BigEndian.PutUint32(d.block, uint32(d.recs))
+	}
+	if d.bloomBits > 0 {
+		d.bloomHashes = append(d.bloomHashes, bloomHash(d.key(rec)))
+	}
+	for _, ix := range d.indexes {
+		ix.add(rec, d.nblocks-1)
+	}
+}
+
+// writeBlock writes out a block, compressing it if enabled.
+func (d *DB) writeBlock(b []byte) error {
+	if d.codec != nil {
+		return d.writeCompressed(b)
+	}
+	if err := d.checkSize(len(b)); err != nil {
+		return err
+	}
+	n, err := d.writeBuf.Write(b)
+	d.written += int64(n)
+	return err
+}
+
+// checkSize returns an error when writing n more bytes would pass the limit
+// set by WithMaxSize.
+func (d *DB) checkSize(n int) error {
+	if d.maxSize > 0 && d.written+int64(n) > d.maxSize {
+		return fmt.Errorf("%w, writing %d bytes after %d would pass %d", ErrMaxSizeExceeded, n, d.written, d.maxSize)
+	}
+	return nil
+}
+
 // Finalize the database, write any buffers to disk, and build search index.
 func (d *DB) Finalize() (err error) {
 	if d == nil {
 		return nil
 	}
 	if d.old != nil {
-		if len(d.old.rec) > 0 {
-			d.add(d.old.rec)
+		// Carry over the rest of the merged records, stopping at the first
+		// failure but still writing out those before it.
+		if d.oldHeld {
+			err = d.addOld()
 		}
-		for d.old.Scan() {
-			d.add(d.old.rec)
+		for err == nil && d.old.Scan() {
+			err = d.addOld()
 		}
-		d.old = nil
+		releaseSource(d.old)
+		d.old, d.oldHeld = nil, false
 	}
 	var wb *bufio.Writer
 	wb, d.writeBuf = d.writeBuf, nil
 	if wb != nil {
+		// Write out the last block, which only needs padding when it holds a
+		// checksum.
+		if d.recs > 0 {
+			d.writeBuf = wb
+			var werr error
+			if d.checksum {
+				werr = d.flushBlock()
+			} else {
+				werr = d.writeBlock(d.block[:d.used])
+				d.filled += int64(d.used)
+				d.used, d.recs = 0, 0
+			}
+			d.writeBuf = nil
+			if err == nil {
+				err = werr
+			}
+		}
+		if d.codec != nil {
+			// Mark the end of the last block
+			d.offsets = append(d.offsets, d.written)
+		}
+		if d.bloomBits > 0 {
+			d.bloom = newBloom(d.bloomHashes, d.bloomBits)
+			d.bloomHashes = nil
+		}
+		for _, ix := range d.indexes {
+			ix.finalize()
+		}
 		if d.search != nil {
 			d.search.Finalize()
 		}
-		err = wb.Flush()
-		d.file.Sync()
+		if ferr := wb.Flush(); err == nil {
+			err = ferr
+		}
+		if f, ok := d.file.(interface{ Truncate(int64) error }); ok && d.prealloc > 0 {
+			// Give back the space reserved past the last block
+			if terr := f.Truncate(d.base() + d.written); err == nil {
+				err = terr
+			}
+		}
+		if s, ok := d.file.(interface{ Sync() error }); ok && !d.noSync {
+			if serr := s.Sync(); err == nil {
+				err = serr
+			}
+		}
+		d.mapFile()
+		if d.bcache != nil {
+			d.bcache.clear()
+		}
+		if s, ok := d.search.(interface{ setFingerprint(*fingerprint) }); ok {
+			// Saved with the index, to catch it being opened with another file
+			fp, _ := d.fingerprint()
+			s.setFingerprint(fp)
+		}
 	}
 	return
 }
 
-// Close the database and the file handle at the same time.
+// Sync writes the full blocks held in the write buffer out to the file and
+// then, when the file supports it, commits the file to stable storage.  The
+// block being filled is not written until it is full or the wormdb is
+// finalized, so the most recently added records may not be included.
+func (d *DB) Sync() error {
+	if d.writeBuf != nil {
+		if err := d.writeBuf.Flush(); err != nil {
+			return err
+		}
+	}
+	if s, ok := d.file.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Len returns the number of records which have been added to a wormdb built
+// with [New], including any records carried over by a merge.  The count is
+// not stored in the file, so a wormdb loaded with [Open] or [OpenForAppend]
+// returns -1 rather than walking every record to find out.
+func (d *DB) Len() int64 {
+	return d.count
+}
+
+// BlockSize returns the size in bytes of each block of the wormdb.
+func (d *DB) BlockSize() int {
+	return d.blocksize
+}
+
+// Offset returns the position in bytes of the wormdb within the file, which
+// is the sum of [WithOffset] and [WithByteOffset].
+func (d *DB) Offset() int64 {
+	return d.base()
+}
+
+// Search returns the search attached with [WithSearch], such as to save the
+// index of a wormdb once it has been finalized without keeping a reference to
+// the search alongside the wormdb.  Type assert it to reach the methods of the
+// search, such as [BinarySearch.Save].  It is nil when there is no search, or
+// once the wormdb has been closed.
+func (d *DB) Search() Search {
+	return d.search
+}
+
+// BuildStats are the counters of a wormdb being built, see [DB.BuildStats].
+type BuildStats struct {
+	Blocks    int64   // Blocks written
+	Records   int64   // Records added
+	Padding   int64   // Bytes left unused at the ends of the blocks
+	Fill      float64 // Share of the bytes of the blocks which hold records
+	AvgPrefix float64 // Average bytes a record shares with the one before it in its block
+}
+
+// BuildStats returns the counters of the blocks and records written, which
+// are complete once the wormdb has been finalized, such as for telling whether
+// the block size suits the records.  The last block of the file is only padded
+// when it holds a checksum, so its unused end is not counted otherwise.  The
+// prefix is only counted with prefix compression on, and for a wormdb opened
+// with [OpenForAppend], only the records added since and the blocks they are
+// written into are counted.
+func (d *DB) BuildStats() BuildStats {
+	st := d.built
+	if total := d.filled + st.Padding; total > 0 {
+		st.Fill = float64(d.filled) / float64(total)
+	}
+	if n := st.Records - st.Blocks; n > 0 {
+		// The first record of each block is stored whole
+		st.AvgPrefix = float64(d.reused) / float64(n)
+	}
+	return st
+}
+
+// DBStat summarizes the layout of a wormdb, see [DB.Stat].
+type DBStat struct {
+	BlockSize int   // Size of each block in bytes
+	Blocks    int64 // Number of blocks written, or -1 when it can not be told
+	Index     int   // Entries in the search index, or -1 when it can not be told
+	Offset    int64 // Position in the file where the wormdb begins
+	Records   int64 // Number of records, or -1 when it is not known, see [DB.Len]
+	Cache     bool  // A cache is attached for lookups
+	Search    bool  // A search index is attached for lookups
+}
+
+// Stat returns a summary of the wormdb, such as for monitoring.  It works the
+// same for a wormdb being built with [New] as for one loaded with [Open], and
+// only reads the fields already in memory, apart from asking the file for its
+// size to count the blocks.
+func (d *DB) Stat() DBStat {
+	st := DBStat{
+		BlockSize: d.blocksize,
+		Blocks:    -1,
+		Index:     -1,
+		Offset:    d.base(),
+		Records:   d.count,
+		Cache:     d.cache != nil,
+		Search:    d.search != nil,
+	}
+	if d.writeBuf != nil {
+		// Still being written, so count what has been flushed
+		st.Blocks = d.written >> d.shift
+		if d.codec != nil {
+			st.Blocks = int64(len(d.offsets))
+		}
+	} else if n, err := d.blocks(); err == nil {
+		st.Blocks = n
+	}
+	switch s := d.search.(type) {
+	case *BinarySearch:
+		st.Index = s.Count()
+	case *InterpolationSearch:
+		st.Index = s.Count()
+	case *TrieSearch:
+		st.Index = s.count
+	case *SparseBinarySearch:
+		st.Index = s.count
+	}
+	return st
+}
+
+// Close the database and the file handle at the same time.  A wormdb still
+// being built is finalized first, and a failure to write out its last records
+// is returned along with any error closing the file, so a full disk is not
+// missed.  While readers hold the wormdb with [DB.Acquire], are in the middle
+// of a lookup, or are walking it with a [Walker], the file is left open and is
+// closed once the last of them releases it, in which case Close returns
+// without waiting.  Lookups and walks begun once the file has been closed
+// return [ErrClosed].
 func (d *DB) Close() error {
 	if d == nil {
 		return nil
 	}
-	d.Finalize()
+	ferr := d.Finalize()
+	d.closing.Store(true)
+	if !d.readers.CompareAndSwap(0, shutReaders) {
+		// The last reader to release closes the file
+		return ferr
+	}
+	return errors.Join(ferr, d.shut())
+}
+
+// shutReaders is the reader count of a wormdb which has been shut, far enough
+// below zero that readers counting in and back out can not reach zero again.
+const shutReaders = math.MinInt64 / 2
+
+// shut releases the memory and file of a closed wormdb once no reader holds
+// it.
+func (d *DB) shut() error {
 	d.search = nil // Make sure memory is no longer referenced here.
-	return d.file.Close()
+	if d.mmap != nil {
+		munmap(d.mmap)
+		d.mmap = nil
+	}
+	if c, ok := d.file.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Acquire holds the wormdb open for reading until release is called, so that
+// a [DB.Close] in the meantime leaves the file open until then.  Every lookup
+// holds the wormdb while it runs, and a [Walker] until its walk ends, so
+// Acquire is for holding it across several lookups, such as while swapping a
+// new wormdb in under a running server; see the example.  Release must be
+// called exactly once.
+func (d *DB) Acquire() (release func()) {
+	if !d.acquire() {
+		// Already closed, so there is nothing to hold
+		return func() {}
+	}
+	var once sync.Once
+	return func() { once.Do(d.releaseReader) }
+}
+
+// acquire counts a reader in, returning false when the wormdb has been closed,
+// in which case the reader has already been counted back out.
+func (d *DB) acquire() bool {
+	if d.readers.Add(1) < 0 {
+		d.readers.Add(-1)
+		return false
+	}
+	return true
+}
+
+// releaseReader counts a reader out, closing the wormdb when it was the last reader
+// of a closed wormdb.
+func (d *DB) releaseReader() {
+	if d.readers.Add(-1) == 0 && d.closing.Load() && d.readers.CompareAndSwap(0, shutReaders) {
+		d.shut()
+	}
 }
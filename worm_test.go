@@ -2,9 +2,25 @@ package wormdb_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
 
 	bwdb "github.com/pschou/go-wormdb"
 )
@@ -77,7 +93,7 @@ func ExampleNew() {
 	// found: hello world abc
 }
 
-func ExampleWalk() {
+func ExampleDB_NewWalker() {
 	f, err := os.Create("walk.db")
 	if err != nil {
 		log.Fatal(err)
@@ -113,6 +129,75 @@ func ExampleWalk() {
 	// step 3 hello world ghi
 }
 
+func ExampleDB_Len() {
+	f, err := os.Create("len.db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f,
+		bwdb.WithSearch(bs))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		db.Add([]byte(fmt.Sprintf("record %04d", i)))
+	}
+	db.Finalize()
+	fmt.Println("records:", db.Len())
+	// Output:
+	// records: 1000
+}
+
+func ExampleWithMergeReduce() {
+	f1, err := os.Create("reduce_old.db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	db1, err := bwdb.New(f1,
+		bwdb.WithSearch(bwdb.NewBinarySearch()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db1.Close()
+	db1.Add([]byte("apple=1"))
+	db1.Add([]byte("banana=1"))
+	db1.Add([]byte("cherry=1"))
+	db1.Finalize()
+
+	f2, err := os.Create("reduce_new.db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	key := func(rec []byte) []byte {
+		k, _, _ := bytes.Cut(rec, []byte("="))
+		return k
+	}
+	db2, err := bwdb.New(f2,
+		bwdb.WithSearch(bwdb.NewBinarySearch()),
+		bwdb.WithMergeReduce(db1,
+			func(a, b []byte) bool { return bytes.Equal(key(a), key(b)) },
+			func(a, b []byte) []byte { return b }, // Last write wins
+		))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db2.Close()
+	db2.Add([]byte("banana=2"))
+	db2.Add([]byte("date=2"))
+	db2.Finalize()
+
+	for w := db2.NewWalker(); w.Scan(); {
+		fmt.Println(w.Text())
+	}
+	// Output:
+	// apple=1
+	// banana=2
+	// cherry=1
+	// date=2
+}
+
 func ExampleNewDiskBinarySearch() {
 	f, err := os.Create("disk_data.db")
 	if err != nil {
@@ -222,7 +307,7 @@ func ExampleOpen() {
 	// rec: "hello world qrs00000000000000000000000000000000000000000000000000000000000000000000000000000000" err: <nil>
 }
 
-func ExampleNewMerge() {
+func ExampleWithMerge() {
 	f1, err := os.Create("new_merged.db")
 	if err != nil {
 		log.Fatal(err)
@@ -276,3 +361,3412 @@ func ExampleNewMerge() {
 	// step 4 hello world def
 	// step 5 hello world ghi
 }
+
+func TestGetAll(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "getall.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f,
+		bwdb.WithSearch(bs),
+		bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 100; j++ {
+			db.Add([]byte(fmt.Sprintf("10.0.%d.%03d", i, j)))
+		}
+	}
+	db.Finalize()
+	if len(bs.Index) < 4 {
+		t.Fatalf("expected records to span many blocks, got %d", len(bs.Index))
+	}
+
+	var got []string
+	err = db.GetAll([]byte("10.0.1."), func(rec []byte) error {
+		got = append(got, string(rec))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 {
+		t.Fatalf("expected 100 matches, got %d", len(got))
+	}
+	for j, rec := range got {
+		if want := fmt.Sprintf("10.0.1.%03d", j); rec != want {
+			t.Fatalf("match %d: expected %q, got %q", j, want, rec)
+		}
+	}
+
+	// Errors from the handler must stop the walk
+	stop := errors.New("stop")
+	var calls int
+	err = db.GetAll([]byte("10.0.2."), func(rec []byte) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("expected the handler error after 1 call, got %v after %d", err, calls)
+	}
+
+	// No matches
+	err = db.GetAll([]byte("10.0.3."), func(rec []byte) error {
+		t.Fatalf("unexpected match %q", rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewRangeWalker(t *testing.T) {
+	f, err := os.Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.Open(f,
+		bwdb.WithSearch(bwdb.LoadBinarySearch(index)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Gather the whole database to compare against
+	var all []string
+	for w := db.NewWalker(); w.Scan(); {
+		all = append(all, w.Text())
+	}
+
+	for _, tc := range []struct{ start, end string }{
+		{"b hello world p00000050", "c hello world p00000010"},
+		{"", "aaaaaaaaaaaaaa00000003"},
+		{"hello world ghi", ""},
+		{"c hello world p00000099", "c hello world p00000099"},
+		{"zzz", ""},
+	} {
+		var end []byte
+		if tc.end != "" {
+			end = []byte(tc.end)
+		}
+		var want []string
+		for _, rec := range all {
+			if rec >= tc.start && (end == nil || rec < tc.end) {
+				want = append(want, rec)
+			}
+		}
+
+		var got []string
+		w := db.NewRangeWalker([]byte(tc.start), end)
+		for w.Scan() {
+			got = append(got, w.Text())
+		}
+		if err := w.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("range [%q, %q): expected %d records, got %d", tc.start, tc.end, len(want), len(got))
+		}
+	}
+}
+
+func TestWalkerSeek(t *testing.T) {
+	f, err := os.Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.Open(f,
+		bwdb.WithSearch(bwdb.LoadBinarySearch(index)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w := db.NewWalker()
+	for _, tc := range []struct{ needle, want, then string }{
+		{"hello world p00000050", "hello world p00000050", "hello world p00000051"},
+		{"aaaaaaaaaaaaaa00000010", "aaaaaaaaaaaaaa00000010", "aaaaaaaaaaaaaa00000011"},
+		{"c hello world p00000099", "c hello world p00000099", "hello world"},
+		{"b", "b hello world p00000000", "b hello world p00000001"},
+		{"", "aaaaaaaaaaaaaa00000000", "aaaaaaaaaaaaaa00000001"},
+		{"hello world tuv", "hello world tuv", ""},
+	} {
+		if !w.Seek([]byte(tc.needle)) {
+			t.Fatalf("seek %q failed: %v", tc.needle, w.Err())
+		}
+		if !w.Scan() || !bytes.HasPrefix(w.Bytes(), []byte(tc.want)) {
+			t.Fatalf("seek %q: expected %q, got %q", tc.needle, tc.want, w.Text())
+		}
+		if tc.then == "" {
+			if w.Scan() {
+				t.Fatalf("seek %q: expected end, got %q", tc.needle, w.Text())
+			}
+			continue
+		}
+		if !w.Scan() || !bytes.HasPrefix(w.Bytes(), []byte(tc.then)) {
+			t.Fatalf("seek %q: expected %q next, got %q", tc.needle, tc.then, w.Text())
+		}
+	}
+
+	if w.Seek([]byte("zzz")) || w.Err() == nil {
+		t.Fatal("expected seeking past the end to fail")
+	}
+	if !w.Seek([]byte("hello world")) || !w.Scan() || w.Text() != "hello world" {
+		t.Fatalf("expected the walker to recover after a failed seek, got %q", w.Text())
+	}
+}
+
+func TestReverseWalkerSeek(t *testing.T) {
+	f, err := os.Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.Open(f,
+		bwdb.WithSearch(bwdb.LoadBinarySearch(index)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	all := walkAll(t, db)
+
+	w := db.NewReverseWalker()
+	for _, needle := range []string{
+		"hello world p00000050",
+		"hello world p00000050a",
+		"aaaaaaaaaaaaaa00000010",
+		"b",
+		"c hello world p00000099",
+		all[0],
+		"zzz",
+	} {
+		// Leave records of another block decoded on the stack
+		w.Scan()
+		w.Scan()
+
+		// The last record at or before the needle, then the few before it
+		i, found := slices.BinarySearch(all, needle)
+		if !found {
+			i--
+		}
+		if !w.Seek([]byte(needle)) {
+			t.Fatalf("seek %q failed: %v", needle, w.Err())
+		}
+		for end := i - 3; i >= 0 && i > end; i-- {
+			if !w.Scan() || w.Text() != all[i] {
+				t.Fatalf("seek %q: expected %q, got %q", needle, all[i], w.Text())
+			}
+		}
+	}
+
+	if w.Seek([]byte("a")) || w.Err() == nil {
+		t.Fatal("expected seeking before the start to fail")
+	}
+	if !w.Seek([]byte("hello world")) || !w.Scan() || w.Text() != "hello world" {
+		t.Fatalf("expected the walker to recover after a failed seek, got %q", w.Text())
+	}
+}
+
+func TestNewReverseWalker(t *testing.T) {
+	f, err := os.Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.Open(f,
+		bwdb.WithSearch(bwdb.LoadBinarySearch(index)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var all []string
+	for w := db.NewWalker(); w.Scan(); {
+		all = append(all, w.Text())
+	}
+
+	w := db.NewReverseWalker()
+	i := len(all)
+	for w.Scan() {
+		i--
+		if i < 0 || w.Text() != all[i] {
+			t.Fatalf("record %d: expected %q, got %q", i, all[i], w.Text())
+		}
+	}
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != 0 {
+		t.Fatalf("expected %d records, got %d", len(all), len(all)-i)
+	}
+}
+
+func TestBlockChecksum(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "checksum.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f,
+		bwdb.WithSearch(bs),
+		bwdb.WithBlockSize(256),
+		bwdb.WithBlockChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if err := db.Add([]byte(fmt.Sprintf("record %04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() *bwdb.DB {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := bwdb.Open(f,
+			bwdb.WithSearch(bwdb.LoadBinarySearch(bs.Index)),
+			bwdb.WithBlockSize(256),
+			bwdb.WithBlockChecksum())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	db = open()
+	var i int
+	w := db.NewWalker()
+	for ; w.Scan(); i++ {
+		if want := fmt.Sprintf("record %04d", i); w.Text() != want {
+			t.Fatalf("expected %q, got %q", want, w.Text())
+		}
+	}
+	if err := w.Err(); err != nil || i != 200 {
+		t.Fatalf("expected 200 records without error, got %d and %v", i, err)
+	}
+	db.Close()
+
+	// Flip a bit in the second block
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[256+10] ^= 1
+	if err := os.WriteFile(name, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = open()
+	defer db.Close()
+	err = db.Get(bs.Index[1], func([]byte) error { return nil })
+	if err != nil {
+		t.Fatalf("expected the index entry to be served without a read, got %v", err)
+	}
+	err = db.Get(append(bs.Index[1], '0'), func(rec []byte) error {
+		t.Fatalf("unexpected record %q from a corrupt block", rec)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected a checksum error from Get")
+	}
+	for w = db.NewWalker(); w.Scan(); {
+	}
+	if w.Err() == nil {
+		t.Fatal("expected a checksum error from the walker")
+	}
+}
+
+func TestVarint(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "varint.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f,
+		bwdb.WithSearch(bs),
+		bwdb.WithVarint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	prefix := bytes.Repeat([]byte("/some/long/path"), 20)[:300]
+	var want [][]byte
+	for i := 0; i < 100; i++ {
+		want = append(want, fmt.Appendf(bytes.Clone(prefix), "/file%03d", i))
+	}
+	want = append(want, append(bytes.Repeat([]byte("z"), 899), 'z'))
+	for _, rec := range want {
+		if err := db.Add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	var i int
+	w := db.NewWalker()
+	for ; w.Scan(); i++ {
+		if !bytes.Equal(w.Bytes(), want[i]) {
+			t.Fatalf("record %d: expected %q, got %q", i, want[i], w.Bytes())
+		}
+	}
+	if err := w.Err(); err != nil || i != len(want) {
+		t.Fatalf("expected %d records without error, got %d and %v", len(want), i, err)
+	}
+
+	for _, needle := range [][]byte{want[42][:len(want[42])-1], want[100][:500]} {
+		var got []byte
+		err = db.Get(needle, func(rec []byte) error {
+			got = bytes.Clone(rec)
+			return nil
+		})
+		if err != nil || !bytes.HasPrefix(got, needle) {
+			t.Fatalf("Get %q: got %q, %v", needle, got, err)
+		}
+	}
+}
+
+func TestAddTooLong(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "toolong.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.New(f,
+		bwdb.WithSearch(bwdb.NewBinarySearch()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Add(bytes.Repeat([]byte("a"), 255)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add(bytes.Repeat([]byte("b"), 256)); err == nil {
+		t.Fatal("expected an error adding a 256 byte record")
+	}
+	// The database must still be usable after the rejection
+	if err := db.Add([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	db.Finalize()
+	var got []string
+	for w := db.NewWalker(); w.Scan(); {
+		got = append(got, w.Text()[:1])
+	}
+	if fmt.Sprint(got) != "[a c]" {
+		t.Fatalf("expected [a c], got %v", got)
+	}
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	raw, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.OpenReaderAt(bytes.NewReader(raw),
+		bwdb.WithSearch(bwdb.LoadBinarySearch(index)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var got string
+	err = db.Get([]byte("hello world p00000042"), func(rec []byte) error {
+		got = string(rec)
+		return nil
+	})
+	if err != nil || !strings.HasPrefix(got, "hello world p00000042") {
+		t.Fatalf("expected a match, got %q and %v", got, err)
+	}
+
+	w := db.NewReverseWalker()
+	if !w.Scan() || !strings.HasPrefix(w.Text(), "hello world tuv") {
+		t.Fatalf("expected the last record, got %q and %v", w.Text(), w.Err())
+	}
+}
+
+func TestMmap(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "mmap.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f,
+		bwdb.WithSearch(bs),
+		bwdb.WithBlockSize(256),
+		bwdb.WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		db.Add([]byte(fmt.Sprintf("record %04d", i)))
+	}
+	check := func(db *bwdb.DB) {
+		t.Helper()
+		var i int
+		w := db.NewWalker()
+		for ; w.Scan(); i++ {
+			if want := fmt.Sprintf("record %04d", i); w.Text() != want {
+				t.Fatalf("expected %q, got %q", want, w.Text())
+			}
+		}
+		if err := w.Err(); err != nil || i != 500 {
+			t.Fatalf("expected 500 records without error, got %d and %v", i, err)
+		}
+		var got string
+		err = db.Get([]byte("record 0321"), func(rec []byte) error {
+			got = string(rec)
+			return nil
+		})
+		if err != nil || got != "record 0321" {
+			t.Fatalf("expected a match, got %q and %v", got, err)
+		}
+	}
+	db.Finalize()
+	check(db)
+	db.Close()
+
+	f, err = os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = bwdb.Open(f,
+		bwdb.WithSearch(bwdb.LoadBinarySearch(bs.Index)),
+		bwdb.WithBlockSize(256),
+		bwdb.WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+// buildDB creates a finalized wormdb holding recs in a temporary directory.
+func buildDB(t testing.TB, recs []string, options ...bwdb.Option) (*bwdb.DB, *bwdb.BinarySearch) {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, append([]bwdb.Option{bwdb.WithSearch(bs)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, rec := range recs {
+		if err := db.Add([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	return db, bs
+}
+
+// walkAll returns every record in the wormdb.
+func walkAll(t testing.TB, db *bwdb.DB) []string {
+	t.Helper()
+	var got []string
+	w := db.NewWalker()
+	for w.Scan() {
+		got = append(got, w.Text())
+	}
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestWithMergeN(t *testing.T) {
+	// Records are key:value and the newest value for a key wins
+	comp := func(a, b []byte) int {
+		ka, _, _ := bytes.Cut(a, []byte(":"))
+		kb, _, _ := bytes.Cut(b, []byte(":"))
+		if bytes.Equal(ka, kb) {
+			return 2
+		}
+		return bytes.Compare(ka, kb)
+	}
+
+	var sources []*bwdb.DB
+	for s := 0; s < 4; s++ {
+		var recs []string
+		for i := s; i < 300; i += s + 1 {
+			recs = append(recs, fmt.Sprintf("k%03d:s%d", i, s))
+		}
+		db, _ := buildDB(t, recs, bwdb.WithBlockSize(256))
+		sources = append(sources, db)
+	}
+
+	// Merge the sources in one at a time
+	pairwise := sources[0]
+	for _, s := range sources[1:] {
+		pairwise, _ = buildDB(t, walkAll(t, s), bwdb.WithMerge(pairwise, comp))
+	}
+
+	merged, _ := buildDB(t, nil, bwdb.WithMergeN(sources, comp))
+	want, got := walkAll(t, pairwise), walkAll(t, merged)
+	if len(want) != 300 || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %d records matching the pairwise merge, got %d", len(want), len(got))
+	}
+	if got[8] != "k008:s2" || got[11] != "k011:s3" {
+		t.Fatalf("expected the newest source to win, got %q and %q", got[8], got[11])
+	}
+}
+
+func TestCompression(t *testing.T) {
+	codec, err := bwdb.NewGzipCodec(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []string
+	for i := 0; i < 2000; i++ {
+		recs = append(recs, fmt.Sprintf("compressed record %05d", i))
+	}
+
+	for _, options := range [][]bwdb.Option{
+		{bwdb.WithCompression(codec)},
+		{bwdb.WithCompression(codec), bwdb.WithBlockChecksum(), bwdb.WithMmap()},
+	} {
+		options = append(options, bwdb.WithBlockSize(512))
+		name := filepath.Join(t.TempDir(), "compressed.db")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs := bwdb.NewBinarySearch()
+		db, err := bwdb.New(f, append([]bwdb.Option{bwdb.WithSearch(bs)}, options...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			if err := db.Add([]byte(rec)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if fi, err := os.Stat(name); err != nil || fi.Size() >= int64(len(bs.Index))*512 {
+			t.Fatalf("expected the file to be smaller than %d blocks, got %v %v", len(bs.Index), fi.Size(), err)
+		}
+
+		// Reopen so the block offsets are rebuilt from the file
+		f, err = os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err = bwdb.Open(f, append([]bwdb.Option{bwdb.WithSearch(bwdb.LoadBinarySearch(bs.Index))}, options...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := walkAll(t, db); !reflect.DeepEqual(got, recs) {
+			t.Fatalf("walker returned %d records, expected %d", len(got), len(recs))
+		}
+		for _, i := range []int{0, 1, 999, 1998, 1999} {
+			var got string
+			if err := db.Get([]byte(recs[i]), func(rec []byte) error {
+				got = string(rec)
+				return nil
+			}); err != nil || got != recs[i] {
+				t.Fatalf("Get(%q) returned %q, %v", recs[i], got, err)
+			}
+		}
+		var n int
+		for w := db.NewReverseWalker(); w.Scan(); n++ {
+			if want := recs[len(recs)-1-n]; w.Text() != want {
+				t.Fatalf("reverse walker expected %q, got %q", want, w.Text())
+			}
+		}
+		if n != len(recs) {
+			t.Fatalf("reverse walker returned %d records", n)
+		}
+		db.Close()
+	}
+}
+
+func TestCompressionLimit(t *testing.T) {
+	codec, err := bwdb.NewGzipCodec(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A block which claims to be a single record but inflates to far more
+	// than a block
+	z, err := codec.Compress([]byte{0, 0, 0, 0}, append([]byte{1, 'a'}, make([]byte, 64<<20)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(z, uint32(len(z)-4))
+
+	db, err := bwdb.OpenReaderAt(bytes.NewReader(z), bwdb.WithCompression(codec),
+		bwdb.WithSearch(bwdb.LoadBinarySearch([][]byte{[]byte("a")})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	w := db.NewWalker()
+	if w.Scan() || w.Err() == nil {
+		t.Fatal("expected an error reading the oversized block")
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Errorf("expected decompressing to stop at the block size, allocated %d bytes", grown)
+	}
+}
+
+// countingReaderAt counts the reads made of the wormdb.
+type countingReaderAt struct {
+	io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.ReaderAt.ReadAt(p, off)
+}
+
+func TestGetBatch(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "batch.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := db.Add([]byte(fmt.Sprintf("batch %05d", i*2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &countingReaderAt{ReaderAt: bytes.NewReader(raw)}
+	db, err = bwdb.OpenReaderAt(r, bwdb.WithSearch(bwdb.LoadBinarySearch(bs.Index)), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	needles := [][]byte{[]byte("a"), []byte("batch 0399"), []byte("batch 0399"), []byte("zzz")}
+	for i := 0; i < 4000; i += 3 {
+		needles = append(needles, []byte(fmt.Sprintf("batch %05d", i)))
+	}
+	slices.SortFunc(needles, bytes.Compare)
+
+	var want []string
+	for _, needle := range needles {
+		if err := db.Get(needle, func(rec []byte) error {
+			want = append(want, string(needle)+"="+string(rec))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r.reads = 0
+	var got []string
+	if err := db.GetBatch(needles, func(needle, rec []byte) error {
+		got = append(got, string(needle)+"="+string(rec))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetBatch returned %d matches, Get found %d", len(got), len(want))
+	}
+	if r.reads > len(bs.Index) {
+		t.Fatalf("expected at most one read for each of the %d blocks, got %d", len(bs.Index), r.reads)
+	}
+
+	slices.Reverse(needles)
+	if err := db.GetBatch(needles, func(needle, rec []byte) error { return nil }); err == nil {
+		t.Fatal("expected an error for unsorted needles")
+	}
+}
+
+func TestNewPrefixWalker(t *testing.T) {
+	var recs []string
+	for _, prefix := range []string{"10.0.0.", "10.0.1.", "10.0.10.", "10.1.0.", "\xff\xff"} {
+		for i := 0; i < 100; i++ {
+			recs = append(recs, fmt.Sprintf("%s%d", prefix, i))
+		}
+	}
+	slices.Sort(recs)
+	db, _ := buildDB(t, recs, bwdb.WithBlockSize(256))
+
+	// The first prefix starts in the first block, the others span blocks
+	for _, prefix := range []string{"", "1", "10.0.0.", "10.0.1", "10.0.1.", "10.1.0.5", "10.2", "\xff", "\xff\xff1"} {
+		var want []string
+		for _, rec := range recs {
+			if strings.HasPrefix(rec, prefix) {
+				want = append(want, rec)
+			}
+		}
+		var got []string
+		w := db.NewPrefixWalker([]byte(prefix))
+		for w.Scan() {
+			got = append(got, w.Text())
+		}
+		if err := w.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("prefix %q: expected %d records, got %d", prefix, len(want), len(got))
+		}
+	}
+}
+
+func TestAddChannel(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var want []string
+	recs, errc := db.AddChannel(16)
+	for i := 0; i < 1000; i++ {
+		rec := fmt.Sprintf("channel %04d", i)
+		want = append(want, rec)
+		recs <- []byte(rec)
+	}
+	close(recs)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := walkAll(t, db); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %d records, got %d", len(want), len(got))
+	}
+
+	// An out of order record is reported and the rest are drained
+	f, err = os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	recs, errc = db.AddChannel(0)
+	for _, rec := range []string{"b", "a", "c", "d"} {
+		recs <- []byte(rec)
+	}
+	close(recs)
+	if err := <-errc; err == nil {
+		t.Fatal("expected an ordering error")
+	}
+	if _, ok := <-errc; ok {
+		t.Fatal("expected the error channel to be closed")
+	}
+}
+
+func TestPrefixCompressionOff(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var recs []string
+	for i := 0; i < 1000; i++ {
+		recs = append(recs, fmt.Sprintf("%016x", r.Uint64()))
+	}
+	slices.Sort(recs)
+
+	for _, options := range [][]bwdb.Option{
+		{bwdb.WithPrefixCompression(false)},
+		{bwdb.WithPrefixCompression(false), bwdb.WithVarint(), bwdb.WithBlockChecksum()},
+	} {
+		db, _ := buildDB(t, recs, append(options, bwdb.WithBlockSize(256))...)
+		if got := walkAll(t, db); !reflect.DeepEqual(got, recs) {
+			t.Fatalf("walker returned %d records, expected %d", len(got), len(recs))
+		}
+		var n int
+		for w := db.NewReverseWalker(); w.Scan(); n++ {
+			if want := recs[len(recs)-1-n]; w.Text() != want {
+				t.Fatalf("reverse walker expected %q, got %q", want, w.Text())
+			}
+		}
+		for _, i := range []int{0, 1, 500, 999} {
+			var got string
+			if err := db.Get([]byte(recs[i][:12]), func(rec []byte) error {
+				got = string(rec)
+				return nil
+			}); err != nil || got != recs[i] {
+				t.Fatalf("Get(%q) returned %q, %v", recs[i][:12], got, err)
+			}
+		}
+	}
+}
+
+func BenchmarkAddRandomKeys(b *testing.B) {
+	for _, enabled := range []bool{true, false} {
+		b.Run(fmt.Sprint("prefix=", enabled), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			keys := make([][]byte, b.N)
+			for i := range keys {
+				keys[i] = make([]byte, 16)
+				r.Read(keys[i])
+			}
+			slices.SortFunc(keys, bytes.Compare)
+
+			f, err := os.CreateTemp(b.TempDir(), "*.db")
+			if err != nil {
+				b.Fatal(err)
+			}
+			db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithPrefixCompression(enabled))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.ResetTimer()
+			for _, key := range keys {
+				if err := db.Add(key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAddSorted(b *testing.B) {
+	for _, check := range []bool{true, false} {
+		b.Run(fmt.Sprint("check=", check), func(b *testing.B) {
+			keys := make([][]byte, b.N)
+			for i := range keys {
+				// Long shared prefixes make the comparison walk far into each key
+				keys[i] = []byte(fmt.Sprintf("https://example.com/some/long/path/to/item/%016d", i))
+			}
+			opts := []bwdb.Option{bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithSync(false)}
+			if !check {
+				opts = append(opts, bwdb.WithUnsafeNoOrderCheck())
+			}
+			db, err := bwdb.NewReaderWriterAt(bwdb.NewMemStore(), opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.ResetTimer()
+			for _, key := range keys {
+				if err := db.Add(key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSuffixCompression(t *testing.T) {
+	var recs []string
+	for _, tld := range []string{"com", "net", "org"} {
+		for i := 0; i < 300; i++ {
+			for _, host := range []string{"cdn", "mail", "www"} {
+				recs = append(recs, fmt.Sprintf("%s.example%03d.%s", tld, i, host))
+			}
+		}
+	}
+	// Long records which share most of their bytes, crossing blocks
+	long := strings.Repeat("x", 290)
+	for i := 0; i < 40; i++ {
+		recs = append(recs, fmt.Sprintf("zz%02d%s%02d", i, long, i%3))
+	}
+	slices.Sort(recs)
+
+	for _, options := range [][]bwdb.Option{
+		{bwdb.WithSuffixCompression()},
+		{bwdb.WithSuffixCompression(), bwdb.WithVarint(), bwdb.WithBlockChecksum()},
+	} {
+		rs := recs
+		if len(options) == 1 {
+			// Without varints records are limited to 255 bytes
+			rs = recs[:len(recs)-40]
+		}
+		db, _ := buildDB(t, rs, append(options, bwdb.WithBlockSize(512))...)
+		if got := walkAll(t, db); !reflect.DeepEqual(got, rs) {
+			t.Fatalf("walker returned %d records, expected %d", len(got), len(rs))
+		}
+		var n int
+		for w := db.NewReverseWalker(); w.Scan(); n++ {
+			if want := rs[len(rs)-1-n]; w.Text() != want {
+				t.Fatalf("reverse walker expected %q, got %q", want, w.Text())
+			}
+		}
+		for i := 0; i < len(rs); i += 37 {
+			var got string
+			if err := db.Get([]byte(rs[i]), func(rec []byte) error {
+				got = string(rec)
+				return nil
+			}); err != nil || got != rs[i] {
+				t.Fatalf("Get(%q) returned %q, %v", rs[i], got, err)
+			}
+		}
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()),
+		bwdb.WithSuffixCompression(), bwdb.WithPrefixCompression(false)); err == nil {
+		t.Fatal("expected suffix compression without prefix compression to fail")
+	}
+}
+
+func TestGetBlockBoundary(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("boundary %04d", i))
+	}
+	name := filepath.Join(t.TempDir(), "boundary.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if err := db.Add([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.Index) < 3 {
+		t.Fatalf("expected several blocks, got %d", len(bs.Index))
+	}
+
+	for _, s := range []bwdb.Search{bs, bwdb.LoadInterpolationSearch(bs.Index), bwdb.LoadTrieSearch(bs.Index)} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := bwdb.Open(f, bwdb.WithSearch(s), bwdb.WithBlockSize(256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		// Query exactly the first record of every block after the first
+		for _, key := range bs.Index[1:] {
+			var got []string
+			if err := db.Get(key, func(rec []byte) error {
+				got = append(got, string(rec))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.GetAll(key, func(rec []byte) error {
+				got = append(got, string(rec))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if w := db.NewRangeWalker(key, nil); w.Scan() {
+				got = append(got, w.Text())
+			}
+			if want := []string{string(key), string(key), string(key)}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("query %q: expected %q, got %q", key, want, got)
+			}
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "sync.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 200; i++ {
+		if err := db.Add([]byte(fmt.Sprintf("sync %04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Size() != 0 {
+		t.Fatalf("expected nothing written before the sync, got %v", err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	synced, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(synced) == 0 || len(synced)%256 != 0 {
+		t.Fatalf("expected whole blocks after the sync, got %d bytes", len(synced))
+	}
+
+	if err := db.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	final, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(final, synced) || len(final) <= len(synced) {
+		t.Fatal("expected the synced blocks to begin the finalized file")
+	}
+}
+
+func TestBounds(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("bounds %04d", i+1))
+	}
+	db, bs := buildDB(t, recs, bwdb.WithBlockSize(256))
+	last := len(bs.Index) - 1
+
+	for _, tc := range []struct {
+		needle       string
+		lower, upper []byte
+	}{
+		{"a", nil, bs.Index[0]},
+		{"bounds 0000", nil, bs.Index[0]},
+		{"bounds 0001", bs.Index[0], bs.Index[1]},
+		{string(bs.Index[1]), bs.Index[1], bs.Index[2]},
+		{string(bs.Index[last]), bs.Index[last], nil},
+		{"zzz", bs.Index[last], nil},
+	} {
+		lower, upper, err := db.Bounds([]byte(tc.needle))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(lower, tc.lower) || !bytes.Equal(upper, tc.upper) || (lower == nil) != (tc.lower == nil) {
+			t.Errorf("Bounds(%q) = %q, %q, expected %q, %q", tc.needle, lower, upper, tc.lower, tc.upper)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Add([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add([]byte("a")); !errors.Is(err, bwdb.ErrOutOfOrder) {
+		t.Errorf("expected ErrOutOfOrder, got %v", err)
+	}
+	if err := db.Add(bytes.Repeat([]byte("c"), 256)); !errors.Is(err, bwdb.ErrRecordTooLong) {
+		t.Errorf("expected ErrRecordTooLong, got %v", err)
+	}
+	if err := db.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GetBatch([][]byte{[]byte("b"), []byte("a")}, func(_, _ []byte) error { return nil }); !errors.Is(err, bwdb.ErrOutOfOrder) {
+		t.Errorf("expected ErrOutOfOrder from an unsorted batch, got %v", err)
+	}
+	if err := db.Add([]byte("c")); !errors.Is(err, bwdb.ErrFinalized) {
+		t.Errorf("expected ErrFinalized, got %v", err)
+	}
+	if err := bs.Add([]byte("c")); !errors.Is(err, bwdb.ErrFinalized) {
+		t.Errorf("expected ErrFinalized from the search, got %v", err)
+	}
+
+	// Blocks holding "abc" followed by a broken record
+	for _, tc := range []struct {
+		block []byte
+		want  error
+	}{
+		{[]byte("\x03abc\x05\x01d"), bwdb.ErrBadPrefix},
+		{[]byte("\x03abc\x01\xc8x"), bwdb.ErrRecordTooShort},
+		{[]byte("\x05abc"), bwdb.ErrRecordTooShort},
+	} {
+		// The last block is not padded, so records can run off its end
+		db, err := bwdb.OpenReaderAt(bytes.NewReader(tc.block),
+			bwdb.WithSearch(bwdb.LoadBinarySearch([][]byte{[]byte("abc")})), bwdb.WithBlockSize(256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := db.NewWalker()
+		for w.Scan() {
+		}
+		if !errors.Is(w.Err(), tc.want) {
+			t.Errorf("block %q: expected %v, got %v", tc.block, tc.want, w.Err())
+		}
+	}
+}
+
+func TestWalkerOffset(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("offset %04d", i))
+	}
+	name := filepath.Join(t.TempDir(), "offset.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, rec := range recs {
+		if err := db.Add([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.Index) < 3 {
+		t.Fatalf("expected several blocks, got %d", len(bs.Index))
+	}
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offs []int64
+	var firsts []string
+	w := db.NewWalker()
+	for w.Scan() {
+		off := w.Offset()
+		if len(offs) > 0 && off <= offs[len(offs)-1] {
+			t.Fatalf("offset %d of %q does not follow %d", off, w.Text(), offs[len(offs)-1])
+		}
+		if off%256 == 0 {
+			// The first record of a block is stored whole at its offset
+			got := raw[off : off+1+int64(len(w.Bytes()))]
+			if int(got[0]) != len(w.Bytes()) || string(got[1:]) != w.Text() {
+				t.Fatalf("expected %q at offset %d, got %q", w.Text(), off, got)
+			}
+			firsts = append(firsts, w.Text())
+		}
+		offs = append(offs, off)
+	}
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(offs) != len(recs) {
+		t.Fatalf("expected %d records, got %d", len(recs), len(offs))
+	}
+	var want []string
+	for _, key := range bs.Index {
+		want = append(want, string(key))
+	}
+	if !reflect.DeepEqual(firsts, want) {
+		t.Fatalf("expected block starts %q, got %q", want, firsts)
+	}
+
+	r := db.NewReverseWalker()
+	for i := len(offs) - 1; r.Scan(); i-- {
+		if r.Offset() != offs[i] {
+			t.Fatalf("reverse offset of %q: expected %d, got %d", r.Text(), offs[i], r.Offset())
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "stat.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.Add([]byte(fmt.Sprintf("stat %04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := db.Stat(); st.Index < 1 || st.Blocks != int64(st.Index-1) {
+		t.Fatalf("expected the flushed blocks to trail the index, got %+v", st)
+	}
+	if err := db.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	built := db.Stat()
+	want := bwdb.DBStat{BlockSize: 256, Blocks: int64(len(bs.Index)), Index: len(bs.Index), Records: 500, Search: true}
+	if built != want {
+		t.Fatalf("expected %+v, got %+v", want, built)
+	}
+	db.Close()
+
+	f, err = os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = bwdb.Open(f, bwdb.WithSearch(bwdb.LoadTrieSearch(bs.Index)), bwdb.WithBlockSize(256),
+		bwdb.WithCache(bwdb.NewCacheMap(10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want.Records, want.Cache = -1, true
+	if got := db.Stat(); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	db, err = bwdb.OpenReaderAt(bytes.NewReader(nil), bwdb.WithSearch(bs), bwdb.WithBlockSize(512),
+		bwdb.WithOffset(1024), bwdb.WithByteOffset(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.BlockSize() != 512 || db.Offset() != 1027 {
+		t.Errorf("expected block size 512 at offset 1027, got %d at %d", db.BlockSize(), db.Offset())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("verify %04d", i))
+	}
+	gz, err := bwdb.NewGzipCodec(gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][]bwdb.Option{
+		{bwdb.WithBlockSize(256)},
+		{bwdb.WithBlockSize(256), bwdb.WithBlockChecksum()},
+		{bwdb.WithBlockSize(256), bwdb.WithSuffixCompression()},
+		{bwdb.WithBlockSize(256), bwdb.WithCompression(gz)},
+	} {
+		db, _ := buildDB(t, recs, opts...)
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db, _ := buildDB(t, nil); db.Verify() != nil {
+		t.Fatal(db.Verify())
+	}
+
+	name := filepath.Join(t.TempDir(), "verify.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err == nil {
+		t.Error("expected an error verifying before Finalize")
+	}
+	for _, rec := range recs {
+		if err := db.Add([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	good, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verify opens a copy of the file with one change made to it
+	verify := func(change func(raw []byte), s bwdb.Search) error {
+		raw := bytes.Clone(good)
+		change(raw)
+		db, err := bwdb.OpenReaderAt(bytes.NewReader(raw), bwdb.WithSearch(s), bwdb.WithBlockSize(256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db.Verify()
+	}
+	if err := verify(func([]byte) {}, bs); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func([]byte){
+		"length":  func(raw []byte) { raw[256] = 250 },
+		"order":   func(raw []byte) { raw[257] = 'a' },
+		"padding": func(raw []byte) { raw[511] = 'x' },
+	} {
+		if err := verify(change, bs); err == nil || !strings.Contains(err.Error(), "block 1") && !strings.Contains(err.Error(), "Block 1") {
+			t.Errorf("%s: expected an error naming block 1, got %v", name, err)
+		}
+	}
+	index := append([][]byte{}, bs.Index...)
+	index[2] = []byte("verify 9999")
+	if err := verify(func([]byte) {}, bwdb.LoadBinarySearch(index)); err == nil || !strings.Contains(err.Error(), "block 2") {
+		t.Errorf("expected an error naming block 2, got %v", err)
+	}
+}
+
+func TestWithCompare(t *testing.T) {
+	fold := func(a, b []byte) int {
+		return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+	}
+	var recs []string
+	for i := 0; i < 300; i++ {
+		rec := fmt.Sprintf("key %03d", i)
+		if i%2 == 1 {
+			rec = strings.ToUpper(rec)
+		}
+		recs = append(recs, rec)
+	}
+	// build writes the records to a new file, stopping at the first error
+	build := func(name string, options ...bwdb.Option) (*bwdb.BinarySearch, error) {
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs := bwdb.NewBinarySearch()
+		db, err := bwdb.New(f, append([]bwdb.Option{bwdb.WithSearch(bs), bwdb.WithBlockSize(256)}, options...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for _, rec := range recs {
+			if err := db.Add([]byte(rec)); err != nil {
+				return nil, err
+			}
+		}
+		return bs, db.Finalize()
+	}
+	dir := t.TempDir()
+	if _, err := build(filepath.Join(dir, "bytes.db")); !errors.Is(err, bwdb.ErrOutOfOrder) {
+		t.Fatalf("expected the records to be out of byte order, got %v", err)
+	}
+	name := filepath.Join(dir, "fold.db")
+	bs, err := build(name, bwdb.WithCompare(fold))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A record can not come after a record it is a prefix of, as it could not
+	// be stored or found
+	reverse := func(a, b []byte) int { return bytes.Compare(b, a) }
+	f, err := os.CreateTemp(dir, "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = bwdb.BuildFromSlices(f, [][]byte{[]byte("ab"), []byte("zz"), []byte("abc")},
+		bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithCompare(reverse))
+	if !errors.Is(err, bwdb.ErrOutOfOrder) {
+		t.Errorf("expected %v adding a prefix of the record before, got %v", bwdb.ErrOutOfOrder, err)
+	}
+
+	for _, s := range []bwdb.Search{bwdb.LoadBinarySearch(bs.Index), bwdb.LoadInterpolationSearch(bs.Index)} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := bwdb.Open(f, bwdb.WithSearch(s), bwdb.WithBlockSize(256), bwdb.WithCompare(fold))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if got := walkAll(t, db); !reflect.DeepEqual(got, recs) {
+			t.Fatalf("expected %q, got %q", recs, got)
+		}
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			var got string
+			if err := db.Get([]byte(rec), func(b []byte) error {
+				got = string(b)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if got != rec {
+				t.Fatalf("%T: expected %q, got %q", s, rec, got)
+			}
+		}
+		w := db.NewRangeWalker([]byte("key 100"), []byte("KEY 103"))
+		var got []string
+		for w.Scan() {
+			got = append(got, w.Text())
+		}
+		if want := recs[100:103]; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%T: expected %q, got %q", s, want, got)
+		}
+	}
+
+	if _, err := bwdb.OpenReaderAt(bytes.NewReader(nil), bwdb.WithSearch(bwdb.LoadTrieSearch(bs.Index)), bwdb.WithCompare(fold)); err == nil {
+		t.Error("expected an error using a trie search with a custom comparison")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "readonly.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = bwdb.Open(f, bwdb.WithSearch(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if bwdb.HasWriteBuffers(db) {
+		t.Error("expected no write buffers for an opened wormdb")
+	}
+	if err := db.Add([]byte("b")); !errors.Is(err, bwdb.ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	recs, errc := db.AddChannel(0)
+	recs <- []byte("b")
+	close(recs)
+	if err := <-errc; !errors.Is(err, bwdb.ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from the channel, got %v", err)
+	}
+	if got := walkAll(t, db); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("expected the records to be unchanged, got %q", got)
+	}
+}
+
+func TestWithByteOffset(t *testing.T) {
+	header := []byte("a header of some odd length\n")
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("byte offset %03d", i))
+	}
+	gz, err := bwdb.NewGzipCodec(gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][]bwdb.Option{nil, {bwdb.WithCompression(gz)}, {bwdb.WithMmap()}} {
+		name := filepath.Join(t.TempDir(), "byteoffset.db")
+		if err := os.WriteFile(name, header, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts = append(opts, bwdb.WithBlockSize(256), bwdb.WithByteOffset(int64(len(header))))
+		bs := bwdb.NewBinarySearch()
+		db, err := bwdb.New(f, append(opts, bwdb.WithSearch(bs))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			if err := db.Add([]byte(rec)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(raw, header) {
+			t.Fatalf("expected the header to be kept, got %q", raw[:len(header)])
+		}
+
+		f, err = os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err = bwdb.Open(f, append(opts, bwdb.WithSearch(bs))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if got := walkAll(t, db); !reflect.DeepEqual(got, recs) {
+			t.Fatalf("expected %q, got %q", recs, got)
+		}
+		for _, rec := range recs {
+			var got string
+			if err := db.Get([]byte(rec), func(b []byte) error {
+				got = string(b)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if got != rec {
+				t.Fatalf("expected %q, got %q", rec, got)
+			}
+		}
+		if st := db.Stat(); st.Offset != int64(len(header)) || st.Blocks != int64(len(bs.Index)) {
+			t.Errorf("expected the blocks to follow the header, got %+v", st)
+		}
+		if db.Offset() != int64(len(header)) || db.BlockSize() != 256 {
+			t.Errorf("expected offset %d and block size 256, got %d and %d", len(header), db.Offset(), db.BlockSize())
+		}
+	}
+}
+
+func TestWalkerReset(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("reset %03d", i))
+	}
+	db, _ := buildDB(t, recs, bwdb.WithBlockSize(256))
+	reversed := slices.Clone(recs)
+	slices.Reverse(reversed)
+
+	for _, tc := range []struct {
+		w    *bwdb.Walker
+		want []string
+	}{
+		{db.NewWalker(), recs},
+		{db.NewRangeWalker([]byte("reset 100"), []byte("reset 200")), recs[100:200]},
+		{db.NewReverseWalker(), reversed},
+	} {
+		for pass := 0; pass < 3; pass++ {
+			var got []string
+			for tc.w.Scan() {
+				got = append(got, tc.w.Text())
+				if pass == 1 && len(got) == 10 {
+					// Rewind part way through
+					break
+				}
+			}
+			if err := tc.w.Err(); err != nil {
+				t.Fatal(err)
+			}
+			want := tc.want
+			if pass == 1 {
+				want = want[:10]
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("pass %d: expected %q, got %q", pass, want, got)
+			}
+			tc.w.Reset()
+		}
+	}
+}
+
+func TestWithRecordCount(t *testing.T) {
+	recs := []string{""}
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("count %03d", i))
+	}
+	reversed := slices.Clone(recs)
+	slices.Reverse(reversed)
+	gz, err := bwdb.NewGzipCodec(gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][]bwdb.Option{
+		{bwdb.WithCache(bwdb.NewCacheMap(1000))},
+		{bwdb.WithPrefixCompression(false)},
+		{bwdb.WithSuffixCompression()},
+		{bwdb.WithBlockChecksum()},
+		{bwdb.WithVarint()},
+		{bwdb.WithCompression(gz)},
+	} {
+		db, _ := buildDB(t, recs, append(opts, bwdb.WithBlockSize(256), bwdb.WithRecordCount())...)
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if got := walkAll(t, db); !reflect.DeepEqual(got, recs) {
+			t.Fatalf("expected %q, got %q", recs, got)
+		}
+		var got []string
+		w := db.NewReverseWalker()
+		for w.Scan() {
+			got = append(got, w.Text())
+		}
+		if !reflect.DeepEqual(got, reversed) {
+			t.Fatalf("expected %q, got %q", reversed, got)
+		}
+		// Look every record up twice to also answer from the cache
+		for _, rec := range append(recs, recs...) {
+			var found []string
+			if err := db.Get([]byte(rec), func(b []byte) error {
+				found = append(found, string(b))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(found, []string{rec}) {
+				t.Fatalf("get %q: expected a match, got %q", rec, found)
+			}
+		}
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Add(nil); err == nil {
+		t.Error("expected an error adding an empty record without a record count")
+	}
+}
+
+func TestGetWithSector(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("sector %03d", i))
+	}
+	db, bs := buildDB(t, recs, bwdb.WithBlockSize(256), bwdb.WithCache(bwdb.NewCacheMap(1000)))
+	if len(bs.Index) < 3 {
+		t.Fatalf("expected several blocks, got %d", len(bs.Index))
+	}
+
+	// Look every record up twice to also answer from the cache
+	for _, rec := range append(recs, recs...) {
+		var got []string
+		sector := -1
+		if err := db.GetWithSector([]byte(rec), func(b []byte, n int) error {
+			got, sector = append(got, string(b)), n
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, []string{rec}) {
+			t.Fatalf("expected %q, got %q", rec, got)
+		}
+		if sector < 0 || sector >= len(bs.Index) || string(bs.Index[sector]) > rec ||
+			sector+1 < len(bs.Index) && string(bs.Index[sector+1]) <= rec {
+			t.Fatalf("record %q is not held by sector %d", rec, sector)
+		}
+	}
+	if err := db.GetWithSector([]byte("missing"), func([]byte, int) error {
+		t.Error("expected no match")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// plainFS hides any ReadAt method of the files it opens.
+type plainFS struct{ fs.FS }
+
+func (p plainFS) Open(name string) (fs.File, error) {
+	f, err := p.FS.Open(name)
+	return struct{ fs.File }{f}, err
+}
+
+func TestOpenFS(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("fs %03d", i))
+	}
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "fs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if err := db.Add([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "fs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fsys := range []fs.FS{os.DirFS(dir), fstest.MapFS{"fs.db": {Data: raw}}, plainFS{os.DirFS(dir)}} {
+		db, err := bwdb.OpenFS(fsys, "fs.db", bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := walkAll(t, db); !reflect.DeepEqual(got, recs) {
+			t.Fatalf("%T: expected %q, got %q", fsys, recs, got)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bwdb.OpenFS(os.DirFS(dir), "missing.db", bwdb.WithSearch(bs)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+}
+
+func TestWithReadAhead(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("read ahead %03d", i))
+	}
+	name := filepath.Join(t.TempDir(), "ahead.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256), bwdb.WithBlockChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if err := db.Add([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := len(raw) / 256
+
+	// Read ahead by more than, less than and a divisor of the blocks
+	for _, ahead := range []int{1, 3, blocks, blocks + 5} {
+		r := &countingReaderAt{ReaderAt: bytes.NewReader(raw)}
+		db, err := bwdb.OpenReaderAt(r, bwdb.WithSearch(bs), bwdb.WithBlockSize(256), bwdb.WithBlockChecksum(),
+			bwdb.WithReadAhead(ahead))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := walkAll(t, db); !reflect.DeepEqual(got, recs) {
+			t.Fatalf("read ahead %d: expected %q, got %q", ahead, recs, got)
+		}
+		if want := (blocks + ahead - 1) / ahead; r.reads > want+1 {
+			t.Errorf("read ahead %d: expected about %d reads, got %d", ahead, want, r.reads)
+		}
+
+		w := db.NewRangeWalker([]byte("read ahead 250"), nil)
+		var got []string
+		for w.Scan() {
+			got = append(got, w.Text())
+		}
+		if err := w.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, recs[250:]) {
+			t.Fatalf("read ahead %d: expected %q, got %q", ahead, recs[250:], got)
+		}
+	}
+}
+
+func TestFindNearest(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("near %03d", i*2))
+	}
+	db, bs := buildDB(t, recs, bwdb.WithBlockSize(256))
+	if len(bs.Index) < 3 {
+		t.Fatalf("expected several blocks, got %d", len(bs.Index))
+	}
+
+	for _, tc := range []struct {
+		needle, want string
+		exact        bool
+	}{
+		{"a", "near 000", false},        // Before the first
+		{"near", "near 000", false},     // A prefix of the first
+		{"near 000", "near 000", true},  // The first
+		{"near 001", "near 000", false}, // Between records
+		{"near 100", "near 100", true},
+		{"near 101", "near 100", false},
+		{string(bs.Index[1]), string(bs.Index[1]), true}, // Start of a block
+		{string(bs.Index[1]) + "x", string(bs.Index[1]), false},
+		{"near 598", "near 598", true}, // The last
+		{"near 599", "near 598", false},
+		{"z", "near 598", false}, // After the last
+	} {
+		rec, exact, err := db.FindNearest([]byte(tc.needle))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rec) != tc.want || exact != tc.exact {
+			t.Errorf("nearest %q: expected %q %v, got %q %v", tc.needle, tc.want, tc.exact, rec, exact)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("truncated %03d", i))
+	}
+	name := filepath.Join(t.TempDir(), "truncated.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.New(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if err := db.Add([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Cut the file off at the start of the last block
+	if err := os.Truncate(name, int64(len(bs.Index)-1)*256); err != nil {
+		t.Fatal(err)
+	}
+
+	last := []byte(recs[len(recs)-1])
+	for _, opts := range [][]bwdb.Option{nil, {bwdb.WithMmap()}} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := bwdb.Open(f, append(opts, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		handler := func([]byte) error { return nil }
+		if err := db.Get(last, handler); !errors.Is(err, bwdb.ErrTruncated) {
+			t.Errorf("expected ErrTruncated from Get, got %v", err)
+		}
+		if err := db.GetAll(last, handler); !errors.Is(err, bwdb.ErrTruncated) {
+			t.Errorf("expected ErrTruncated from GetAll, got %v", err)
+		}
+		if _, _, err := db.FindNearest(last); !errors.Is(err, bwdb.ErrTruncated) {
+			t.Errorf("expected ErrTruncated from FindNearest, got %v", err)
+		}
+		// Records before the cut are still found
+		if err := db.Get([]byte(recs[0]), handler); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "empty.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	searches := map[string]func() bwdb.Search{
+		"binary":        func() bwdb.Search { return bwdb.LoadBinarySearch(nil) },
+		"interpolation": func() bwdb.Search { return bwdb.LoadInterpolationSearch(nil) },
+		"built binary": func() bwdb.Search {
+			s := bwdb.NewBinarySearch()
+			s.Finalize()
+			return s
+		},
+		"built trie": func() bwdb.Search {
+			s := bwdb.NewTrieSearch()
+			s.Finalize()
+			return s
+		},
+	}
+	for sname, search := range searches {
+		t.Run(sname, func(t *testing.T) {
+			s := search()
+			if pos, lower, exact := s.Find([]byte("abc")); pos != 0 || lower != nil || exact {
+				t.Errorf("Find = %d, %q, %v", pos, lower, exact)
+			}
+			if pos, lower, upper, exact := s.FindBounds([]byte("abc")); pos != 0 || lower != nil || upper != nil || exact {
+				t.Errorf("FindBounds = %d, %q, %q, %v", pos, lower, upper, exact)
+			}
+
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := bwdb.Open(f, bwdb.WithSearch(s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			found := func([]byte) error {
+				t.Error("handler called on an empty wormdb")
+				return nil
+			}
+			for _, needle := range []string{"", "abc"} {
+				if err := db.Get([]byte(needle), found); err != nil {
+					t.Errorf("Get(%q): %v", needle, err)
+				}
+				if err := db.GetAll([]byte(needle), found); err != nil {
+					t.Errorf("GetAll(%q): %v", needle, err)
+				}
+				if rec, exact, err := db.FindNearest([]byte(needle)); rec != nil || exact || err != nil {
+					t.Errorf("FindNearest(%q) = %q, %v, %v", needle, rec, exact, err)
+				}
+				if lower, upper, err := db.Bounds([]byte(needle)); lower != nil || upper != nil || err != nil {
+					t.Errorf("Bounds(%q) = %q, %q, %v", needle, lower, upper, err)
+				}
+			}
+			err = db.GetBatch([][]byte{[]byte("a"), []byte("b")}, func(needle, rec []byte) error {
+				t.Errorf("batch handler called for %q on an empty wormdb", needle)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			if got := walkAll(t, db); len(got) != 0 {
+				t.Errorf("walked %q", got)
+			}
+		})
+	}
+}
+
+func TestGetSource(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("source %03d", i))
+	}
+	db, bs := buildDB(t, recs, bwdb.WithBlockSize(256), bwdb.WithCache(bwdb.NewCacheMap(1000)))
+	mid := recs[slices.Index(recs, string(bs.Index[1]))+1]
+
+	for _, tc := range []struct {
+		needle string
+		want   bwdb.Source
+		found  bool
+	}{
+		{string(bs.Index[1]), bwdb.SourceIndexExact, true},
+		{string(bs.Index[1]), bwdb.SourceCache, true},
+		{mid, bwdb.SourceDisk, true},
+		{mid, bwdb.SourceCache, true},
+		{"source 5", bwdb.SourceMiss, false},
+		{"source 5", bwdb.SourceCache, false},
+		{"a", bwdb.SourceMiss, false},
+	} {
+		var found bool
+		src, err := db.GetSource([]byte(tc.needle), func([]byte) error {
+			found = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src != tc.want || found != tc.found {
+			t.Errorf("GetSource(%q) = %v found %v, want %v found %v", tc.needle, src, found, tc.want, tc.found)
+		}
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	for _, level := range []slog.Level{slog.LevelDebug, slog.LevelInfo} {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: level}))
+		db, _ := buildDB(t, []string{"logged a", "logged b"},
+			bwdb.WithCache(bwdb.NewCacheMap(10)), bwdb.WithLogger(logger.With("db", "test")))
+		if err := db.Get([]byte("logged b"), func([]byte) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		got := buf.String()
+		if level == slog.LevelDebug {
+			if !strings.Contains(got, `msg="Querying cache for \"logged b\""`) || !strings.Contains(got, "db=test") {
+				t.Errorf("expected the cache query to be logged, got %q", got)
+			}
+		} else if got != "" {
+			t.Errorf("expected nothing logged above debug level, got %q", got)
+		}
+	}
+}
+
+func TestGetBuf(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("buffer %03d", i))
+	}
+	for _, opts := range [][]bwdb.Option{nil, {bwdb.WithCache(bwdb.NewCacheMap(4))}} {
+		db, _ := buildDB(t, recs, append(opts, bwdb.WithBlockSize(256))...)
+
+		// Hold on to several records at once while the cache churns
+		var (
+			held     [][]byte
+			want     []string
+			releases []func()
+		)
+		check := func() {
+			for i, release := range releases {
+				if string(held[i]) != want[i] {
+					t.Fatalf("held record %q changed to %q", want[i], held[i])
+				}
+				release()
+			}
+			held, want, releases = nil, nil, nil
+		}
+		for _, rec := range append(recs, recs...) {
+			got, release, err := db.GetBuf([]byte(rec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			held, want, releases = append(held, got), append(want, rec), append(releases, release)
+			if len(held) == 8 {
+				check()
+			}
+		}
+		check()
+
+		got, release, err := db.GetBuf([]byte("missing"))
+		release()
+		if got != nil || err != nil {
+			t.Errorf("GetBuf(missing) = %q, %v", got, err)
+		}
+	}
+}
+
+func TestWalkParallel(t *testing.T) {
+	var recs []string
+	for i := 0; i < 3000; i++ {
+		recs = append(recs, fmt.Sprintf("parallel %04d", i))
+	}
+	db, _ := buildDB(t, recs, bwdb.WithBlockSize(256))
+
+	for _, workers := range []int{0, 1, 3, 8, 1000} {
+		var (
+			mu  sync.Mutex
+			got []string
+		)
+		err := db.WalkParallel(workers, func(rec []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, string(rec))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, recs) {
+			t.Fatalf("%d workers walked %d records, want %d", workers, len(got), len(recs))
+		}
+	}
+
+	stop := errors.New("stop")
+	err := db.WalkParallel(4, func(rec []byte) error {
+		if string(rec) == recs[2000] {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("expected the error from fn, got %v", err)
+	}
+}
+
+// syncCounter counts the calls to Sync of the file it wraps.
+type syncCounter struct {
+	*os.File
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return s.File.Sync()
+}
+
+func TestWithSync(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		name := filepath.Join(t.TempDir(), "sync.db")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := &syncCounter{File: f}
+		bs := bwdb.NewBinarySearch()
+		db, err := bwdb.NewReaderWriterAt(sc, bwdb.WithSearch(bs), bwdb.WithBlockSize(256), bwdb.WithSync(enabled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recs []string
+		for i := 0; i < 200; i++ {
+			recs = append(recs, fmt.Sprintf("sync %04d", i))
+			if err := db.Add([]byte(recs[i])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]int{true: 1, false: 0}[enabled]; sc.syncs != want {
+			t.Errorf("WithSync(%v) synced %d times, want %d", enabled, sc.syncs, want)
+		}
+
+		// Close must still have written every record out
+		f, err = os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err = bwdb.Open(f, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := walkAll(t, db); !slices.Equal(got, recs) {
+			t.Errorf("WithSync(%v) walked %d records, want %d", enabled, len(got), len(recs))
+		}
+		db.Close()
+	}
+}
+
+func TestFindWithPos(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("position %03d", i))
+	}
+	for _, opts := range [][]bwdb.Option{nil, {bwdb.WithRecordCount()}} {
+		db, _ := buildDB(t, recs, append(opts, bwdb.WithBlockSize(256))...)
+		w := db.NewWalker()
+		for w.Scan() {
+			rec, block, intra, err := db.FindWithPos(w.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rec, w.Bytes()) {
+				t.Fatalf("FindWithPos(%q) found %q", w.Bytes(), rec)
+			}
+			if off := int64(block)*256 + int64(intra); off != w.Offset() {
+				t.Fatalf("FindWithPos(%q) = block %d at %d, walker is at %d", rec, block, intra, w.Offset())
+			}
+		}
+		if err := w.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec, err := db.Find([]byte("position 12")); err != nil || string(rec) != "position 120" {
+			t.Errorf("Find = %q, %v", rec, err)
+		}
+		if rec, block, intra, err := db.FindWithPos([]byte("missing")); rec != nil || block != -1 || intra != -1 || err != nil {
+			t.Errorf("FindWithPos(missing) = %q, %d, %d, %v", rec, block, intra, err)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	recs := []string{""}
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("lookup %03d", i))
+	}
+	db, _ := buildDB(t, recs, bwdb.WithBlockSize(256), bwdb.WithRecordCount())
+	for _, rec := range recs {
+		got, found, err := db.Lookup([]byte(rec))
+		if err != nil || !found || string(got) != rec {
+			t.Fatalf("Lookup(%q) = %q, %v, %v", rec, got, found, err)
+		}
+	}
+	if got, found, err := db.Lookup(nil); got == nil || len(got) != 0 || !found || err != nil {
+		t.Errorf("Lookup(empty) = %q, %v, %v", got, found, err)
+	}
+	if got, found, err := db.Lookup([]byte("missing")); got != nil || found || err != nil {
+		t.Errorf("Lookup(missing) = %q, %v, %v", got, found, err)
+	}
+}
+
+func TestWithMaxSize(t *testing.T) {
+	codec, err := bwdb.NewGzipCodec(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][]bwdb.Option{nil, {bwdb.WithCompression(codec)}} {
+		name := filepath.Join(t.TempDir(), "max.db")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts = append(opts, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithBlockSize(256), bwdb.WithMaxSize(1024))
+		db, err := bwdb.New(f, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; err == nil; i++ {
+			if i == 100000 {
+				t.Fatal("expected the size limit to be hit")
+			}
+			err = db.Add([]byte(fmt.Sprintf("max size %06d %x", i, i*7919)))
+		}
+		if !errors.Is(err, bwdb.ErrMaxSizeExceeded) {
+			t.Fatalf("expected ErrMaxSizeExceeded, got %v", err)
+		}
+		db.Close()
+		if fi, err := os.Stat(name); err != nil || fi.Size() > 1024 {
+			t.Fatalf("expected the file to stay within the limit, got %d bytes, %v", fi.Size(), err)
+		}
+	}
+}
+
+func TestWithMergeTrace(t *testing.T) {
+	// Records are key:value and the newest value for a key wins
+	comp := func(a, b []byte) int {
+		ka, _, _ := bytes.Cut(a, []byte(":"))
+		kb, _, _ := bytes.Cut(b, []byte(":"))
+		if bytes.Equal(ka, kb) {
+			return 2
+		}
+		return bytes.Compare(ka, kb)
+	}
+
+	var sources []*bwdb.DB
+	for s := 0; s < 3; s++ {
+		var recs []string
+		for i := s; i < 100; i += s + 1 {
+			recs = append(recs, fmt.Sprintf("k%03d:s%d", i, s))
+		}
+		db, _ := buildDB(t, recs, bwdb.WithBlockSize(256))
+		sources = append(sources, db)
+	}
+	var added []string
+	for i := 0; i < 100; i += 10 {
+		added = append(added, fmt.Sprintf("k%03d:s3", i))
+	}
+
+	traced := make(map[string]int)
+	db, _ := buildDB(t, added, bwdb.WithBlockSize(256), bwdb.WithMergeN(sources, comp),
+		bwdb.WithMergeTrace(func(rec []byte, src int) {
+			traced[string(rec)] = src
+		}))
+	got := walkAll(t, db)
+	if len(traced) != len(got) {
+		t.Fatalf("traced %d records, wrote %d", len(traced), len(got))
+	}
+	for _, rec := range got {
+		var want int
+		fmt.Sscanf(rec[strings.IndexByte(rec, 's')+1:], "%d", &want)
+		if src, ok := traced[rec]; !ok || src != want {
+			t.Errorf("record %q traced to source %d, want %d", rec, src, want)
+		}
+	}
+}
+
+func TestPreferIncoming(t *testing.T) {
+	old, _ := buildDB(t, []string{"a", "b", "d"})
+	for _, tc := range []struct {
+		comp bwdb.CompareFunc
+		want map[string]int
+	}{
+		{bwdb.PreferIncoming, map[string]int{"a": 0, "b": 1, "c": 1, "d": 1}},
+		{bwdb.PreferExisting, map[string]int{"a": 0, "b": 0, "c": 1, "d": 0}},
+	} {
+		traced := make(map[string]int)
+		db, _ := buildDB(t, []string{"b", "c", "d"}, bwdb.WithMerge(old, tc.comp),
+			bwdb.WithMergeTrace(func(rec []byte, src int) {
+				traced[string(rec)] = src
+			}))
+		if got := walkAll(t, db); !slices.Equal(got, []string{"a", "b", "c", "d"}) {
+			t.Fatalf("walked %q", got)
+		}
+		if !reflect.DeepEqual(traced, tc.want) {
+			t.Errorf("expected the records from %v, got %v", tc.want, traced)
+		}
+	}
+}
+
+func TestMergeEmptyRecord(t *testing.T) {
+	// The empty first record of the old wormdb must not be taken for a walk
+	// which has not started
+	old, _ := buildDB(t, []string{"", "b", "d"}, bwdb.WithRecordCount())
+	for _, tc := range []struct {
+		comp   bwdb.CompareFunc
+		added  []string
+		want   []string
+		traced map[string]int
+	}{
+		{bwdb.PreferIncoming, nil, []string{"", "b", "d"},
+			map[string]int{"": 0, "b": 0, "d": 0}},
+		{bwdb.PreferIncoming, []string{"", "c"}, []string{"", "b", "c", "d"},
+			map[string]int{"": 1, "b": 0, "c": 1, "d": 0}},
+		{bwdb.PreferExisting, []string{"", "c"}, []string{"", "b", "c", "d"},
+			map[string]int{"": 0, "b": 0, "c": 1, "d": 0}},
+		{bwdb.PreferExisting, []string{"a"}, []string{"", "a", "b", "d"},
+			map[string]int{"": 0, "a": 1, "b": 0, "d": 0}},
+	} {
+		traced := make(map[string]int)
+		db, _ := buildDB(t, tc.added, bwdb.WithRecordCount(), bwdb.WithMerge(old, tc.comp),
+			bwdb.WithMergeTrace(func(rec []byte, src int) {
+				traced[string(rec)] = src
+			}))
+		if got := walkAll(t, db); !slices.Equal(got, tc.want) {
+			t.Fatalf("adding %q, expected %q, walked %q", tc.added, tc.want, got)
+		}
+		if !reflect.DeepEqual(traced, tc.traced) {
+			t.Errorf("adding %q, expected the records from %v, got %v", tc.added, tc.traced, traced)
+		}
+	}
+
+	// Keeping both of two equal records leaves the empty old record to be
+	// written when finalizing, which is out of order rather than dropped
+	keepBoth := func(a, b []byte) int {
+		if c := bytes.Compare(a, b); c != 0 {
+			return c
+		}
+		return bwdb.BFirst
+	}
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithRecordCount(),
+		bwdb.WithMerge(old, keepBoth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Add(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Finalize(); !errors.Is(err, bwdb.ErrMergeOrder) {
+		t.Errorf("expected Finalize to return %v, got %v", bwdb.ErrMergeOrder, err)
+	}
+}
+
+func TestGetExact(t *testing.T) {
+	db, _ := buildDB(t, []string{"hello world", "help", "helpful", "zebra"},
+		bwdb.WithCache(bwdb.NewCacheMap(10)))
+	for _, tc := range []struct {
+		key  string
+		want []string
+	}{
+		{"hello", nil},
+		{"hello world", []string{"hello world"}},
+		{"help", []string{"help"}},
+		{"helpful", []string{"helpful"}},
+		{"zeb", nil},
+		{"zebra", []string{"zebra"}},
+	} {
+		// Twice to also answer from the cache
+		for i := 0; i < 2; i++ {
+			var got []string
+			if err := db.GetExact([]byte(tc.key), func(rec []byte) error {
+				got = append(got, string(rec))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("GetExact(%q) = %q, want %q", tc.key, got, tc.want)
+			}
+		}
+	}
+}
+
+func BenchmarkGetLargeRecords(b *testing.B) {
+	var recs []string
+	for i := 0; i < 200; i++ {
+		recs = append(recs, fmt.Sprintf("large %03d ", i)+strings.Repeat("x", 1500))
+	}
+	for _, hint := range []int{0, 2048} {
+		b.Run(fmt.Sprint("hint=", hint), func(b *testing.B) {
+			db, bs := buildDB(b, recs, bwdb.WithVarint(), bwdb.WithBlockSize(8192), bwdb.WithRecordBufferHint(hint))
+			if len(bs.Index) < 2 {
+				b.Fatal("expected several blocks")
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Miss the index so each lookup decodes a block
+				needle := []byte(recs[i%len(recs)][:10])
+				if err := db.Get(needle, func([]byte) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWithFilter(t *testing.T) {
+	var recs, kept []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("filter %03d", i))
+		if i%3 != 0 {
+			kept = append(kept, recs[i])
+		}
+	}
+	old, _ := buildDB(t, recs, bwdb.WithBlockSize(256))
+	keep := func(rec []byte) bool {
+		var i int
+		fmt.Sscanf(string(rec), "filter %d", &i)
+		return i%3 != 0
+	}
+
+	db, _ := buildDB(t, nil, bwdb.WithBlockSize(256), bwdb.WithFilter(old, keep))
+	if got := walkAll(t, db); !slices.Equal(got, kept) {
+		t.Fatalf("filtered to %d records, want %d", len(got), len(kept))
+	}
+
+	// Added records are merged in without being filtered
+	added := []string{"filter 000a", "filter 300", "filter 999"}
+	want := append(slices.Clone(kept), added...)
+	slices.Sort(want)
+	want = slices.Compact(want)
+	db, _ = buildDB(t, added, bwdb.WithBlockSize(256), bwdb.WithFilter(old, keep))
+	if got := walkAll(t, db); !slices.Equal(got, want) {
+		t.Fatalf("filtered and merged to %d records, want %d", len(got), len(want))
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Add([]byte("held"))
+	db.Finalize()
+
+	get := func() error {
+		return db.Get([]byte("held"), func(rec []byte) error {
+			if string(rec) != "held" {
+				t.Errorf("got %q, want %q", rec, "held")
+			}
+			return nil
+		})
+	}
+
+	release := db.Acquire()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Stat(); err != nil {
+		t.Fatalf("file closed while held: %v", err)
+	}
+	if err := get(); err != nil {
+		t.Fatalf("Get while held: %v", err)
+	}
+
+	release()
+	release() // Releasing twice is harmless
+	if _, err := f.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("file not closed after release: %v", err)
+	}
+	if err := get(); !errors.Is(err, bwdb.ErrClosed) {
+		t.Fatalf("Get after close: got %v, want %v", err, bwdb.ErrClosed)
+	}
+	db.Acquire()()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseWhileReading(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("reading %04d", i))
+	}
+	// open builds a wormdb of the records, returning its file to check on
+	open := func() (*bwdb.DB, *os.File) {
+		f, err := os.CreateTemp(t.TempDir(), "*.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithBlockSize(256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			if err := db.Add([]byte(rec)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Finalize(); err != nil {
+			t.Fatal(err)
+		}
+		return db, f
+	}
+	isOpen := func(f *os.File) bool {
+		_, err := f.Stat()
+		return err == nil
+	}
+
+	// A walk keeps the file open until it ends
+	db, f := open()
+	w := db.NewWalker()
+	var n int
+	for ; w.Scan(); n++ {
+		if n == 10 {
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n >= 10 && !isOpen(f) {
+			t.Fatalf("file closed during the walk at %q", w.Text())
+		}
+	}
+	if err := w.Err(); err != nil || n != len(recs) {
+		t.Fatalf("walked %d records with %v, want %d", n, err, len(recs))
+	}
+	if isOpen(f) {
+		t.Fatal("file not closed once the walk ended")
+	}
+	if w := db.NewWalker(); w.Scan() || !errors.Is(w.Err(), bwdb.ErrClosed) {
+		t.Errorf("walk after close: got %v, want %v", w.Err(), bwdb.ErrClosed)
+	}
+
+	// A walk left early is let go of with Release
+	db, f = open()
+	w = db.NewWalker()
+	w.Scan()
+	db.Close()
+	if !isOpen(f) {
+		t.Fatal("file closed during the walk")
+	}
+	w.Release()
+	if isOpen(f) {
+		t.Fatal("file not closed once the walk was released")
+	}
+
+	// As does GetAll until it returns
+	db, f = open()
+	n = 0
+	if err := db.GetAll([]byte("reading 0"), func(rec []byte) error {
+		if n++; n == 1 {
+			db.Close()
+		}
+		if !isOpen(f) {
+			t.Fatalf("file closed during GetAll at %q", rec)
+		}
+		return nil
+	}); err != nil || n != len(recs) {
+		t.Fatalf("GetAll found %d records with %v, want %d", n, err, len(recs))
+	}
+	if isOpen(f) {
+		t.Fatal("file not closed once GetAll returned")
+	}
+	if err := db.GetAll([]byte("reading"), func([]byte) error { return nil }); !errors.Is(err, bwdb.ErrClosed) {
+		t.Errorf("GetAll after close: got %v, want %v", err, bwdb.ErrClosed)
+	}
+	if _, _, err := db.FindNearest([]byte("reading")); !errors.Is(err, bwdb.ErrClosed) {
+		t.Errorf("FindNearest after close: got %v, want %v", err, bwdb.ErrClosed)
+	}
+	if err := db.WalkParallel(2, func([]byte) error { return nil }); !errors.Is(err, bwdb.ErrClosed) {
+		t.Errorf("WalkParallel after close: got %v, want %v", err, bwdb.ErrClosed)
+	}
+}
+
+func ExampleDB_Acquire() {
+	open := func(name string, recs ...string) *bwdb.DB {
+		f, err := os.Create(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, rec := range recs {
+			db.Add([]byte(rec))
+		}
+		db.Finalize()
+		return db
+	}
+
+	var current atomic.Pointer[bwdb.DB]
+	current.Store(open("swap_old.db", "fruit apple"))
+
+	// A reader holds whichever wormdb is current for as long as it needs it.
+	// Checking the pointer again after Acquire makes sure the wormdb was not
+	// swapped out and closed in between.
+	lookup := func(needle string) {
+		for {
+			db := current.Load()
+			release := db.Acquire()
+			if current.Load() != db {
+				release()
+				continue
+			}
+			db.Get([]byte(needle), func(rec []byte) error {
+				fmt.Printf("found: %s\n", rec)
+				return nil
+			})
+			release()
+			return
+		}
+	}
+	lookup("fruit")
+
+	// Swap in a rebuilt wormdb; the old file closes once its readers are done.
+	old := current.Swap(open("swap_new.db", "fruit banana"))
+	old.Close()
+	lookup("fruit")
+	current.Load().Close()
+	// Output:
+	// found: fruit apple
+	// found: fruit banana
+}
+
+func TestWithPadByte(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("pad %04d", i*7))
+	}
+	for _, opts := range [][]bwdb.Option{
+		{},
+		{bwdb.WithBlockChecksum()},
+		{bwdb.WithSuffixCompression(), bwdb.WithRecordCount()},
+	} {
+		name := filepath.Join(t.TempDir(), "pad.db")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts = append(opts, bwdb.WithBlockSize(256))
+		bs := bwdb.NewBinarySearch()
+		db, err := bwdb.New(f, append(opts, bwdb.WithSearch(bs), bwdb.WithPadByte(0xaa))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			if err := db.Add([]byte(rec)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Each block is padded after the two zeros which end its records
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var padded int
+		for off := 0; off+256 <= len(raw); off += 256 {
+			block := raw[off : off+256]
+			if i := bytes.IndexByte(block, 0xaa); i >= 0 {
+				end := bytes.LastIndexByte(block, 0xaa) + 1
+				if !bytes.Equal(block[i-2:i], []byte{0, 0}) || bytes.Count(block[i:end], []byte{0xaa}) != end-i {
+					t.Fatalf("block at %d is not padded after its records: % x", off, block)
+				}
+				padded++
+			}
+		}
+		if padded == 0 {
+			t.Fatal("no block was padded")
+		}
+
+		// Reading does not need the option, only Verify does
+		f, err = os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err = bwdb.Open(f, append(opts, bwdb.WithSearch(bwdb.LoadBinarySearch(bs.Index)))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := walkAll(t, db); !slices.Equal(got, recs) {
+			t.Fatalf("walked %d records, want %d", len(got), len(recs))
+		}
+		if err := db.Verify(); err == nil {
+			t.Error("expected Verify to fail without the pad byte")
+		}
+		db.Close()
+		f, err = os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err = bwdb.Open(f, append(opts, bwdb.WithSearch(bwdb.LoadBinarySearch(bs.Index)), bwdb.WithPadByte(0xaa))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+}
+
+func TestSuggestBlockSize(t *testing.T) {
+	if got := bwdb.SuggestBlockSize(nil, 0); got != 4096 {
+		t.Errorf("empty sample = %d, want 4096", got)
+	}
+
+	var (
+		recs []string
+		keys [][]byte
+	)
+	for i := 0; i < 100000; i++ {
+		recs = append(recs, fmt.Sprintf("https://example.com/item/%08d", i*13))
+		keys = append(keys, []byte(recs[i]))
+	}
+	prev := 1 << 30
+	for _, budget := range []int{1 << 8, 1 << 10, 1 << 12, 1 << 14, 1 << 22} {
+		size := bwdb.SuggestBlockSize(keys, budget)
+		if size&(size-1) != 0 || size < 4096 || size > 1<<20 {
+			t.Fatalf("budget %d gave block size %d", budget, size)
+		}
+		if size > prev {
+			t.Errorf("budget %d gave block size %d, larger than %d for a smaller budget", budget, size, prev)
+		}
+		prev = size
+
+		// The index of a wormdb built at that size keeps within the budget
+		_, bs := buildDB(t, recs, bwdb.WithBlockSize(size))
+		var used int
+		for _, entry := range bs.Index {
+			used += len(entry) + 24
+		}
+		if size > 4096 && size < 1<<20 && used > budget {
+			t.Errorf("budget %d gave block size %d with an index of %d bytes", budget, size, used)
+		}
+	}
+
+	// The longest key must fit
+	if got := bwdb.SuggestBlockSize([][]byte{bytes.Repeat([]byte("x"), 5000)}, 1<<30); got != 8192 {
+		t.Errorf("long key gave block size %d, want 8192", got)
+	}
+}
+
+func TestSkipBlocks(t *testing.T) {
+	var recs []string
+	for i := 0; i < 600; i++ {
+		recs = append(recs, fmt.Sprintf("skip %04d", i))
+	}
+	db, bs := buildDB(t, recs, bwdb.WithBlockSize(256))
+	blocks := len(bs.Index)
+	if blocks < 8 {
+		t.Fatalf("expected several blocks, got %d", blocks)
+	}
+	first := func(n int) string { return string(bs.Index[n]) }
+
+	w := db.NewWalker()
+	if !w.SkipBlocks(3) || !w.Scan() || w.Text() != first(3) {
+		t.Fatalf("skipping 3 blocks from the start got %q, want %q", w.Text(), first(3))
+	}
+	w.Scan()
+	if !w.SkipBlocks(2) || !w.Scan() || w.Text() != first(5) {
+		t.Fatalf("skipping 2 blocks got %q, want %q", w.Text(), first(5))
+	}
+	if !w.SkipBlocks(0) || !w.Scan() || w.Text() != first(5) {
+		t.Fatalf("skipping no blocks got %q, want %q", w.Text(), first(5))
+	}
+	if w.SkipBlocks(blocks) || w.Scan() || w.Err() != nil {
+		t.Fatalf("skipping past the end: %v", w.Err())
+	}
+
+	// Sample the first record of every other block
+	var got, want []string
+	for i := 0; i < blocks; i += 2 {
+		want = append(want, first(i))
+	}
+	for w = db.NewWalker(); w.Scan(); {
+		got = append(got, w.Text())
+		if !w.SkipBlocks(2) {
+			break
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("sampled %q, want %q", got, want)
+	}
+
+	// A reverse walker resumes from the last record of the block
+	w = db.NewReverseWalker()
+	w.Scan()
+	if !w.SkipBlocks(1) || !w.Scan() {
+		t.Fatal("reverse skip failed")
+	}
+	next := slices.Index(recs, first(blocks-1))
+	if w.Text() != recs[next-1] {
+		t.Fatalf("reverse skip got %q, want %q", w.Text(), recs[next-1])
+	}
+	if w.SkipBlocks(blocks) || w.Scan() {
+		t.Fatal("expected reverse skip past the start to fail")
+	}
+}
+
+func TestBuildStats(t *testing.T) {
+	var recs []string
+	for i := 0; i < 600; i++ {
+		recs = append(recs, fmt.Sprintf("stats %04d", i))
+	}
+	db, bs := buildDB(t, recs, bwdb.WithBlockSize(256), bwdb.WithBlockChecksum())
+	st := db.BuildStats()
+	if st.Blocks != int64(len(bs.Index)) || st.Records != int64(len(recs)) {
+		t.Fatalf("counted %d blocks and %d records, want %d and %d", st.Blocks, st.Records, len(bs.Index), len(recs))
+	}
+	// Every block is padded out, holding a 4 byte checksum at its end
+	if filled := float64(st.Blocks*(256-4) - st.Padding); st.Padding <= 0 || st.Fill != filled/float64(st.Blocks*(256-4)) {
+		t.Errorf("padding %d gives a fill of %v", st.Padding, st.Fill)
+	}
+	// Neighbours share "stats 0" and mostly the next digit or two
+	if st.AvgPrefix < 8 || st.AvgPrefix > 10 {
+		t.Errorf("average prefix of %v", st.AvgPrefix)
+	}
+
+	db, _ = buildDB(t, recs, bwdb.WithBlockSize(256), bwdb.WithPrefixCompression(false))
+	if st := db.BuildStats(); st.AvgPrefix != 0 || st.Fill <= 0 || st.Fill > 1 {
+		t.Errorf("without prefix compression got %+v", st)
+	}
+	if st := (&bwdb.DB{}).BuildStats(); st != (bwdb.BuildStats{}) {
+		t.Errorf("empty wormdb got %+v", st)
+	}
+}
+
+// fullDisk fails every write past its limit, as a disk which has filled up.
+type fullDisk struct {
+	*os.File
+	limit  int64
+	closed bool
+}
+
+func (f *fullDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > f.limit {
+		return 0, errors.New("no space left on device")
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *fullDisk) Close() error {
+	f.closed = true
+	return f.File.Close()
+}
+
+func TestCloseFlushError(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "full.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := &fullDisk{File: f, limit: 512}
+	db, err := bwdb.NewReaderWriterAt(disk, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The records are held in the write buffer until the wormdb is closed
+	for i := 0; i < 200; i++ {
+		if err := db.Add([]byte(fmt.Sprintf("full %04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err == nil || !strings.Contains(err.Error(), "no space left") {
+		t.Fatalf("expected the flush error from Close, got %v", err)
+	}
+	if !disk.closed {
+		t.Error("file was not closed after the flush failed")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db, bs := buildDB(t, []string{"apple", "banana", "cherry"})
+	s, ok := db.Search().(*bwdb.BinarySearch)
+	if !ok || s != bs {
+		t.Fatalf("Search returned %T, want the search attached", db.Search())
+	}
+	var buf bytes.Buffer
+	if err := s.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := bwdb.LoadBinarySearchReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(loaded.Index, bs.Index, bytes.Equal) {
+		t.Errorf("saved index %q, want %q", loaded.Index, bs.Index)
+	}
+	db.Close()
+	if db.Search() != nil {
+		t.Error("expected no search once closed")
+	}
+}
+
+func TestErrStopIteration(t *testing.T) {
+	var recs []string
+	for i := 0; i < 500; i++ {
+		recs = append(recs, fmt.Sprintf("stop %04d", i))
+	}
+	db, _ := buildDB(t, recs, bwdb.WithBlockSize(256))
+
+	// stopAfter returns a handler which stops on the nth call
+	stopAfter := func(n int, calls *int) func([]byte) error {
+		return func([]byte) error {
+			if *calls++; *calls == n {
+				return bwdb.ErrStopIteration
+			}
+			return nil
+		}
+	}
+	var calls int
+	if err := db.GetAll([]byte("stop 0"), stopAfter(3, &calls)); err != nil || calls != 3 {
+		t.Errorf("GetAll stopped after %d calls with %v", calls, err)
+	}
+	calls = 0
+	if err := db.Get([]byte("stop 0100"), stopAfter(1, &calls)); err != nil || calls != 1 {
+		t.Errorf("Get stopped after %d calls with %v", calls, err)
+	}
+	calls = 0
+	needles := [][]byte{[]byte("stop 0001"), []byte("stop 0200"), []byte("stop 0300")}
+	if err := db.GetBatch(needles, func(_, rec []byte) error { return stopAfter(2, &calls)(rec) }); err != nil || calls != 2 {
+		t.Errorf("GetBatch stopped after %d calls with %v", calls, err)
+	}
+	var walked atomic.Int64
+	if err := db.WalkParallel(4, func([]byte) error {
+		if walked.Add(1) == 10 {
+			return bwdb.ErrStopIteration
+		}
+		return nil
+	}); err != nil || walked.Load() < 10 {
+		t.Errorf("WalkParallel stopped after %d records with %v", walked.Load(), err)
+	}
+
+	// Any other error is still returned, even when wrapping the sentinel
+	wrapped := fmt.Errorf("handler failed: %w", bwdb.ErrStopIteration)
+	if err := db.GetAll([]byte("stop 0"), func([]byte) error { return wrapped }); err != wrapped {
+		t.Errorf("GetAll returned %v, want %v", err, wrapped)
+	}
+}
+
+// readCounter counts the reads of the file it wraps.
+type readCounter struct {
+	*os.File
+	reads atomic.Int64
+}
+
+func (r *readCounter) ReadAt(p []byte, off int64) (int, error) {
+	r.reads.Add(1)
+	return r.File.ReadAt(p, off)
+}
+
+func TestWithBlockCache(t *testing.T) {
+	var recs []string
+	for i := 0; i < 600; i++ {
+		recs = append(recs, fmt.Sprintf("block %04d", i))
+	}
+	for _, opts := range [][]bwdb.Option{
+		{bwdb.WithBlockSize(256)},
+		{bwdb.WithBlockSize(256), bwdb.WithBlockChecksum()},
+	} {
+		name := filepath.Join(t.TempDir(), "block.db")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs := bwdb.NewBinarySearch()
+		db, err := bwdb.New(f, append(opts, bwdb.WithSearch(bs))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			db.Add([]byte(rec))
+		}
+		db.Close()
+
+		if f, err = os.Open(name); err != nil {
+			t.Fatal(err)
+		}
+		rc := &readCounter{File: f}
+		db, err = bwdb.OpenReaderAt(rc, append(opts, bwdb.WithSearch(bwdb.LoadBinarySearch(bs.Index)), bwdb.WithBlockCache(4))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		get := func(needle string) {
+			t.Helper()
+			var got string
+			if err := db.Get([]byte(needle), func(rec []byte) error {
+				got = string(rec)
+				return nil
+			}); err != nil || got != needle {
+				t.Fatalf("Get(%q) = %q, %v", needle, got, err)
+			}
+		}
+
+		// Needles in the same block read it once
+		get("block 0101")
+		reads := rc.reads.Load()
+		get("block 0102")
+		get("block 0103")
+		if got := rc.reads.Load(); got != reads {
+			t.Errorf("cached block was read %d more times", got-reads)
+		}
+
+		// Walking more blocks than are held pushes the first one out
+		if got := walkAll(t, db); !slices.Equal(got, recs) {
+			t.Fatalf("walked %d records, want %d", len(got), len(recs))
+		}
+		reads = rc.reads.Load()
+		get("block 0101")
+		if got := rc.reads.Load(); got != reads+1 {
+			t.Errorf("evicted block was read %d times, want 1", got-reads)
+		}
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	var recs []string
+	for i := 0; i < 600; i++ {
+		recs = append(recs, fmt.Sprintf("memory %04d", i))
+	}
+	store := bwdb.NewMemStore()
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.NewReaderWriterAt(store, bwdb.WithSearch(bs), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if err := db.Add([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if store.Size() != int64(len(store.Bytes())) || store.Size() == 0 {
+		t.Fatalf("store holds %d bytes, size %d", len(store.Bytes()), store.Size())
+	}
+
+	db, err = bwdb.OpenReaderAt(store, bwdb.WithSearch(bwdb.LoadBinarySearch(bs.Index)), bwdb.WithBlockSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := walkAll(t, db); !slices.Equal(got, recs) {
+		t.Fatalf("walked %d records, want %d", len(got), len(recs))
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads past the end and writes leaving a gap
+	buf := make([]byte, 4)
+	if n, err := store.ReadAt(buf, store.Size()-2); n != 2 || err != io.EOF {
+		t.Errorf("read at the end got %d bytes and %v", n, err)
+	}
+	gap := bwdb.NewMemStore()
+	gap.WriteAt([]byte("ab"), 3)
+	if got := gap.Bytes(); !bytes.Equal(got, []byte("\x00\x00\x00ab")) {
+		t.Errorf("write after a gap left %q", got)
+	}
+}
+
+func ExampleNewMemStore() {
+	store := bwdb.NewMemStore()
+	bs := bwdb.NewBinarySearch()
+	db, err := bwdb.NewReaderWriterAt(store, bwdb.WithSearch(bs))
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.Add([]byte("apple"))
+	db.Add([]byte("banana"))
+	db.Add([]byte("cherry"))
+	db.Finalize()
+
+	db.Get([]byte("ban"), func(rec []byte) error {
+		fmt.Printf("found: %s\n", rec)
+		return nil
+	})
+	db.Close()
+	// Output:
+	// found: banana
+}
+
+func TestWithUnsafeNoOrderCheck(t *testing.T) {
+	db, _ := buildDB(t, []string{"b", "a"}, bwdb.WithUnsafeNoOrderCheck())
+	if err := db.Verify(); !errors.Is(err, bwdb.ErrOutOfOrder) {
+		t.Errorf("expected Verify to find %v, got %v", bwdb.ErrOutOfOrder, err)
+	}
+	db, _ = buildDB(t, []string{"a", "b", "c"}, bwdb.WithUnsafeNoOrderCheck())
+	if got := walkAll(t, db); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("walked %q", got)
+	}
+}
+
+func TestErrMergeOrder(t *testing.T) {
+	old, _ := buildDB(t, []string{"a", "c", "b", "d"}, bwdb.WithUnsafeNoOrderCheck())
+	for _, opts := range [][]bwdb.Option{nil, {bwdb.WithUnsafeNoOrderCheck()}} {
+		f, err := os.CreateTemp(t.TempDir(), "*.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := bwdb.New(f, append(opts, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithMerge(old, bytes.Compare))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Add([]byte("e")); !errors.Is(err, bwdb.ErrMergeOrder) {
+			t.Errorf("expected Add to return %v, got %v", bwdb.ErrMergeOrder, err)
+		}
+	}
+
+	// The unsorted records may also only be reached when finalizing
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithMerge(old, bytes.Compare))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Finalize(); !errors.Is(err, bwdb.ErrMergeOrder) {
+		t.Errorf("expected Finalize to return %v, got %v", bwdb.ErrMergeOrder, err)
+	}
+	if got := walkAll(t, db); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("expected the records before the failure, walked %q", got)
+	}
+}
+
+func TestWalkerReuse(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		recs = append(recs, fmt.Sprintf("reuse %04d", i*7))
+	}
+	for _, tc := range []struct {
+		opts   []bwdb.Option
+		prefix bool
+	}{
+		{nil, true},
+		{[]bwdb.Option{bwdb.WithRecordCount()}, true},
+		{[]bwdb.Option{bwdb.WithPrefixCompression(false)}, false},
+	} {
+		db, _ := buildDB(t, recs, append(tc.opts, bwdb.WithBlockSize(256))...)
+		var (
+			want    = map[string]int{}
+			prev    string
+			prevBlk int64 = -1
+			firsts  int
+		)
+		w := db.NewWalker()
+		for w.Scan() {
+			if blk := w.Offset() / 256; blk != prevBlk {
+				prevBlk, prev = blk, ""
+				firsts++
+			}
+			var n int
+			for tc.prefix && n < len(prev) && prev[n] == w.Text()[n] {
+				n++
+			}
+			want[w.Text()] = n
+			prev = w.Text()
+		}
+		if firsts < 2 {
+			t.Fatalf("expected several blocks, got %d", firsts)
+		}
+
+		for _, w := range []*bwdb.Walker{db.NewWalker(), db.NewReverseWalker()} {
+			var seen int
+			for w.Scan() {
+				seen++
+				if got := w.Reuse(); got != want[w.Text()] {
+					t.Fatalf("Reuse() at %q = %d, want %d", w.Text(), got, want[w.Text()])
+				}
+			}
+			if seen != len(recs) {
+				t.Fatalf("walked %d records, want %d", seen, len(recs))
+			}
+		}
+	}
+}
+
+func TestWithPreallocate(t *testing.T) {
+	var recs []string
+	for i := 0; i < 600; i++ {
+		recs = append(recs, fmt.Sprintf("prealloc %04d", i))
+	}
+	codec, err := bwdb.NewGzipCodec(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// build returns the file written with the options, checking it is first
+	// grown to at least the given number of bytes
+	build := func(least int64, opts ...bwdb.Option) []byte {
+		f, err := os.CreateTemp(t.TempDir(), "*.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := bwdb.New(f, append(opts, bwdb.WithSearch(bwdb.NewBinarySearch()))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if fi, err := f.Stat(); err != nil || fi.Size() < least {
+			t.Fatalf("expected the file to be grown to %d bytes, got %d", least, fi.Size())
+		}
+		for _, rec := range recs {
+			if err := db.Add([]byte(rec)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Finalize(); err != nil {
+			t.Fatal(err)
+		}
+		if got := walkAll(t, db); !slices.Equal(got, recs) {
+			t.Fatalf("walked %d records, want %d", len(got), len(recs))
+		}
+		dat, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dat
+	}
+	for _, opts := range [][]bwdb.Option{
+		{bwdb.WithBlockSize(256)},
+		{bwdb.WithBlockSize(256), bwdb.WithByteOffset(10)},
+		{bwdb.WithBlockSize(256), bwdb.WithCompression(codec)},
+	} {
+		want := build(0, opts...)
+		if got := build(1<<20, append(opts, bwdb.WithPreallocate(1<<20))...); !bytes.Equal(got, want) {
+			t.Fatalf("expected the same %d bytes as without preallocating, got %d", len(want), len(got))
+		}
+	}
+}
+
+func TestWithLargeRecords(t *testing.T) {
+	var recs []string
+	for i := 0; i < 300; i++ {
+		rec := fmt.Sprintf("large %03d ", i)
+		if i%25 == 0 {
+			// Several blocks long
+			rec += strings.Repeat(fmt.Sprint(i%10), 200*i+300)
+		}
+		recs = append(recs, rec)
+	}
+	reversed := slices.Clone(recs)
+	slices.Reverse(reversed)
+	codec, err := bwdb.NewGzipCodec(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, opts := range map[string][]bwdb.Option{
+		"plain":    nil,
+		"checksum": {bwdb.WithBlockChecksum()},
+		"count":    {bwdb.WithRecordCount()},
+		"suffix":   {bwdb.WithSuffixCompression()},
+		"compress": {bwdb.WithCompression(codec)},
+		"mmap":     {bwdb.WithMmap()},
+		"cache":    {bwdb.WithBlockCache(4)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts = append(opts, bwdb.WithBlockSize(256), bwdb.WithVarint(), bwdb.WithLargeRecords())
+			file := filepath.Join(t.TempDir(), "large.db")
+			f, err := os.Create(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bs := bwdb.NewBinarySearch()
+			db, err := bwdb.New(f, append(opts, bwdb.WithSearch(bs))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// End on a large record, so appending begins a new block after it
+			for _, rec := range recs[:276] {
+				if err := db.Add([]byte(rec)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if f, err = os.OpenFile(file, os.O_RDWR, 0); err != nil {
+				t.Fatal(err)
+			}
+			if db, err = bwdb.OpenForAppend(f, bs, opts...); err != nil {
+				t.Fatal(err)
+			}
+			for _, rec := range recs[276:] {
+				if err := db.Add([]byte(rec)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if f, err = os.Open(file); err != nil {
+				t.Fatal(err)
+			}
+			if db, err = bwdb.Open(f, append(opts, bwdb.WithSearch(bs))...); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			if got := walkAll(t, db); !slices.Equal(got, recs) {
+				t.Fatalf("walked %d records, want %d", len(got), len(recs))
+			}
+			var got []string
+			w := db.NewReverseWalker()
+			for w.Scan() {
+				got = append(got, w.Text())
+			}
+			if !slices.Equal(got, reversed) {
+				t.Fatalf("walked back %d records, want %d", len(got), len(reversed))
+			}
+			for _, rec := range recs {
+				got, found, err := db.Lookup([]byte(rec))
+				if err != nil || !found || string(got) != rec {
+					t.Fatalf("Lookup(%q) = %d bytes, %v, %v", rec[:10], len(got), found, err)
+				}
+			}
+		})
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bwdb.New(f, bwdb.WithSearch(bwdb.NewBinarySearch()), bwdb.WithBlockSize(256), bwdb.WithVarint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Add([]byte(recs[25])); !errors.Is(err, bwdb.ErrRecordTooLong) {
+		t.Errorf("expected %v without large records, got %v", bwdb.ErrRecordTooLong, err)
+	}
+}